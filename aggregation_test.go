@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"github.com/LimeHD/limehd-syslog-server/lib"
+	"sync"
+	"testing"
+)
+
+func TestShardedAggregation(t *testing.T) {
+	online := lib.NewOnlineExact()
+	stream := lib.NewStream()
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 35; worker++ {
+		wg.Add(1)
+
+		go func(worker int) {
+			defer wg.Done()
+
+			// каждый зритель приходит от нескольких обработчиков
+			for i := 0; i < 10000; i++ {
+				online.Peek(_identity("karusel", i))
+				stream.Add(_identity("karusel", i), lib.InfluxRequestParams{
+					InfluxRequestTags: lib.InfluxRequestTags{Channel: "karusel"},
+				})
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	if count := online.Connections()["karusel"].Count(); count != 10000 || online.Total() != 10000 || online.Count() != 1 {
+		t.Errorf("expected 10000 unique viewers on one channel, got %d", count)
+	}
+
+	if stream.Len() != 350000 || len(stream.All()) != 350000 {
+		t.Errorf("expected 350000 requests in stream, got %d", stream.Len())
+	}
+
+	if collected := stream.Collect(); len(collected) != 350000 {
+		t.Errorf("expected 350000 collected requests, got %d", len(collected))
+	}
+
+	online.Flush()
+
+	if stream.Len() != 0 || online.Total() != 0 {
+		t.Error("expected empty aggregation after flush")
+	}
+}
+
+// пропускная способность агрегации в зависимости от количества обработчиков (worker-count),
+// все обработчики пишут в один канал, как во время трансляции финала
+func BenchmarkAggregation(b *testing.B) {
+	for _, workers := range []int{1, 4, 16, 35} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			online := lib.NewOnlineExact()
+			stream := lib.NewStream()
+			identities := make([]lib.UniqueIdentity, 100000)
+
+			for i := range identities {
+				identities[i] = _identity("match", i)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			var wg sync.WaitGroup
+			for worker := 0; worker < workers; worker++ {
+				wg.Add(1)
+
+				go func(worker int) {
+					defer wg.Done()
+
+					for i := worker; i < b.N; i += workers {
+						online.Peek(identities[i%len(identities)])
+						stream.Add(identities[i%len(identities)], lib.InfluxRequestParams{
+							InfluxRequestFields: lib.InfluxRequestFields{BytesSent: i},
+						})
+					}
+				}(worker)
+			}
+			wg.Wait()
+		})
+	}
+}
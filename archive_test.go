@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/LimeHD/limehd-syslog-server/lib"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchiveSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := lib.NewFileLogger(lib.LoggerConfig{})
+	parser, _ := _parsers(t)
+
+	log, err := parser.Parse(_generateRandomParts())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := lib.NewArchiveSink(lib.ArchiveSinkConfig{
+		Dir:     dir,
+		MaxSize: 1,
+		Logger:  logger,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := lib.Receiver{Parser: log}
+
+	for i := 0; i < 3; i++ {
+		if err := archive.WriteEvents([]lib.Receiver{event}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archive.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "events-*.ndjson.gz"))
+
+	// лимит размера в 1 байт - каждое событие в своем файле
+	if len(files) != 3 {
+		t.Fatalf("expected 3 rotated files, got %d", len(files))
+	}
+
+	f, err := os.Open(files[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scanner := bufio.NewScanner(zr)
+
+	if !scanner.Scan() {
+		t.Fatal("archive file is empty")
+	}
+
+	record := lib.EventRecord{}
+
+	if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+
+	if record.Status != 404 || record.Channel != "domashniy" || record.RemoteAddr != "127.0.0.1" {
+		t.Errorf("unexpected record %+v", record)
+	}
+}
+
+func TestEventQueueCollectDoesNotLoseEvents(t *testing.T) {
+	events := lib.NewEventQueue()
+
+	done := make(chan bool)
+	go func() {
+		// события добавляются, пока планировщик забирает пачки
+		for i := 0; i < 10000; i++ {
+			events.Add(_identity("karusel", i), lib.Receiver{})
+		}
+		close(done)
+	}()
+
+	collected := 0
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+
+		collected += len(events.Collect())
+	}
+
+	if collected != 10000 || events.Len() != 0 {
+		t.Errorf("expected 10000 collected events, got %d", collected)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"github.com/LimeHD/limehd-syslog-server/lib"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAudienceCounter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audience")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := lib.AudienceCounterConfig{
+		Path:      filepath.Join(dir, "audience.snapshot"),
+		Precision: 14,
+		Logger:    lib.NewFileLogger(lib.LoggerConfig{}),
+	}
+
+	audience, err := lib.NewAudienceCounter(config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// один и тот же зритель смотрит оба канала
+	for i := 0; i < 10000; i++ {
+		audience.Peek(_identity("domashniy", i))
+		audience.Peek(_identity("karusel", i))
+	}
+
+	if reports, err := audience.Rotate(time.Now()); err != nil || len(reports) != 0 {
+		t.Fatalf("period is not finished yet: %v, %v", reports, err)
+	}
+
+	if err := audience.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := lib.NewAudienceCounter(config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := restored.Restore(); err != nil || !ok {
+		t.Fatalf("audience is not restored: %v", err)
+	}
+
+	reports, err := restored.Rotate(time.Now().AddDate(0, 0, 1))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var day *lib.AudienceReport
+	for i := range reports {
+		if reports[i].Period == lib.AUDIENCE_PERIOD_DAY {
+			day = &reports[i]
+		}
+	}
+
+	if day == nil {
+		t.Fatal("expected day report")
+	}
+
+	for _, unique := range []int{day.Total, day.Channels["domashniy"], day.Channels["karusel"]} {
+		if math.Abs(float64(unique-10000))/10000 > 0.03 {
+			t.Errorf("expected ~10000 unique viewers, got %d", unique)
+		}
+	}
+
+	// новый день начинается с нуля, месяц продолжается, если не закончился
+	for _, current := range restored.Current() {
+		if current.Period == lib.AUDIENCE_PERIOD_DAY && current.Total != 0 {
+			t.Errorf("new day must be empty, got %d", current.Total)
+		}
+	}
+}
+
+func TestAudienceConcurrentPeek(t *testing.T) {
+	audience, err := lib.NewAudienceCounter(lib.AudienceCounterConfig{
+		Precision: 14,
+		Logger:    lib.NewFileLogger(lib.LoggerConfig{}),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 16; worker++ {
+		wg.Add(1)
+
+		go func(worker int) {
+			defer wg.Done()
+
+			// каналы создаются одновременно несколькими обработчиками
+			for i := worker; i < 20000; i += 16 {
+				audience.Peek(_identity(fmt.Sprintf("channel-%d", i%4), i))
+			}
+		}(worker)
+	}
+
+	// текущие значения читаются, пока зрители пишутся
+	for i := 0; i < 10; i++ {
+		audience.Current()
+	}
+	wg.Wait()
+
+	for _, current := range audience.Current() {
+		if math.Abs(float64(current.Total-20000))/20000 > 0.03 {
+			t.Errorf("expected ~20000 unique viewers for %s, got %d", current.Period, current.Total)
+		}
+
+		if len(current.Channels) != 4 {
+			t.Errorf("expected 4 channels for %s, got %v", current.Period, current.Channels)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/LimeHD/limehd-syslog-server/lib"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestClickHouseSink(t *testing.T) {
+	var mt sync.Mutex
+	var queries []string
+	var rows []map[string]interface{}
+	inserts := 0
+	creates := 0
+
+	// HTTP интерфейс ClickHouse: запрос в ?query=, данные в теле
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mt.Lock()
+		defer mt.Unlock()
+
+		query := r.URL.Query().Get("query")
+		queries = append(queries, query)
+
+		// ClickHouse недоступен при запуске: таблица создается перед первой записью
+		if strings.HasPrefix(query, "CREATE") {
+			if creates++; creates == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+
+		if strings.HasPrefix(query, "INSERT") {
+			inserts++
+
+			// первая попытка вставки падает, проверяем повтор
+			if inserts == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			scanner := bufio.NewScanner(r.Body)
+
+			for scanner.Scan() {
+				row := map[string]interface{}{}
+
+				if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+					t.Error(err)
+				}
+
+				rows = append(rows, row)
+			}
+		}
+	}))
+	defer server.Close()
+
+	logger := lib.NewFileLogger(lib.LoggerConfig{})
+	parser, _ := _parsers(t)
+
+	log, err := parser.Parse(_generateRandomParts())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clickhouse, err := lib.NewClickHouseSink(lib.ClickHouseSinkConfig{
+		Addr:      server.URL,
+		Database:  "analytics",
+		Table:     "requests",
+		Retries:   1,
+		BatchSize: 2,
+		IpHashKey: "secret",
+		Logger:    logger,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := lib.Receiver{Parser: log, SampleRate: 0.5}
+
+	if err := clickhouse.WriteEvents([]lib.Receiver{event, event, event}); err != nil {
+		t.Fatal(err)
+	}
+
+	if creates != 2 || !strings.HasPrefix(queries[1], "CREATE TABLE IF NOT EXISTS analytics.requests (time DateTime64") {
+		t.Errorf("table must be created again before the first insert, got %q", queries)
+	}
+
+	// 2 строки + повтор, затем 1 строка
+	if inserts != 3 || len(rows) != 3 {
+		t.Fatalf("expected 3 insert requests with 3 rows, got %d requests with %d rows", inserts, len(rows))
+	}
+
+	if rows[0]["channel"] != "domashniy" || rows[0]["status"] != float64(404) || rows[0]["sample_rate"] != 0.5 {
+		t.Errorf("unexpected row %v", rows[0])
+	}
+
+	if _, ok := rows[0]["ip_hash"]; !ok {
+		t.Error("row must contain ip_hash")
+	}
+
+	// без секрета хеш IPv4 восстанавливается перебором, поэтому приемник не создается
+	if _, err := lib.NewClickHouseSink(lib.ClickHouseSinkConfig{Addr: server.URL, Logger: logger}); err == nil {
+		t.Error("expected clickhouse sink without ip hash key to be rejected")
+	}
+}
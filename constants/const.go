@@ -16,6 +16,45 @@ const DEFAULT_LOG_FILE = "./tmp/log"
 const DEFAULT_MAXMIND_DATABASE = "/usr/share/GeoIP/GeoLite2-City.mmdb"
 const DEFAULT_MAXMIND_ASN_DATABASE = "/usr/share/GeoIP/GeoLite2-ASN.mmdb"
 
+// уникальный пользователь по умолчанию - пара ip и user-agent
+const DEFAULT_IDENTITY = "remote_addr+http_user_agent"
+
+// режимы подсчета онлайн пользователей
+const ONLINE_MODE_EXACT = "exact"
+const ONLINE_MODE_HYPERLOGLOG = "hyperloglog"
+const ONLINE_MODE_SLIDING = "sliding"
+
+// режимы фильтрации запросов не от зрителей
+const FILTER_MODE_DROP = "drop"
+const FILTER_MODE_TAG = "tag"
+
+// политики переполнения очереди задач
+const POOL_OVERFLOW_BLOCK = "block"
+const POOL_OVERFLOW_DROP_NEWEST = "drop-newest"
+const POOL_OVERFLOW_DROP_OLDEST = "drop-oldest"
+const POOL_OVERFLOW_SAMPLE = "sample"
+
+// примерный размер элементов очередей пула в памяти: сырой лог с замыканием, разобранный лог и ошибка
+const POOL_TASK_SIZE = 2048
+const POOL_RECEIVER_SIZE = 1024
+const POOL_ERROR_SIZE = 256
+
+// при политике sample выборка включается, когда очередь задач заполнена на эту долю
+const POOL_SAMPLE_WATERMARK = 0.8
+
+// количество шардов онлайна, очереди трафика, сессий и блокировок аудитории
+const AGGREGATION_SHARDS = 64
+
+// версия хэша пользователей в снимках: хэши другой версии несовместимы с текущими
+const IDENTITY_HASH = "fnv1a-mix64"
+
+// параметры FNV-1a 64, те же, что в hash/fnv
+const FNV_OFFSET_64 = 14695981039346656037
+const FNV_PRIME_64 = 1099511628211
+
+// точность доли выборки: зрители делятся на столько корзин по хэшу
+const SAMPLER_BUCKETS = 1000000
+
 // константы частей лога, всего из 22 в качестве значений указываются ИНДЕКСЫ 0..21
 const FULL_LEN_OF_PARTS = 22
 
@@ -40,3 +79,38 @@ const LOG_FILE_ON_EXIST = "Файл для логов не обнаружен, 
 const TEMPLATE_FILE_NOT_EXIST = "Файл конфигурации не найден"
 const TEMPLATE_FILE_NOT_LOADED = "Не удалось загрузить шаблон"
 const NOT_AVAILABLE_URI = "Данный тип ссылок не поддерживается"
+const INFLUX_DATABASE_REQUIRED = "Для Influx v1 необходимо указать базу данных (--influx-db)"
+const INFLUX2_ORG_BUCKET_REQUIRED = "Для Influx v2 необходимо указать организацию и бакет (--influx-org, --influx-bucket)"
+const INFLUX_UNSUPPORTED_VERSION = "Неподдерживаемая версия Influx"
+const INFLUX_INVALID_PRECISION = "Неподдерживаемая точность временных меток Influx"
+const INFLUX_WRITE_FAILED = "Не удалось записать данные в Influx"
+const INFLUX_NOT_AVAILABLE = "Influx недоступен при запуске, данные будут отправляться, когда он станет доступен"
+const PROMETHEUS_UNKNOWN_LABEL = "Неизвестная метка Prometheus"
+const PROMETHEUS_WITHOUT_HTTP = "Для экспорта метрик Prometheus необходимо указать адрес HTTP сервера (--http-address)"
+const CLICKHOUSE_QUERY_FAILED = "Не удалось выполнить запрос к ClickHouse"
+const CLICKHOUSE_NOT_AVAILABLE = "ClickHouse недоступен при запуске, таблица будет создана перед первой записью"
+const CLICKHOUSE_IP_KEY_REQUIRED = "Для записи в ClickHouse необходимо указать секрет для хеша IP (--clickhouse-ip-key)"
+const HLL_INVALID_PRECISION = "Точность HyperLogLog должна быть в пределах от 4 до 18"
+const HLL_PRECISION_MISMATCH = "Нельзя объединить скетчи HyperLogLog разной точности"
+const FILTER_UNKNOWN_MODE = "Неизвестный режим фильтрации запросов"
+const FILTER_RULE_INVALID = "Неверное правило фильтрации запросов"
+const SAMPLER_INVALID_RATE = "Доля выборки зрителей должна быть больше 0 и не больше 1"
+const SAMPLER_READ_ONLY = "Доля выборки меняется только с --sampling-token"
+const SAMPLER_UNAUTHORIZED = "Неверный токен для изменения доли выборки"
+const UDP_REUSEPORT_NOT_SUPPORTED = "Прием через несколько UDP сокетов (SO_REUSEPORT) поддерживается только в Linux"
+const UDP_STATS_NOT_AVAILABLE = "Статистика UDP сокетов ядра недоступна"
+const UDP_STATS_INVALID = "Не удалось разобрать статистику UDP сокетов"
+const POOL_WORKER_PANIC = "Обработчик пула восстановлен после паники"
+const POOL_UNKNOWN_OVERFLOW = "Неизвестная политика переполнения очереди"
+const POOL_INVALID_SAMPLE_RATE = "Доля зрителей для политики sample должна быть больше 0 и не больше 1"
+const UA_RULE_INVALID = "Неверное правило классификации User-Agent"
+const IDENTITY_UNKNOWN_FIELD = "Неизвестное поле для идентификации пользователя"
+const ONLINE_UNKNOWN_DIMENSION = "Неизвестное измерение онлайн пользователей"
+const ONLINE_UNKNOWN_MODE = "Неизвестный режим подсчета онлайн пользователей"
+const SNAPSHOT_MISMATCH = "Снимок онлайна не соответствует текущей конфигурации"
+const SNAPSHOT_NOT_SUPPORTED = "Счетчик онлайна не поддерживает сохранение состояния"
+const COMPONENT_EXITED = "Компонент завершился без остановки"
+const COMPONENT_NOT_FOUND = "Компонент не найден"
+const SINK_CLOSED = "Приемники уже закрыты, пачка данных потеряна"
+const SINK_BUFFER_OVERFLOW = "Буфер приемника переполнен, пачка данных потеряна"
+const SINK_DRAIN_TIMEOUT = "Приемники не успели отправить накопленное при остановке, пачек потеряно"
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/LimeHD/limehd-syslog-server/constants"
+	"github.com/LimeHD/limehd-syslog-server/lib"
+	"testing"
+)
+
+func TestRequestFilter(t *testing.T) {
+	filter, err := lib.NewRequestFilter(lib.RequestFilterConfig{
+		UserAgents: []string{"(?i)zabbix"},
+		Networks:   []string{"10.0.0.0/8"},
+		Hosts:      []string{"health.limehd.tv"},
+		Bots:       true,
+		Mode:       constants.FILTER_MODE_TAG,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		values   map[int]string
+		device   string
+		expected string
+	}{
+		{map[int]string{constants.POS_REMOTE_ADDR: "83.219.236.137"}, "smarttv", ""},
+		{map[int]string{constants.POS_HTTP_USER_AGENT: "Zabbix"}, "unknown", "ua:(?i)zabbix"},
+		{map[int]string{constants.POS_REMOTE_ADDR: "10.1.2.3"}, "smarttv", "cidr:10.0.0.0/8"},
+		{map[int]string{constants.POS_HOST: "Health.limehd.tv"}, "smarttv", "host:health.limehd.tv"},
+		{map[int]string{}, "bot", "bot"},
+	}
+
+	for _, c := range cases {
+		receiver := lib.Receiver{
+			Parser: _parseWith(t, c.values),
+			Device: lib.DeviceInfo{DeviceType: c.device},
+		}
+
+		if actual := filter.Match(receiver); actual != c.expected {
+			t.Errorf("%v: expected rule %q, got %q", c.values, c.expected, actual)
+		}
+	}
+
+	if filter.Drops() {
+		t.Error("tag mode must not drop requests")
+	}
+
+	counters := filter.Counters()
+
+	for _, rule := range []string{"ua:(?i)zabbix", "cidr:10.0.0.0/8", "host:health.limehd.tv", "bot"} {
+		if counters[rule] != 1 {
+			t.Errorf("counter for %s: expected 1, got %d", rule, counters[rule])
+		}
+	}
+
+	if _, err := lib.NewRequestFilter(lib.RequestFilterConfig{Networks: []string{"10.0.0.0"}, Mode: constants.FILTER_MODE_DROP}); err == nil {
+		t.Error("expected invalid network error")
+	}
+
+	if _, err := lib.NewRequestFilter(lib.RequestFilterConfig{UserAgents: []string{"(?i)zabbix("}, Mode: constants.FILTER_MODE_DROP}); err == nil {
+		t.Error("expected invalid user agent rule error")
+	}
+
+	if _, err := lib.NewRequestFilter(lib.RequestFilterConfig{Mode: "skip"}); err == nil {
+		t.Error("expected unknown mode error")
+	}
+}
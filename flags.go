@@ -35,10 +35,36 @@ var CliFlags = []cli.Flag{
 		Usage:    "URL подключения к Influx, например: http://0.0.0.0:8086",
 		Required: true,
 	},
+	&cli.IntFlag{
+		Name:  "influx-version",
+		Usage: "Версия API Influx: 1 (база данных) или 2 (организация, бакет и токен)",
+		Value: 1,
+	},
 	&cli.StringFlag{
-		Name:     "influx-db",
-		Usage:    "Название базы данных в Influx",
-		Required: true,
+		Name:  "influx-db",
+		Usage: "Название базы данных в Influx, только для --influx-version 1",
+	},
+	&cli.StringFlag{
+		Name:  "influx-org",
+		Usage: "Организация в Influx, только для --influx-version 2",
+	},
+	&cli.StringFlag{
+		Name:  "influx-bucket",
+		Usage: "Бакет в Influx, только для --influx-version 2",
+	},
+	&cli.StringFlag{
+		Name:   "influx-token",
+		Usage:  "Токен авторизации в Influx, только для --influx-version 2",
+		EnvVar: "INFLUX_TOKEN",
+	},
+	&cli.StringFlag{
+		Name:  "influx-precision",
+		Usage: "Точность временных меток для Influx v2: ns, us, ms или s",
+		Value: "ns",
+	},
+	&cli.BoolTFlag{
+		Name:  "influx-gzip",
+		Usage: "Сжимать запросы к Influx v2 с помощью gzip",
 	},
 	&cli.StringFlag{
 		Name:     "influx-measurement",
@@ -50,17 +76,237 @@ var CliFlags = []cli.Flag{
 		Usage:    "Название измерения (measurement) в Influx для счетчиков online пользователей",
 		Required: true,
 	},
+	&cli.StringFlag{
+		Name:  "influx-measurement-sessions",
+		Usage: "Название измерения (measurement) в Influx для сессий просмотра",
+		Value: "sessions",
+	},
+	&cli.StringFlag{
+		Name:  "influx-measurement-watch-time",
+		Usage: "Название измерения (measurement) в Influx для среднего времени просмотра по каналам",
+		Value: "watch_time",
+	},
+	&cli.StringFlag{
+		Name:  "influx-measurement-internal",
+		Usage: "Название измерения (measurement) в Influx для внутренних метрик конвейера: очереди, задержки, отброшенные логи",
+		Value: "syslog_internal",
+	},
+	&cli.Float64Flag{
+		Name:  "sample-rate",
+		Usage: "Доля зрителей, которые учитываются в трафике и онлайне (выборка по хэшу идентификатора), 1 - все, меняется на лету через /sampling",
+		Value: 1,
+	},
+	&cli.StringFlag{
+		Name:   "sampling-token",
+		Usage:  "Токен для изменения доли выборки через POST /sampling, без него доля только читается",
+		EnvVar: "SAMPLING_TOKEN",
+	},
+	&cli.Int64Flag{
+		Name:  "metrics-interval",
+		Usage: "Как часто писать внутренние метрики конвейера в Influx (в секундах), 0 - не писать",
+		Value: 10,
+	},
+	&cli.StringFlag{
+		Name:  "influx-measurement-audience",
+		Usage: "Название измерения (measurement) в Influx для уникальных зрителей за день и месяц",
+		Value: "audience",
+	},
 	&cli.Int64Flag{
 		Name:     "online-duration",
 		Usage:    "За какой промежуток агрегировать уникальных пользователей (в секундах)",
 		Value:    300,
 		Required: true,
 	},
+	&cli.StringFlag{
+		Name:  "ua-rules",
+		Usage: "Файл дополнительных правил определения устройства по User-Agent: строки device_type|os|app|регулярное выражение, \"-\" - поле не задается. Правила из файла проверяются раньше встроенных",
+	},
+	&cli.IntFlag{
+		Name:  "ua-cache-size",
+		Usage: "Сколько различных User-Agent хранить в кэше классификатора",
+		Value: 10000,
+	},
+	&cli.Int64Flag{
+		Name:  "shutdown-timeout",
+		Usage: "Сколько секунд при остановке ждать обработки уже принятых логов и отдельно отправки накопленного в приемники, необработанные к этому времени считаются потерянными",
+		Value: 10,
+	},
+	&cli.StringFlag{
+		Name:  "filter-user-agents",
+		Usage: "Регулярные выражения User-Agent через запятую, запросы с которыми не считаются зрителями (мониторинг, проверки доступности)",
+	},
+	&cli.StringFlag{
+		Name:  "filter-networks",
+		Usage: "Подсети через запятую в нотации CIDR, запросы из которых не считаются зрителями, например: 10.0.0.0/8,127.0.0.1/32",
+	},
+	&cli.StringFlag{
+		Name:  "filter-hosts",
+		Usage: "Значения $host через запятую, запросы на которые не считаются зрителями",
+	},
+	&cli.BoolFlag{
+		Name:  "filter-bots",
+		Usage: "Не считать зрителями запросы, User-Agent которых определен как bot",
+	},
+	&cli.StringFlag{
+		Name:  "filter-mode",
+		Usage: "Что делать с отфильтрованными запросами: drop (не учитывать нигде) или tag (учитывать в трафике с тэгом filtered, но не в онлайне и сессиях)",
+		Value: constants.FILTER_MODE_DROP,
+	},
+	&cli.StringFlag{
+		Name:  "identity",
+		Usage: "Из каких полей строить ключ уникального пользователя: стратегии через запятую пробуются по очереди, поля стратегии объединяются через +. Поля: remote_addr, http_user_agent, sent_http_x_profile, http_x_forwarded_for, args, arg:<параметр из $args>. Например: arg:token,sent_http_x_profile,remote_addr+http_user_agent",
+		Value: constants.DEFAULT_IDENTITY,
+	},
+	&cli.StringFlag{
+		Name:  "online-mode",
+		Usage: "Режим подсчета уникальных пользователей: exact (точно, память растет с количеством зрителей), hyperloglog (оценка с постоянной памятью на канал) или sliding (скользящее окно online-duration, значение отправляется каждые online-tick секунд)",
+		Value: constants.ONLINE_MODE_EXACT,
+	},
+	&cli.Int64Flag{
+		Name:  "online-peak-interval",
+		Usage: "Длина интервала, по которому ищется пик онлайна внутри окна (в секундах): пик - наибольшее количество зрителей, которые были видны за один интервал, 0 - пики не считаются",
+		Value: 10,
+	},
+	&cli.StringFlag{
+		Name:  "online-dimensions",
+		Usage: "Дополнительные срезы онлайна по каналам через запятую: country, asn, asn_org, quality, streaming_server, host, device_type, os, app, identity (сработавшая стратегия --identity). Каждый срез пишется в measurement <influx-measurement-online>_<срез>",
+	},
+	&cli.Int64Flag{
+		Name:  "online-tick",
+		Usage: "Как часто отправлять онлайн в режиме sliding (в секундах)",
+		Value: 10,
+	},
+	&cli.IntFlag{
+		Name:  "online-hll-precision",
+		Usage: "Точность HyperLogLog от 4 до 18: скетч занимает 2^N байт на канал, погрешность ~1.04/sqrt(2^N)",
+		Value: 14,
+	},
+	&cli.StringFlag{
+		Name:  "online-snapshot",
+		Usage: "Файл для сохранения состояния онлайна между перезапусками, если не указан - состояние не сохраняется",
+	},
+	&cli.Int64Flag{
+		Name:  "online-snapshot-interval",
+		Usage: "Как часто сохранять состояние онлайна на диск (в секундах)",
+		Value: 60,
+	},
+	&cli.Int64Flag{
+		Name:  "online-snapshot-max-age",
+		Usage: "Снимок онлайна старше этого возраста (в секундах) при запуске игнорируется",
+		Value: 600,
+	},
+	&cli.BoolFlag{
+		Name:  "audience",
+		Usage: "Считать уникальных зрителей за календарный день и месяц (DAU/MAU), итоги пишутся в Influx по окончании периода",
+	},
+	&cli.StringFlag{
+		Name:  "audience-snapshot",
+		Usage: "Файл для сохранения скетчей DAU/MAU между перезапусками, если не указан - состояние не сохраняется",
+	},
+	&cli.IntFlag{
+		Name:  "audience-hll-precision",
+		Usage: "Точность HyperLogLog для DAU/MAU от 4 до 18",
+		Value: 14,
+	},
+	&cli.Int64Flag{
+		Name:  "audience-interval",
+		Usage: "Как часто проверять окончание дня и сохранять скетчи DAU/MAU (в секундах)",
+		Value: 60,
+	},
+	&cli.BoolFlag{
+		Name:  "sessions",
+		Usage: "Отслеживать сессии просмотра: длительность, трафик, качества, страна и ASN зрителя",
+	},
+	&cli.Int64Flag{
+		Name:  "session-idle-timeout",
+		Usage: "Через сколько секунд без медиа сегментов сессия считается закрытой",
+		Value: 60,
+	},
+	&cli.Int64Flag{
+		Name:  "session-segment-duration",
+		Usage: "Длительность медиа сегмента (в секундах), добавляется к сессии за досмотр последнего сегмента",
+		Value: 6,
+	},
+	&cli.Int64Flag{
+		Name:  "session-duration",
+		Usage: "Как часто закрывать простаивающие сессии и отправлять их вместе со средним временем просмотра (в секундах)",
+		Value: 60,
+	},
 	&cli.Int64Flag{
 		Name:  "stream-duration",
 		Usage: "За какой промежуток агрегировать данные по стримингу (в секундах)",
 		Value: 5,
 	},
+	&cli.IntFlag{
+		Name:  "sink-buffer-size",
+		Usage: "Количество пачек данных, ожидающих отправки в каждый из приемников (influx и т.д.)",
+		Value: 100,
+	},
+	&cli.StringFlag{
+		Name:  "http-address",
+		Usage: "IP и порт служебного HTTP сервера, например: 0.0.0.0:9100. Если не указан - сервер не запускается",
+	},
+	&cli.BoolFlag{
+		Name:  "prometheus",
+		Usage: "Отдавать онлайн и счетчики трафика в формате Prometheus на /metrics служебного HTTP сервера",
+	},
+	&cli.StringFlag{
+		Name:  "prometheus-labels",
+		Usage: "Метки счетчиков трафика Prometheus через запятую: channel, quality, country, asn_number, asn_org, streaming_server, host, device_type, os, app, filtered, identity",
+		Value: "channel,quality,country,streaming_server",
+	},
+	&cli.StringFlag{
+		Name:  "archive-dir",
+		Usage: "Директория для архива сырых событий (NDJSON + gzip, ротация каждый час). Если не указана - архив не ведется",
+	},
+	&cli.Int64Flag{
+		Name:  "archive-max-size",
+		Usage: "Максимальный размер одного файла архива (в мегабайтах), 0 - без ограничений",
+		Value: 1024,
+	},
+	&cli.IntFlag{
+		Name:  "archive-retention",
+		Usage: "Сколько хранить файлы архива (в часах), 0 - хранить всегда",
+		Value: 168,
+	},
+	&cli.StringFlag{
+		Name:  "clickhouse-url",
+		Usage: "URL HTTP интерфейса ClickHouse для построчной аналитики, например: http://0.0.0.0:8123. Если не указан - запись не ведется",
+	},
+	&cli.StringFlag{
+		Name:  "clickhouse-db",
+		Usage: "База данных в ClickHouse",
+		Value: "default",
+	},
+	&cli.StringFlag{
+		Name:  "clickhouse-table",
+		Usage: "Таблица в ClickHouse, создается автоматически",
+		Value: "syslog_requests",
+	},
+	&cli.StringFlag{
+		Name:  "clickhouse-user",
+		Usage: "Пользователь ClickHouse",
+	},
+	&cli.StringFlag{
+		Name:   "clickhouse-password",
+		Usage:  "Пароль пользователя ClickHouse",
+		EnvVar: "CLICKHOUSE_PASSWORD",
+	},
+	&cli.IntFlag{
+		Name:  "clickhouse-retries",
+		Usage: "Количество повторных попыток записи пачки в ClickHouse",
+		Value: 3,
+	},
+	&cli.IntFlag{
+		Name:  "clickhouse-batch-size",
+		Usage: "Максимальное количество строк в одном запросе к ClickHouse",
+		Value: 100000,
+	},
+	&cli.StringFlag{
+		Name:   "clickhouse-ip-key",
+		Usage:  "Секрет для хеша IP в ClickHouse, обязателен вместе с --clickhouse-url",
+		EnvVar: "CLICKHOUSE_IP_KEY",
+	},
 	&cli.StringFlag{
 		Name:  "nginx-template",
 		Usage: "Шаблон для конфигурации форматов логов Nginx",
@@ -68,18 +314,63 @@ var CliFlags = []cli.Flag{
 	},
 	&cli.IntFlag{
 		Name:  "pool-size",
-		Usage: "Максимальная емкость воркеров для обработки запросов",
-		Value: 4000000,
+		Usage: "Максимальная емкость воркеров для обработки запросов, 0 - рассчитывается из --pool-memory-limit",
+		Value: 0,
 	},
 	&cli.IntFlag{
 		Name:  "worker-pool-size",
-		Usage: "Максимальная емкость воркеров для обработки запросов",
-		Value: 2000000,
+		Usage: "Максимальная емкость воркеров для обработки запросов, 0 - рассчитывается из --pool-memory-limit",
+		Value: 0,
 	},
 	&cli.IntFlag{
 		Name:  "error-pool-size",
-		Usage: "Максимальная емкость воркеров для обработки ошибок",
-		Value: 1000000,
+		Usage: "Максимальная емкость воркеров для обработки ошибок, 0 - рассчитывается из --pool-memory-limit",
+		Value: 0,
+	},
+	&cli.StringFlag{
+		Name:  "quarantine",
+		Usage: "Файл, куда пишутся сообщения, на которых обработчики пула упали с паникой, вместе со стеком, если не указан - не пишутся",
+		Value: "",
+	},
+	&cli.Int64Flag{
+		Name:  "quarantine-max-size",
+		Usage: "Предельный размер файла --quarantine в мегабайтах, после него записи пропускаются, 0 - без ограничения",
+		Value: 100,
+	},
+	&cli.IntFlag{
+		Name:  "quarantine-rate",
+		Usage: "Сколько записей в минуту пишется в --quarantine, остальные пропускаются, 0 - без ограничения",
+		Value: 60,
+	},
+	&cli.IntFlag{
+		Name:  "pool-memory-limit",
+		Usage: "Объем памяти в мегабайтах, на который рассчитываются очереди, если их размер не указан явно",
+		Value: 512,
+	},
+	&cli.StringFlag{
+		Name:  "pool-overflow",
+		Usage: "Что делать при заполненной очереди: block, drop-newest, drop-oldest или sample (выборка зрителей по хэшу)",
+		Value: "block",
+	},
+	&cli.Float64Flag{
+		Name:  "pool-sample-rate",
+		Usage: "Доля зрителей, которые остаются при политике sample, когда очередь почти заполнена",
+		Value: 0.5,
+	},
+	&cli.IntFlag{
+		Name:  "udp-sockets",
+		Usage: "Количество UDP сокетов с SO_REUSEPORT на bind-address (только Linux), 0 - один сокет go-syslog",
+		Value: 0,
+	},
+	&cli.IntFlag{
+		Name:  "udp-read-buffer",
+		Usage: "Размер приемного буфера каждого UDP сокета в байтах (SO_RCVBUF), 0 - по умолчанию ядра",
+		Value: 32 * 1024 * 1024,
+	},
+	&cli.IntFlag{
+		Name:  "udp-batch-size",
+		Usage: "Сколько датаграмм читается из UDP сокета одним системным вызовом",
+		Value: 64,
 	},
 	&cli.IntFlag{
 		Name:  "max-parallel",
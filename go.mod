@@ -7,5 +7,6 @@ require (
 	github.com/oschwald/geoip2-golang v1.4.0
 	github.com/pkg/errors v0.9.1
 	github.com/urfave/cli v1.22.4
+	golang.org/x/sys v0.0.0-20191224085550-c709ea063b76
 	gopkg.in/mcuadros/go-syslog.v2 v2.3.0
 )
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/LimeHD/limehd-syslog-server/lib"
+	"testing"
+)
+
+func TestIdentityBuilder(t *testing.T) {
+	builder, err := lib.NewIdentityBuilder("arg:token,remote_addr+http_user_agent")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// в шаблоне $args на 7 позиции
+	withToken := _parseWith(t, map[int]string{
+		6: "/streaming/muztv/324/vl2w/segment-1597220444-01972046.ts",
+		7: "token=abc&from=app",
+	})
+	withoutToken := _parseUri(t, "/streaming/muztv/324/vl2w/segment-1597220445-01972047.ts")
+
+	first := builder.Build(withToken)
+	second := builder.Build(withoutToken)
+
+	if first.Channel != "muztv" || second.Channel != "muztv" {
+		t.Errorf("identity must keep the channel, got %q and %q", first.Channel, second.Channel)
+	}
+
+	if first.Key != "0|abc" || first.Strategy != "arg:token" {
+		t.Errorf("token strategy expected, got key %q by %q", first.Key, first.Strategy)
+	}
+
+	if second.Key != "1|127.0.0.1|Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/69.0.3497.100 Safari/537.36" || second.Strategy != "remote_addr+http_user_agent" {
+		t.Errorf("fallback to ip and user agent expected, got key %q by %q", second.Key, second.Strategy)
+	}
+
+	online := lib.NewOnlineExact()
+	online.Peek(first)
+	online.Peek(second)
+
+	if online.Total() != 2 {
+		t.Errorf("different keys must be different viewers, got %d", online.Total())
+	}
+
+	if _, err := lib.NewIdentityBuilder("remote_addr+cookie"); err == nil {
+		t.Error("unknown fields must be rejected")
+	}
+}
+
+func TestIdentityFallback(t *testing.T) {
+	builder, err := lib.NewIdentityBuilder("arg:token,sent_http_x_profile")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ни токена, ни профиля: зрители различаются по ip и user-agent, а не сливаются в один ключ
+	first := builder.Build(_parseWith(t, map[int]string{
+		2: "10.0.0.1",
+		6: "/streaming/muztv/324/vl2w/segment-1597220444-01972046.ts",
+	}))
+	second := builder.Build(_parseWith(t, map[int]string{
+		2: "10.0.0.2",
+		6: "/streaming/muztv/324/vl2w/segment-1597220444-01972046.ts",
+	}))
+
+	if first.Hash() == second.Hash() {
+		t.Errorf("viewers without configured fields collapsed into key %q", first.Key)
+	}
+
+	if first.Strategy != "remote_addr+http_user_agent" {
+		t.Errorf("unexpected fallback strategy %q", first.Strategy)
+	}
+
+	// срез identity считает онлайн по сработавшей стратегии
+	dimensions, err := lib.NewDimensionalOnline(lib.DimensionalOnlineConfig{
+		Dimensions: []string{"identity"},
+		CounterFactory: func() (lib.OnlineCounter, error) {
+			return lib.NewOnlineExact(), nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withToken := _parseWith(t, map[int]string{
+		6: "/streaming/muztv/324/vl2w/segment-1597220444-01972046.ts",
+		7: "token=abc&from=app",
+	})
+
+	dimensions.Peek(first, lib.Receiver{})
+	dimensions.Peek(second, lib.Receiver{})
+	dimensions.Peek(builder.Build(withToken), lib.Receiver{})
+
+	channels := dimensions.Connections()[0].Channels["muztv"]
+
+	if channels["remote_addr+http_user_agent"].Count() != 2 || channels["arg:token"].Count() != 1 {
+		t.Errorf("unexpected online by identity strategy %v", channels)
+	}
+}
+
+func TestIdentityArgWithMalformedNeighbour(t *testing.T) {
+	builder, _ := lib.NewIdentityBuilder("arg:token")
+
+	// битый соседний параметр не мешает взять токен
+	for args, expected := range map[string]string{
+		"from=%zz&token=abc":   "0|abc",
+		"token=a%20b&x=%":      "0|a b",
+		"tok%65n=abc&from=app": "0|abc",
+	} {
+		log := _parseWith(t, map[int]string{
+			6: "/streaming/muztv/324/vl2w/segment-1597220444-01972046.ts",
+			7: args,
+		})
+
+		if identity := builder.Build(log); identity.Key != expected || identity.Strategy != "arg:token" {
+			t.Errorf("%s: expected key %q, got %q by %q", args, expected, identity.Key, identity.Strategy)
+		}
+	}
+}
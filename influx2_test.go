@@ -0,0 +1,148 @@
+package main
+
+import (
+	"compress/gzip"
+	"github.com/LimeHD/limehd-syslog-server/lib"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInflux2ClientWrite(t *testing.T) {
+	var body, query, auth string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		query = r.URL.RawQuery
+		auth = r.Header.Get("Authorization")
+
+		zr, err := gzip.NewReader(r.Body)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		b, _ := ioutil.ReadAll(zr)
+		body = string(b)
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	influx, err := lib.NewInflux2Client(lib.Influx2ClientConfig{
+		Addr:              server.URL,
+		Org:               "limehd",
+		Bucket:            "polina",
+		Token:             "secret",
+		Precision:         "s",
+		Gzip:              true,
+		Logger:            lib.NewFileLogger(lib.LoggerConfig{}),
+		Measurement:       "syslog",
+		MeasurementOnline: "online_users",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = influx.WriteTraffic([]lib.InfluxRequestParams{
+		{
+			InfluxRequestTags: lib.InfluxRequestTags{
+				CountryName:  "RU",
+				AsnNumber:    12389,
+				AsnOrg:       "Rostelecom",
+				Channel:      "domashniy",
+				StreamServer: "127.0.0.1",
+				Host:         "mhd.limehd.tv",
+				Quality:      "vh1w",
+				Time:         time.Unix(1597143692, 0),
+			},
+			InfluxRequestFields: lib.InfluxRequestFields{
+				BytesSent: 404,
+			},
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if auth != "Token secret" {
+		t.Errorf("unexpected authorization header %q", auth)
+	}
+
+	if query != "bucket=polina&org=limehd&precision=s" {
+		t.Errorf("unexpected query %q", query)
+	}
+
+	expected := "syslog,asn_number=12389,asn_org=Rostelecom,channel=domashniy,country_name=RU,host=mhd.limehd.tv,quality=vh1w,streaming_server=127.0.0.1 bytes_sent=404i 1597143692\n"
+
+	if body != expected {
+		t.Errorf("unexpected line protocol:\n%s\nexpected:\n%s", body, expected)
+	}
+}
+
+func TestInflux2ClientStartsWhileInfluxIsDown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr().String()
+	_ = listener.Close()
+
+	influx, err := lib.NewInflux2Client(lib.Influx2ClientConfig{
+		Addr:              "http://" + addr,
+		Org:               "limehd",
+		Bucket:            "polina",
+		Precision:         "s",
+		Logger:            lib.NewFileLogger(lib.LoggerConfig{}),
+		Measurement:       "syslog",
+		MeasurementOnline: "online_users",
+	})
+
+	if err != nil {
+		t.Fatalf("Sink is not created while influx is down: %s", err)
+	}
+
+	traffic := []lib.InfluxRequestParams{
+		{InfluxRequestTags: lib.InfluxRequestTags{Channel: "domashniy", Time: time.Unix(1597143692, 0)}},
+	}
+
+	if err := influx.WriteTraffic(traffic); err == nil {
+		t.Fatal("Write to unavailable influx succeeded")
+	}
+
+	// influx поднялся - следующая пачка доходит
+	listener, err = net.Listen("tcp", addr)
+
+	if err != nil {
+		t.Skip(err)
+	}
+
+	written := false
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		written = true
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	if err := influx.WriteTraffic(traffic); err != nil {
+		t.Fatal(err)
+	}
+
+	if !written {
+		t.Error("Traffic is not written after influx became available")
+	}
+}
@@ -0,0 +1,200 @@
+package lib
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const archivePrefix = "events-"
+const archiveExt = ".ndjson.gz"
+const archiveHourLayout = "2006010215"
+
+type (
+	// Архив сырых обогащенных событий в NDJSON, сжатых gzip
+	// файлы ротируются каждый час и при превышении размера, старые файлы удаляются
+	ArchiveSink struct {
+		mt        sync.Mutex
+		dir       string
+		maxSize   int64
+		retention time.Duration
+		hour      string
+		file      *os.File
+		counter   *countingWriter
+		gzip      *gzip.Writer
+		encoder   *json.Encoder
+		_logger   Logger
+	}
+
+	ArchiveSinkConfig struct {
+		Dir string
+		// максимальный размер одного файла в байтах, 0 - без ограничений
+		MaxSize int64
+		// сколько хранить файлы, 0 - хранить всегда
+		Retention time.Duration
+		Logger    Logger
+	}
+
+	countingWriter struct {
+		file    *os.File
+		written int64
+	}
+)
+
+func NewArchiveSink(config ArchiveSinkConfig) (*ArchiveSink, error) {
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &ArchiveSink{
+		dir:       config.Dir,
+		maxSize:   config.MaxSize,
+		retention: config.Retention,
+		_logger:   config.Logger,
+	}, nil
+}
+
+// агрегаты архиву не нужны
+func (a *ArchiveSink) WriteTraffic(params []InfluxRequestParams) error {
+	return nil
+}
+
+func (a *ArchiveSink) WriteOnline(params InfluxOnlineRequestParams) error {
+	return nil
+}
+
+func (a *ArchiveSink) WriteEvents(events []Receiver) error {
+	a.mt.Lock()
+	defer a.mt.Unlock()
+
+	for _, event := range events {
+		if err := a.rotate(time.Now()); err != nil {
+			return err
+		}
+
+		if err := a.encoder.Encode(NewEventRecord(event)); err != nil {
+			return err
+		}
+	}
+
+	// сбрасываем сжатые данные на диск после каждой пачки, чтобы при падении терять не больше одной пачки
+	if a.gzip != nil {
+		return a.gzip.Flush()
+	}
+
+	return nil
+}
+
+func (a *ArchiveSink) Close() {
+	a.mt.Lock()
+	defer a.mt.Unlock()
+
+	if err := a.closeFile(); err != nil {
+		a._logger.ErrorLog(err)
+	}
+}
+
+func (a *ArchiveSink) CloseMessage() string {
+	return "Close events archive"
+}
+
+// открывает новый файл, если наступил новый час или текущий файл превысил лимит
+func (a *ArchiveSink) rotate(now time.Time) error {
+	hour := now.Format(archiveHourLayout)
+
+	if a.file != nil && a.hour == hour && (a.maxSize == 0 || a.counter.written < a.maxSize) {
+		return nil
+	}
+
+	if err := a.closeFile(); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(a.nextFilename(hour), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	a.hour = hour
+	a.file = file
+	a.counter = &countingWriter{file: file}
+	a.gzip = gzip.NewWriter(a.counter)
+	a.encoder = json.NewEncoder(a.gzip)
+
+	a.cleanup(now)
+
+	return nil
+}
+
+func (a *ArchiveSink) closeFile() error {
+	if a.file == nil {
+		return nil
+	}
+
+	err := a.gzip.Close()
+
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	a.file = nil
+
+	return err
+}
+
+// events-2020081311.ndjson.gz, events-2020081311-1.ndjson.gz ...
+// существующие файлы не дописываются, после перезапуска создается следующий по счету
+func (a *ArchiveSink) nextFilename(hour string) string {
+	for i := 0; ; i++ {
+		name := archivePrefix + hour + archiveExt
+
+		if i > 0 {
+			name = fmt.Sprintf("%s%s-%d%s", archivePrefix, hour, i, archiveExt)
+		}
+
+		path := filepath.Join(a.dir, name)
+
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return path
+		}
+	}
+}
+
+// удаляем файлы старше срока хранения
+func (a *ArchiveSink) cleanup(now time.Time) {
+	if a.retention == 0 {
+		return
+	}
+
+	files, err := ioutil.ReadDir(a.dir)
+
+	if err != nil {
+		a._logger.ErrorLog(err)
+		return
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasPrefix(f.Name(), archivePrefix) || !strings.HasSuffix(f.Name(), archiveExt) {
+			continue
+		}
+
+		if now.Sub(f.ModTime()) > a.retention {
+			if err := os.Remove(filepath.Join(a.dir, f.Name())); err != nil {
+				a._logger.ErrorLog(err)
+			}
+		}
+	}
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.file.Write(p)
+	c.written += int64(n)
+	return n, err
+}
@@ -0,0 +1,390 @@
+package lib
+
+import (
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"github.com/LimeHD/limehd-syslog-server/constants"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const AUDIENCE_PERIOD_DAY = "day"
+const AUDIENCE_PERIOD_MONTH = "month"
+
+type (
+	// Уникальные зрители за календарный день и месяц (DAU/MAU) по каналам и по платформе в целом
+	// считаются скетчами HyperLogLog, которые сохраняются на диск и переживают перезапуск,
+	// итог периода отправляется после его окончания, текущие значения доступны по HTTP
+	AudienceCounter struct {
+		// блокировки по регистрам: зритель меняет регистр с одним и тем же номером во всех скетчах,
+		// поэтому обработчики, попавшие в разные регистры, друг друга не ждут,
+		// чтение и смена периодов берут все блокировки
+		shards           []sync.Mutex
+		path             string
+		precision        uint8
+		periods          []*audiencePeriod
+		scheduleCallback func(report AudienceReport)
+		_logger          Logger
+	}
+
+	AudienceCounterConfig struct {
+		// файл для сохранения скетчей, если не указан - состояние не сохраняется
+		Path      string
+		Precision uint8
+		Logger    Logger
+	}
+
+	// уникальные зрители за период, начавшийся в Start
+	AudienceReport struct {
+		Period   string         `json:"period"`
+		Start    time.Time      `json:"start"`
+		Channels map[string]int `json:"channels"`
+		Total    int            `json:"total"`
+	}
+
+	audiencePeriod struct {
+		kind  string
+		start time.Time
+		// канал -> *HyperLogLog, каналы только добавляются, поэтому поиск обходится без блокировки
+		channels *sync.Map
+		total    *HyperLogLog
+	}
+
+	audienceSnapshot struct {
+		Precision uint8
+		// версия хэша пользователей, см. constants.IDENTITY_HASH
+		Hash    string
+		Periods []audiencePeriodSnapshot
+	}
+
+	audiencePeriodSnapshot struct {
+		Kind     string
+		Start    int64
+		Channels map[string][]uint8
+		Total    []uint8
+	}
+)
+
+func NewAudienceCounter(config AudienceCounterConfig) (*AudienceCounter, error) {
+	a := &AudienceCounter{
+		shards:    make([]sync.Mutex, constants.AGGREGATION_SHARDS),
+		path:      config.Path,
+		precision: config.Precision,
+		_logger:   config.Logger,
+	}
+
+	now := time.Now()
+
+	for _, kind := range []string{AUDIENCE_PERIOD_DAY, AUDIENCE_PERIOD_MONTH} {
+		period, err := a.newPeriod(kind, periodStart(kind, now))
+
+		if err != nil {
+			return nil, err
+		}
+
+		a.periods = append(a.periods, period)
+	}
+
+	return a, nil
+}
+
+func (a *AudienceCounter) SetScheduleHandler(handler func(report AudienceReport)) {
+	a.scheduleCallback = handler
+}
+
+func (a *AudienceCounter) Peek(i UniqueIdentity) {
+	hash := i.Hash()
+	// номер регистра - старшие биты хэша, как в HyperLogLog.Add
+	shard := &a.shards[(hash>>(64-a.precision))%uint64(len(a.shards))]
+
+	shard.Lock()
+	for _, period := range a.periods {
+		period.peek(i.Channel, hash)
+	}
+	shard.Unlock()
+}
+
+func (a *AudienceCounter) lock() {
+	for index := range a.shards {
+		a.shards[index].Lock()
+	}
+}
+
+func (a *AudienceCounter) unlock() {
+	for index := range a.shards {
+		a.shards[index].Unlock()
+	}
+}
+
+// значения за текущие день и месяц
+func (a *AudienceCounter) Current() []AudienceReport {
+	a.lock()
+	defer a.unlock()
+
+	reports := make([]AudienceReport, 0, len(a.periods))
+	for _, period := range a.periods {
+		reports = append(reports, period.report())
+	}
+
+	return reports
+}
+
+// закрывает периоды, которые закончились к моменту now, и возвращает их итоги
+func (a *AudienceCounter) Rotate(now time.Time) ([]AudienceReport, error) {
+	a.lock()
+	defer a.unlock()
+
+	var reports []AudienceReport
+
+	for index, period := range a.periods {
+		start := periodStart(period.kind, now)
+
+		if start.Equal(period.start) {
+			continue
+		}
+
+		reports = append(reports, period.report())
+		next, err := a.newPeriod(period.kind, start)
+
+		if err != nil {
+			return reports, err
+		}
+
+		a.periods[index] = next
+	}
+
+	return reports, nil
+}
+
+// пишем во временный файл и переименовываем, как и снимок онлайна
+func (a *AudienceCounter) Save() error {
+	if len(a.path) == 0 {
+		return nil
+	}
+
+	a.lock()
+	snapshot := audienceSnapshot{
+		Precision: a.precision,
+		Hash:      constants.IDENTITY_HASH,
+	}
+
+	for _, period := range a.periods {
+		snapshot.Periods = append(snapshot.Periods, period.snapshot())
+	}
+	a.unlock()
+
+	tmp := a.path + ".tmp"
+	file, err := os.Create(tmp)
+
+	if err != nil {
+		return err
+	}
+
+	if err := gob.NewEncoder(file).Encode(snapshot); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, a.path)
+}
+
+// восстанавливает скетчи, период из снимка сохраняется как есть,
+// поэтому день, закончившийся во время простоя, будет отправлен на ближайшем Rotate
+func (a *AudienceCounter) Restore() (bool, error) {
+	if len(a.path) == 0 {
+		return false, nil
+	}
+
+	file, err := os.Open(a.path)
+
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	defer file.Close()
+
+	snapshot := audienceSnapshot{}
+
+	if err := gob.NewDecoder(file).Decode(&snapshot); err != nil {
+		return false, err
+	}
+
+	// при смене точности или хэша старые скетчи нельзя объединить с новыми
+	if snapshot.Precision != a.precision {
+		a._logger.InfoLog(fmt.Sprintf("Audience snapshot has another precision (%d), start from scratch", snapshot.Precision))
+		return false, nil
+	}
+
+	if snapshot.Hash != constants.IDENTITY_HASH {
+		a._logger.InfoLog("Audience snapshot uses another identity hash, start from scratch")
+		return false, nil
+	}
+
+	// сначала проверяем все периоды, чтобы не восстановить снимок частично
+	periods := make(map[string]*audiencePeriod, len(snapshot.Periods))
+
+	for _, saved := range snapshot.Periods {
+		period, err := restorePeriod(saved, a.precision)
+
+		if err != nil {
+			return false, err
+		}
+
+		periods[saved.Kind] = period
+	}
+
+	a.lock()
+	defer a.unlock()
+
+	for index, period := range a.periods {
+		if restored, ok := periods[period.kind]; ok {
+			a.periods[index] = restored
+		}
+	}
+
+	return true, nil
+}
+
+func (a *AudienceCounter) Scheduler(ctx context.Context, duration int64) error {
+	return runEvery(ctx, every(time.Second*time.Duration(duration)), func() {
+		reports, err := a.Rotate(time.Now())
+
+		if err != nil {
+			a._logger.ErrorLog(err)
+		}
+
+		for _, report := range reports {
+			a.scheduleCallback(report)
+		}
+
+		if err := a.Save(); err != nil {
+			a._logger.ErrorLog(err)
+		}
+	})
+}
+
+func (a *AudienceCounter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(a.Current())
+}
+
+// сохраняем скетчи при остановке сервиса
+func (a *AudienceCounter) Close() {
+	if err := a.Save(); err != nil {
+		a._logger.ErrorLog(err)
+	}
+}
+
+func (a *AudienceCounter) CloseMessage() string {
+	return "Save audience sketches"
+}
+
+func (a *AudienceCounter) newPeriod(kind string, start time.Time) (*audiencePeriod, error) {
+	total, err := NewHyperLogLog(a.precision)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &audiencePeriod{
+		kind:     kind,
+		start:    start,
+		channels: &sync.Map{},
+		total:    total,
+	}, nil
+}
+
+func (p *audiencePeriod) peek(channel string, hash uint64) {
+	sketch, ok := p.channels.Load(channel)
+
+	if !ok {
+		// точность уже проверена при создании total, канал мог одновременно создать другой обработчик
+		created, _ := NewHyperLogLog(p.total.precision)
+		sketch, _ = p.channels.LoadOrStore(channel, created)
+	}
+
+	sketch.(*HyperLogLog).Add(hash)
+	p.total.Add(hash)
+}
+
+func (p *audiencePeriod) report() AudienceReport {
+	report := AudienceReport{
+		Period:   p.kind,
+		Start:    p.start,
+		Channels: map[string]int{},
+		Total:    p.total.Count(),
+	}
+
+	p.channels.Range(func(name, sketch interface{}) bool {
+		report.Channels[name.(string)] = sketch.(*HyperLogLog).Count()
+		return true
+	})
+
+	return report
+}
+
+func (p *audiencePeriod) snapshot() audiencePeriodSnapshot {
+	snapshot := audiencePeriodSnapshot{
+		Kind:     p.kind,
+		Start:    p.start.Unix(),
+		Channels: map[string][]uint8{},
+		Total:    append([]uint8(nil), p.total.registers...),
+	}
+
+	p.channels.Range(func(name, sketch interface{}) bool {
+		snapshot.Channels[name.(string)] = append([]uint8(nil), sketch.(*HyperLogLog).registers...)
+		return true
+	})
+
+	return snapshot
+}
+
+func restorePeriod(snapshot audiencePeriodSnapshot, precision uint8) (*audiencePeriod, error) {
+	total, err := restoreHyperLogLog(precision, snapshot.Total, snapshot.Kind)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p := &audiencePeriod{
+		kind:     snapshot.Kind,
+		start:    time.Unix(snapshot.Start, 0),
+		channels: &sync.Map{},
+		total:    total,
+	}
+
+	for name, registers := range snapshot.Channels {
+		sketch, err := restoreHyperLogLog(precision, registers, snapshot.Kind+":"+name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		p.channels.Store(name, sketch)
+	}
+
+	return p, nil
+}
+
+// начало календарного дня или месяца в локальном часовом поясе
+func periodStart(kind string, t time.Time) time.Time {
+	year, month, day := t.Date()
+
+	if kind == AUDIENCE_PERIOD_MONTH {
+		day = 1
+	}
+
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
@@ -0,0 +1,257 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/LimeHD/limehd-syslog-server/constants"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type (
+	// Построчная аналитика по запросам в ClickHouse через HTTP интерфейс (JSONEachRow)
+	ClickHouseSink struct {
+		url       string
+		table     string
+		user      string
+		password  string
+		retries   int
+		batchSize int
+		ipHashKey []byte
+		// таблица создана, пишется и читается только потоком приемника в FanOutSink
+		tableReady bool
+		http       *http.Client
+		_logger    Logger
+	}
+
+	ClickHouseSinkConfig struct {
+		Addr     string
+		Database string
+		Table    string
+		User     string
+		Password string
+		// количество повторных попыток записи пачки
+		Retries int
+		// максимальное количество строк в одном INSERT
+		BatchSize int
+		// секрет для хеша IP: без него хеш IPv4 восстанавливается перебором всех адресов
+		IpHashKey string
+		Logger    Logger
+	}
+
+	// колонка таблицы и способ получить ее значение из события, приемник нужен для секрета хеша IP
+	clickHouseColumn struct {
+		name  string
+		kind  string
+		value func(c *ClickHouseSink, e EventRecord) interface{}
+	}
+)
+
+const clickHouseTimeLayout = "2006-01-02 15:04:05.000"
+
+var clickHouseColumns = []clickHouseColumn{
+	{"time", "DateTime64(3, 'UTC')", func(c *ClickHouseSink, e EventRecord) interface{} { return e.Time.UTC().Format(clickHouseTimeLayout) }},
+	{"channel", "LowCardinality(String)", func(c *ClickHouseSink, e EventRecord) interface{} { return e.Channel }},
+	{"quality", "LowCardinality(String)", func(c *ClickHouseSink, e EventRecord) interface{} { return e.Quality }},
+	{"ip_hash", "UInt64", func(c *ClickHouseSink, e EventRecord) interface{} { return c.ipHash(e.RemoteAddr) }},
+	{"country", "LowCardinality(String)", func(c *ClickHouseSink, e EventRecord) interface{} { return e.CountryIsoCode }},
+	{"asn_number", "UInt32", func(c *ClickHouseSink, e EventRecord) interface{} { return e.AsnNumber }},
+	{"asn_org", "LowCardinality(String)", func(c *ClickHouseSink, e EventRecord) interface{} { return e.AsnOrg }},
+	{"bytes_sent", "UInt64", func(c *ClickHouseSink, e EventRecord) interface{} { return e.BytesSent }},
+	{"status", "UInt16", func(c *ClickHouseSink, e EventRecord) interface{} { return e.Status }},
+	{"request_time", "Float32", func(c *ClickHouseSink, e EventRecord) interface{} { return e.RequestTime }},
+	{"streaming_server", "LowCardinality(String)", func(c *ClickHouseSink, e EventRecord) interface{} { return e.StreamingServer }},
+	{"host", "LowCardinality(String)", func(c *ClickHouseSink, e EventRecord) interface{} { return e.Host }},
+	{"sample_rate", "Float32", func(c *ClickHouseSink, e EventRecord) interface{} { return e.SampleRate }},
+}
+
+// если ClickHouse недоступен при запуске, таблица создается перед первой записью
+func NewClickHouseSink(config ClickHouseSinkConfig) (*ClickHouseSink, error) {
+	if len(config.IpHashKey) == 0 {
+		return nil, errors.New(constants.CLICKHOUSE_IP_KEY_REQUIRED)
+	}
+
+	c := &ClickHouseSink{
+		url:       strings.TrimRight(config.Addr, "/") + "/",
+		table:     fmt.Sprintf("%s.%s", config.Database, config.Table),
+		user:      config.User,
+		password:  config.Password,
+		retries:   config.Retries,
+		batchSize: config.BatchSize,
+		ipHashKey: []byte(config.IpHashKey),
+		http:      &http.Client{Timeout: time.Second * 30},
+		_logger:   config.Logger,
+	}
+
+	if err := c.createTable(); err != nil {
+		c._logger.ErrorLog(errors.New(fmt.Sprintf("%s: %v", constants.CLICKHOUSE_NOT_AVAILABLE, err)))
+	}
+
+	return c, nil
+}
+
+// агрегаты в ClickHouse не пишем, только сырые события
+func (c *ClickHouseSink) WriteTraffic(params []InfluxRequestParams) error {
+	return nil
+}
+
+func (c *ClickHouseSink) WriteOnline(params InfluxOnlineRequestParams) error {
+	return nil
+}
+
+func (c *ClickHouseSink) WriteEvents(events []Receiver) error {
+	if !c.tableReady {
+		if err := c.retry(c.createTable); err != nil {
+			return err
+		}
+	}
+
+	batchSize := c.batchSize
+
+	if batchSize <= 0 {
+		batchSize = len(events)
+	}
+
+	for start := 0; start < len(events); start += batchSize {
+		end := start + batchSize
+
+		if end > len(events) {
+			end = len(events)
+		}
+
+		body, err := c.encode(events[start:end])
+
+		if err != nil {
+			return err
+		}
+
+		if err := c.insert(body); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *ClickHouseSink) Close() {
+	c.http.CloseIdleConnections()
+}
+
+func (c *ClickHouseSink) CloseMessage() string {
+	return "Close ClickHouse connection"
+}
+
+func (c *ClickHouseSink) createTable() error {
+	columns := make([]string, len(clickHouseColumns))
+
+	for i, column := range clickHouseColumns {
+		columns[i] = fmt.Sprintf("%s %s", column.name, column.kind)
+	}
+
+	query := fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (%s) ENGINE = MergeTree() PARTITION BY toYYYYMMDD(time) ORDER BY (channel, time)",
+		c.table,
+		strings.Join(columns, ", "),
+	)
+
+	if err := c.exec(query, nil); err != nil {
+		return err
+	}
+
+	c.tableReady = true
+	c._logger.Debug(fmt.Sprintf("ClickHouse table %s is ready", c.table))
+
+	return nil
+}
+
+// JSONEachRow: объект на строку
+func (c *ClickHouseSink) encode(events []Receiver) ([]byte, error) {
+	body := &bytes.Buffer{}
+	encoder := json.NewEncoder(body)
+	row := make(map[string]interface{}, len(clickHouseColumns))
+
+	for _, event := range events {
+		record := NewEventRecord(event)
+
+		for _, column := range clickHouseColumns {
+			row[column.name] = column.value(c, record)
+		}
+
+		if err := encoder.Encode(row); err != nil {
+			return nil, err
+		}
+	}
+
+	return body.Bytes(), nil
+}
+
+func (c *ClickHouseSink) insert(body []byte) error {
+	query := fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", c.table)
+
+	return c.retry(func() error {
+		return c.exec(query, bytes.NewReader(body))
+	})
+}
+
+// повторяем запрос с нарастающей паузой, пачка теряется только после всех попыток
+func (c *ClickHouseSink) retry(query func() error) error {
+	var err error
+
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Second * time.Duration(attempt))
+		}
+
+		if err = query(); err == nil {
+			return nil
+		}
+
+		c._logger.Debug(fmt.Sprintf("ClickHouse query attempt %d failed: %v", attempt+1, err))
+	}
+
+	return err
+}
+
+func (c *ClickHouseSink) exec(query string, body io.Reader) error {
+	request, err := http.NewRequest(http.MethodPost, c.url+"?query="+url.QueryEscape(query), body)
+
+	if err != nil {
+		return err
+	}
+
+	if len(c.user) > 0 {
+		request.Header.Set("X-ClickHouse-User", c.user)
+		request.Header.Set("X-ClickHouse-Key", c.password)
+	}
+
+	response, err := c.http.Do(request)
+
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(response.Body)
+		return errors.New(fmt.Sprintf("%s: %s %s", constants.CLICKHOUSE_QUERY_FAILED, response.Status, message))
+	}
+
+	return nil
+}
+
+// IP не храним в открытом виде: HMAC с секретом, без которого адрес не подобрать перебором
+func (c *ClickHouseSink) ipHash(ip string) uint64 {
+	h := hmac.New(sha256.New, c.ipHashKey)
+	_, _ = h.Write([]byte(ip))
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
@@ -0,0 +1,129 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"github.com/LimeHD/limehd-syslog-server/constants"
+	"strconv"
+	"strings"
+)
+
+type (
+	// Онлайн пользователи в разрезе (канал, измерение), например: страна, ASN или качество
+	// по каждому измерению ведется свой OnlineCounter того же режима, что и основной онлайн
+	DimensionalOnline struct {
+		dimensions []string
+		counters   map[string]OnlineCounter
+	}
+
+	DimensionalOnlineConfig struct {
+		Dimensions []string
+		// создает счетчик для очередного измерения
+		CounterFactory func() (OnlineCounter, error)
+	}
+
+	// срез онлайна по одному измерению: канал -> значение измерения -> количество
+	OnlineDimensionConnections struct {
+		Name     string
+		Channels map[string]map[string]ChannelCounter
+	}
+)
+
+// доступные измерения и способ получить значение из обогащенного запроса
+var onlineDimensions = map[string]func(i UniqueIdentity, r Receiver) string{
+	"country": func(i UniqueIdentity, r Receiver) string {
+		if r.Finder == nil {
+			return constants.UNKNOWN
+		}
+		return r.Finder.GetCountryIsoCode()
+	},
+	"asn": func(i UniqueIdentity, r Receiver) string {
+		if r.Finder == nil {
+			return constants.UNKNOWN
+		}
+		return strconv.FormatUint(uint64(r.Finder.GetOrganizationNumber()), 10)
+	},
+	"asn_org": func(i UniqueIdentity, r Receiver) string {
+		if r.Finder == nil {
+			return constants.UNKNOWN
+		}
+		return r.Finder.GetOrganization()
+	},
+	"quality":          func(i UniqueIdentity, r Receiver) string { return r.Parser.GetQuality() },
+	"streaming_server": func(i UniqueIdentity, r Receiver) string { return r.Parser.GetClientAddr() },
+	"host":             func(i UniqueIdentity, r Receiver) string { return r.Parser.GetStreamingServer() },
+	"device_type":      func(i UniqueIdentity, r Receiver) string { return r.Device.DeviceType },
+	"os":               func(i UniqueIdentity, r Receiver) string { return r.Device.Os },
+	"app":              func(i UniqueIdentity, r Receiver) string { return r.Device.App },
+	// стратегия --identity, по которой определен зритель
+	"identity": func(i UniqueIdentity, r Receiver) string { return i.Strategy },
+}
+
+func NewDimensionalOnline(config DimensionalOnlineConfig) (*DimensionalOnline, error) {
+	d := &DimensionalOnline{
+		dimensions: config.Dimensions,
+		counters:   map[string]OnlineCounter{},
+	}
+
+	for _, name := range config.Dimensions {
+		if _, ok := onlineDimensions[name]; !ok {
+			return nil, errors.New(fmt.Sprintf("%s: %s", constants.ONLINE_UNKNOWN_DIMENSION, name))
+		}
+
+		counter, err := config.CounterFactory()
+
+		if err != nil {
+			return nil, err
+		}
+
+		d.counters[name] = counter
+	}
+
+	return d, nil
+}
+
+// учитывает пользователя в каждом измерении, ключом выступает пара канал|значение
+func (d *DimensionalOnline) Peek(i UniqueIdentity, r Receiver) {
+	for _, name := range d.dimensions {
+		identity := i
+		identity.Channel = i.Channel + constants.LOG_DELIM + onlineDimensions[name](i, r)
+
+		d.counters[name].Peek(identity)
+	}
+}
+
+func (d *DimensionalOnline) Connections() []OnlineDimensionConnections {
+	result := make([]OnlineDimensionConnections, 0, len(d.dimensions))
+
+	for _, name := range d.dimensions {
+		channels := map[string]map[string]ChannelCounter{}
+
+		for key, counter := range d.counters[name].Connections() {
+			pair := strings.SplitN(key, constants.LOG_DELIM, 2)
+
+			if _, ok := channels[pair[0]]; !ok {
+				channels[pair[0]] = map[string]ChannelCounter{}
+			}
+
+			channels[pair[0]][pair[1]] = counter
+		}
+
+		result = append(result, OnlineDimensionConnections{
+			Name:     name,
+			Channels: channels,
+		})
+	}
+
+	return result
+}
+
+// счетчики по названиям измерений
+func (d *DimensionalOnline) Counters() map[string]OnlineCounter {
+	return d.counters
+}
+
+func (d *DimensionalOnline) Flush() {
+	for _, counter := range d.counters {
+		counter.Flush()
+	}
+}
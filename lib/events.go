@@ -0,0 +1,152 @@
+package lib
+
+import (
+	"context"
+	"github.com/LimeHD/limehd-syslog-server/constants"
+	"sync"
+	"time"
+)
+
+type (
+	// Накопитель сырых событий для приемников EventSink, работает аналогично StreamQueue:
+	// события раскладываются по шардам по хэшу зрителя, у каждого шарда своя блокировка
+	EventQueue struct {
+		shards           []*eventShard
+		scheduleCallback func(e *EventQueue)
+	}
+
+	eventShard struct {
+		mt       sync.Mutex
+		internal []Receiver
+	}
+)
+
+func NewEventQueue() *EventQueue {
+	e := new(EventQueue)
+	e.shards = make([]*eventShard, constants.AGGREGATION_SHARDS)
+
+	for index := range e.shards {
+		e.shards[index] = &eventShard{
+			internal: []Receiver{},
+		}
+	}
+
+	return e
+}
+
+func (e *EventQueue) SetScheduleHandler(handler func(e *EventQueue)) {
+	e.scheduleCallback = handler
+}
+
+func (e *EventQueue) Add(i UniqueIdentity, item Receiver) {
+	shard := e.shards[i.Hash()%uint64(len(e.shards))]
+
+	shard.mt.Lock()
+	shard.internal = append(shard.internal, item)
+	shard.mt.Unlock()
+}
+
+// забирает накопленные события и начинает новое накопление,
+// каждый шард меняется под своей блокировкой, поэтому события, добавленные в это время, не теряются
+func (e *EventQueue) Collect() []Receiver {
+	all := make([]Receiver, 0, e.Len())
+
+	for _, shard := range e.shards {
+		shard.mt.Lock()
+		all = append(all, shard.internal...)
+		shard.internal = []Receiver{}
+		shard.mt.Unlock()
+	}
+
+	return all
+}
+
+func (e *EventQueue) Len() int {
+	total := 0
+
+	for _, shard := range e.shards {
+		shard.mt.Lock()
+		total += len(shard.internal)
+		shard.mt.Unlock()
+	}
+
+	return total
+}
+
+func (e *EventQueue) Scheduler(ctx context.Context, duration int) error {
+	return runEvery(ctx, every(time.Second*time.Duration(duration)), func() {
+		e.scheduleCallback(e)
+	})
+}
+
+type (
+	// Плоское представление обогащенного запроса для архива и аналитических хранилищ
+	EventRecord struct {
+		Time               time.Time `json:"time"`
+		RemoteAddr         string    `json:"remote_addr"`
+		Host               string    `json:"host"`
+		Uri                string    `json:"uri"`
+		Args               string    `json:"args"`
+		Method             string    `json:"method"`
+		Status             int       `json:"status"`
+		BytesSent          int       `json:"bytes_sent"`
+		BodyBytesSent      int       `json:"body_bytes_sent"`
+		RequestTime        float64   `json:"request_time"`
+		UserAgent          string    `json:"user_agent"`
+		Referer            string    `json:"referer"`
+		Profile            string    `json:"profile"`
+		ConnectionRequests int       `json:"connection_requests"`
+		Channel            string    `json:"channel"`
+		Quality            string    `json:"quality"`
+		StreamingServer    string    `json:"streaming_server"`
+		CountryIsoCode     string    `json:"country_iso_code"`
+		CountryName        string    `json:"country_name"`
+		CityName           string    `json:"city_name"`
+		AsnNumber          uint      `json:"asn_number"`
+		AsnOrg             string    `json:"asn_org"`
+		SampleRate         float64   `json:"sample_rate"` // доля выборки зрителей, событие весит 1/sample_rate
+	}
+)
+
+// поля лога, из которых собирается событие, разбираются только если события кому-то нужны
+var eventFields = []string{
+	"msec", "remote_addr", "host", "uri", "args", "request_method", "status", "bytes_sent",
+	"body_bytes_sent", "request_time", "http_user_agent", "http_referer", "sent_http_x_profile", "connection_requests",
+}
+
+func NewEventRecord(r Receiver) EventRecord {
+	e := EventRecord{
+		Time:               r.Parser.GetTime(),
+		RemoteAddr:         r.Parser.GetRemoteAddr(),
+		Host:               r.Parser.GetStreamingServer(),
+		Uri:                r.Parser.GetUri(),
+		Args:               r.Parser.GetArgs(),
+		Method:             r.Parser.GetRequestMethod(),
+		Status:             r.Parser.GetStatus(),
+		BytesSent:          r.Parser.GetBytesSent(),
+		BodyBytesSent:      r.Parser.GetBodyBytesSent(),
+		RequestTime:        r.Parser.GetRequestTime(),
+		UserAgent:          r.Parser.GetUserAgent(),
+		Referer:            r.Parser.GetReferer(),
+		Profile:            r.Parser.GetProfile(),
+		ConnectionRequests: r.Parser.GetConnectionRequests(),
+		Channel:            r.Parser.GetChannel(),
+		Quality:            r.Parser.GetQuality(),
+		StreamingServer:    r.Parser.GetClientAddr(),
+		SampleRate:         1,
+	}
+
+	if r.SampleRate > 0 {
+		e.SampleRate = r.SampleRate
+	}
+
+	if r.Finder != nil {
+		e.CountryIsoCode = r.Finder.GetCountryIsoCode()
+		e.CountryName = r.Finder.GetCountryName()
+		e.CityName = r.Finder.GetCityName()
+		e.AsnNumber = r.Finder.GetOrganizationNumber()
+		e.AsnOrg = r.Finder.GetOrganization()
+	}
+
+	return e
+}
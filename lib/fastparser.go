@@ -0,0 +1,222 @@
+package lib
+
+import (
+	"errors"
+	"github.com/LimeHD/limehd-syslog-server/constants"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+	"strings"
+)
+
+type (
+	// Разбор лога за один проход по строке: значения полей - подстроки исходной строки,
+	// без промежуточного слайса, замыканий на каждое сообщение и отладочного вывода,
+	// позиции нужных полей вычисляются из шаблона один раз, проход заканчивается на последнем нужном поле
+	// парсер не хранит состояния и может использоваться всеми обработчиками одновременно
+	FastParser struct {
+		delim       string
+		streamDelim string
+		// заполнение поля по его позиции в строке, nil - поле не нужно
+		setters []logSetter
+	}
+
+	logSetter func(l *Log, value string)
+)
+
+// поля шаблона, которые умеет заполнять разбор
+var logSetters = map[string]logSetter{
+	"time_local":             func(l *Log, v string) { l.timeLocal = v },
+	"msec":                   func(l *Log, v string) { l.msec = v },
+	"remote_addr":            func(l *Log, v string) { l.remoteAddr = v },
+	"server_protocol":        func(l *Log, v string) { l.serverProtocol = v },
+	"request_method":         func(l *Log, v string) { l.requestMethod = v },
+	"host":                   func(l *Log, v string) { l.host = v },
+	"uri":                    func(l *Log, v string) { l.uri = v },
+	"args":                   func(l *Log, v string) { l.args = v },
+	"status":                 func(l *Log, v string) { l.status = strToInt(v) },
+	"body_bytes_sent":        func(l *Log, v string) { l.bodyBytesSent = strToInt(v) },
+	"request_time":           func(l *Log, v string) { l.requestTime = v },
+	"upstream_response_time": func(l *Log, v string) { l.upstreamResponseTime = v },
+	"upstream_addr":          func(l *Log, v string) { l.upstreamAddr = v },
+	"upstream_status":        func(l *Log, v string) { l.upstreamStatus = v },
+	"http_referer":           func(l *Log, v string) { l.httpReferer = getIf(v) },
+	"http_via":               func(l *Log, v string) { l.httpVia = getIf(v) },
+	"http_x_forwarded_for":   func(l *Log, v string) { l.httpXForwardedFor = getIf(v) },
+	"http_user_agent":        func(l *Log, v string) { l.httpUserAgent = getIf(v) },
+	"sent_http_x_profile":    func(l *Log, v string) { l.sentHttpXProfile = getIf(v) },
+	"connection_requests":    func(l *Log, v string) { l.connectionRequests = strToInt(v) },
+	"connection":             func(l *Log, v string) { l.connection = v },
+	"bytes_sent":             func(l *Log, v string) { l.bytesSent = strToInt(v) },
+}
+
+// поля, которые нужны конвейеру всегда: гео, устройство, фильтр и трафик
+var pipelineFields = []string{"remote_addr", "http_user_agent", "host", "bytes_sent"}
+
+// поля, которые нужны конвейеру, ключу зрителя и, если они кому-то нужны, сырым событиям
+func PipelineFields(identity *IdentityBuilder, events bool) []string {
+	fields := append(append([]string{}, pipelineFields...), identity.Fields()...)
+
+	if events {
+		fields = append(fields, eventFields...)
+	}
+
+	return fields
+}
+
+// fields - поля, которые нужны конвейеру, если не указаны - все, что есть в шаблоне,
+// uri нужен всегда, из него определяются канал и качество
+func NewFastParser(config ParserConfig, fields ...string) *FastParser {
+	p := &FastParser{
+		delim:       config.PartsDelim,
+		streamDelim: config.StreamDelim,
+	}
+
+	if len(fields) == 0 {
+		for name := range logSetters {
+			fields = append(fields, name)
+		}
+	}
+
+	for _, name := range append(fields, "uri") {
+		set, ok := logSetters[name]
+		pos := config.Template.pos(name)
+
+		if !ok || pos == -1 {
+			continue
+		}
+
+		for len(p.setters) <= pos {
+			p.setters = append(p.setters, nil)
+		}
+
+		p.setters[pos] = set
+	}
+
+	return p
+}
+
+// заполняет l, который можно переиспользовать между сообщениями: прежние значения сбрасываются
+func (p *FastParser) Parse(parts format.LogParts, l *Log) error {
+	content := ifaceToStr(parts["content"])
+
+	if len(content) == 0 {
+		return errors.New(withMessage(constants.NOT_RECOGNIZE_LOGS, content))
+	}
+
+	*l = Log{}
+
+	// в обрезанной строке недостающие поля заполняются как пустые, так же как при полном разборе
+	for pos := 0; pos < len(p.setters); pos++ {
+		value, rest, _ := p.next(content)
+
+		if set := p.setters[pos]; set != nil {
+			set(l, value)
+		}
+
+		content = rest
+	}
+
+	l._splitUri = parseStreamUri(l.uri, p.streamDelim)
+	l._clientInfo = _clientInfo{
+		client:   ifaceToStr(parts["client"]),
+		tag:      ifaceToStr(parts["tag"]),
+		hostname: ifaceToStr(parts["hostname"]),
+	}
+
+	return nil
+}
+
+// очередное поле строки и остаток после разделителя, last - полей больше нет
+func (p *FastParser) next(content string) (value string, rest string, last bool) {
+	end := strings.Index(content, p.delim)
+
+	if end < 0 {
+		return content, "", true
+	}
+
+	return content[:end], content[end+len(p.delim):], false
+}
+
+// канал, качество и сегмент из пути запроса без разбиения на слайс
+// @see readme
+func parseStreamUri(uri string, delim string) _splitUri {
+	segment := func(index int) string {
+		return uriSegment(uri, delim, index)
+	}
+
+	switch count := strings.Count(uri, delim) + 1; {
+	// /streaming/muztv/324/vl2w/segment-1597220444-01972046.ts
+	case isInetraTranscoder(count):
+		return _splitUri{
+			prefix:  segment(1),
+			channel: segment(2),
+			quality: segment(4),
+			index:   segment(5),
+		}
+	// /streaming/karusel/324/variable.m3u8
+	case isInetraMultibitrate(count):
+		return _splitUri{
+			prefix:  constants.UNKNOWN,
+			channel: segment(2),
+			quality: constants.UNKNOWN,
+			index:   segment(4),
+		}
+	// /domashniy/tracks-v1a1/2020/08/13/11/38/56-06000.ts
+	case isFlussonicTranscoder(count):
+		return _splitUri{
+			prefix:  segment(1),
+			channel: segment(1),
+			quality: splitQuality(segment(2)),
+			index:   segment(8),
+		}
+	// /karusel/tracks-v1a1/mono.m3u8
+	case isFlussonicPlaylist(count):
+		return _splitUri{
+			prefix:  constants.UNKNOWN,
+			channel: segment(1),
+			quality: splitQuality(segment(2)),
+			index:   segment(3),
+		}
+	// /karusel/index.m3u8
+	case isFlussonicMultibitrate(count):
+		return _splitUri{
+			prefix:  constants.UNKNOWN,
+			channel: segment(1),
+			quality: constants.UNKNOWN,
+			index:   segment(2),
+		}
+	}
+
+	return _splitUri{
+		channel: constants.UNKNOWN,
+		quality: constants.UNKNOWN,
+		index:   constants.UNKNOWN,
+		prefix:  constants.UNKNOWN,
+	}
+}
+
+// index-й сегмент пути
+func uriSegment(uri string, delim string, index int) string {
+	for ; index > 0; index-- {
+		next := strings.Index(uri, delim)
+
+		if next < 0 {
+			return ""
+		}
+
+		uri = uri[next+len(delim):]
+	}
+
+	if end := strings.Index(uri, delim); end >= 0 {
+		return uri[:end]
+	}
+
+	return uri
+}
+
+// tracks-v1a1
+func splitQuality(quality string) string {
+	if strings.Count(quality, "-") == 1 {
+		return quality[strings.Index(quality, "-")+1:]
+	}
+	return constants.UNKNOWN
+}
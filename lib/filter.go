@@ -0,0 +1,137 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/LimeHD/limehd-syslog-server/constants"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+type (
+	// Отсеивает запросы мониторинга, проверок доступности и поисковых роботов до подсчета онлайна
+	// запрос отбрасывается целиком (drop) или учитывается в трафике с тэгом filtered (tag),
+	// в онлайн и сессии отфильтрованные запросы не попадают ни в одном из режимов
+	RequestFilter struct {
+		mode  string
+		rules []filterRule
+	}
+
+	RequestFilterConfig struct {
+		// регулярные выражения для User-Agent
+		UserAgents []string
+		// подсети в нотации CIDR
+		Networks []string
+		// значения $host, на которые ходят проверки доступности
+		Hosts []string
+		// отсеивать запросы, которые классификатор User-Agent определил как bot
+		Bots bool
+		Mode string
+	}
+
+	filterRule struct {
+		name  string
+		match func(r Receiver) bool
+		// у каждого правила свой счетчик, Match вызывается на каждый лог
+		counter *MetricCounter
+	}
+)
+
+func NewRequestFilter(config RequestFilterConfig) (*RequestFilter, error) {
+	if config.Mode != constants.FILTER_MODE_DROP && config.Mode != constants.FILTER_MODE_TAG {
+		return nil, errors.New(fmt.Sprintf("%s: %s", constants.FILTER_UNKNOWN_MODE, config.Mode))
+	}
+
+	f := &RequestFilter{
+		mode: config.Mode,
+	}
+
+	for _, raw := range config.UserAgents {
+		pattern, err := regexp.Compile(raw)
+
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s", constants.FILTER_RULE_INVALID, err))
+		}
+
+		f.add("ua:"+raw, func(r Receiver) bool {
+			return pattern.MatchString(r.Parser.GetUserAgent())
+		})
+	}
+
+	for _, raw := range config.Networks {
+		_, network, err := net.ParseCIDR(raw)
+
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s", constants.FILTER_RULE_INVALID, err))
+		}
+
+		f.add("cidr:"+raw, func(r Receiver) bool {
+			ip := net.ParseIP(r.Parser.GetRemoteAddr())
+			return ip != nil && network.Contains(ip)
+		})
+	}
+
+	for _, raw := range config.Hosts {
+		host := strings.ToLower(raw)
+
+		f.add("host:"+raw, func(r Receiver) bool {
+			return strings.ToLower(r.Parser.GetStreamingServer()) == host
+		})
+	}
+
+	if config.Bots {
+		f.add("bot", func(r Receiver) bool {
+			return r.Device.DeviceType == "bot"
+		})
+	}
+
+	return f, nil
+}
+
+// задано ли хотя бы одно правило
+func (c RequestFilterConfig) Enabled() bool {
+	return len(c.UserAgents) > 0 || len(c.Networks) > 0 || len(c.Hosts) > 0 || c.Bots
+}
+
+// название первого подходящего правила, пустая строка - запрос от зрителя
+func (f *RequestFilter) Match(r Receiver) string {
+	for _, rule := range f.rules {
+		if rule.match(r) {
+			rule.counter.Inc()
+			return rule.name
+		}
+	}
+
+	return ""
+}
+
+// отфильтрованный запрос не учитывается нигде
+func (f *RequestFilter) Drops() bool {
+	return f.mode == constants.FILTER_MODE_DROP
+}
+
+// сколько запросов отфильтровано каждым правилом с момента запуска
+func (f *RequestFilter) Counters() map[string]int64 {
+	counters := make(map[string]int64, len(f.rules))
+	for _, rule := range f.rules {
+		counters[rule.name] = rule.counter.Value()
+	}
+
+	return counters
+}
+
+func (f *RequestFilter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(f.Counters())
+}
+
+func (f *RequestFilter) add(name string, match func(r Receiver) bool) {
+	f.rules = append(f.rules, filterRule{
+		name:    name,
+		match:   match,
+		counter: &MetricCounter{},
+	})
+}
@@ -0,0 +1,78 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type (
+	// Служебный HTTP сервер: метрики, состояние сервиса и т.д.
+	HttpServer struct {
+		server  *http.Server
+		mux     *http.ServeMux
+		_logger Logger
+	}
+
+	HttpServerConfig struct {
+		Addr   string
+		Logger Logger
+	}
+)
+
+func NewHttpServer(config HttpServerConfig) *HttpServer {
+	h := &HttpServer{
+		mux:     http.NewServeMux(),
+		_logger: config.Logger,
+	}
+
+	h.server = &http.Server{
+		Addr:    config.Addr,
+		Handler: h.mux,
+	}
+
+	return h
+}
+
+func (h *HttpServer) Handle(pattern string, handler http.Handler) {
+	h.mux.Handle(pattern, handler)
+}
+
+// работает до отмены ctx, ошибка запуска (например, занятый порт) возвращается сразу
+func (h *HttpServer) Run(ctx context.Context) error {
+	// остановленный http.Server нельзя запустить повторно
+	h.server = &http.Server{
+		Addr:    h.server.Addr,
+		Handler: h.mux,
+	}
+
+	h._logger.InfoLog(fmt.Sprintf("HTTP server listen on %s", h.server.Addr))
+
+	failed := make(chan error, 1)
+
+	go func(server *http.Server) {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			failed <- err
+		}
+	}(h.server)
+
+	select {
+	case err := <-failed:
+		return err
+	case <-ctx.Done():
+		h.Close()
+		return nil
+	}
+}
+
+func (h *HttpServer) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_ = h.server.Shutdown(ctx)
+}
+
+func (h *HttpServer) CloseMessage() string {
+	return "Close HTTP server"
+}
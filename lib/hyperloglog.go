@@ -0,0 +1,291 @@
+package lib
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/LimeHD/limehd-syslog-server/constants"
+	"io"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+const HLL_MIN_PRECISION = 4
+const HLL_MAX_PRECISION = 18
+
+type (
+	// Скетч HyperLogLog для оценки количества уникальных значений
+	// занимает 2^precision байт независимо от количества пользователей, скетчи можно объединять
+	// стандартная ошибка оценки ~ 1.04 / sqrt(2^precision), для 14 это ~0.8%
+	HyperLogLog struct {
+		precision uint8
+		registers []uint8
+	}
+)
+
+func NewHyperLogLog(precision uint8) (*HyperLogLog, error) {
+	if precision < HLL_MIN_PRECISION || precision > HLL_MAX_PRECISION {
+		return nil, errors.New(constants.HLL_INVALID_PRECISION)
+	}
+
+	return &HyperLogLog{
+		precision: precision,
+		registers: make([]uint8, 1<<precision),
+	}, nil
+}
+
+// точность из флага: диапазон проверяется до приведения к uint8, иначе 260 превратится в 4
+func HyperLogLogPrecision(value int) (uint8, error) {
+	if value < HLL_MIN_PRECISION || value > HLL_MAX_PRECISION {
+		return 0, errors.New(fmt.Sprintf("%s: %d", constants.HLL_INVALID_PRECISION, value))
+	}
+
+	return uint8(value), nil
+}
+
+// скетч из сохраненных регистров, битый или обрезанный снимок не должен уронить обработчик на первом Add
+func restoreHyperLogLog(precision uint8, registers []uint8, name string) (*HyperLogLog, error) {
+	if len(registers) != 1<<precision {
+		return nil, errors.New(fmt.Sprintf("%s: %s", constants.SNAPSHOT_MISMATCH, name))
+	}
+
+	return &HyperLogLog{
+		precision: precision,
+		registers: registers,
+	}, nil
+}
+
+// добавляет 64 битный хеш значения
+func (h *HyperLogLog) Add(hash uint64) {
+	index := hash >> (64 - h.precision)
+	// старшие биты ушли на индекс регистра, в оставшихся ищем позицию первой единицы
+	// ограничивающий бит гарантирует, что rank не выйдет за пределы 64 - precision + 1
+	rank := uint8(bits.LeadingZeros64(hash<<h.precision|1<<(h.precision-1))) + 1
+
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+	}
+}
+
+// оценка количества уникальных значений
+func (h *HyperLogLog) Count() int {
+	m := float64(len(h.registers))
+	sum := 0.0
+	zeros := 0
+
+	for _, r := range h.registers {
+		sum += 1 / float64(uint64(1)<<r)
+
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	estimate := h.alpha() * m * m / sum
+
+	// на малых количествах точнее линейный подсчет по пустым регистрам
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return int(estimate + 0.5)
+}
+
+// объединяет скетч с другим скетчем той же точности
+func (h *HyperLogLog) Merge(other *HyperLogLog) error {
+	if h.precision != other.precision {
+		return errors.New(constants.HLL_PRECISION_MISMATCH)
+	}
+
+	for i, r := range other.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+
+	return nil
+}
+
+func (h *HyperLogLog) alpha() float64 {
+	m := float64(len(h.registers))
+
+	switch len(h.registers) {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	}
+
+	return 0.7213 / (1 + 1.079/m)
+}
+
+type (
+	// Онлайн пользователи на скетчах HyperLogLog: память на канал постоянна
+	// и не зависит от количества зрителей, взамен получаем оценку с небольшой погрешностью
+	HyperLogLogOnline struct {
+		mt               *sync.RWMutex
+		precision        uint8
+		sketches         map[string]*HyperLogLog
+		lastFlushedAt    int64
+		scheduleCallback func(OnlineCounter)
+	}
+)
+
+func NewHyperLogLogOnline(precision uint8) (*HyperLogLogOnline, error) {
+	// проверяем точность заранее, чтобы не получить ошибку на первом же пользователе
+	if _, err := NewHyperLogLog(precision); err != nil {
+		return nil, err
+	}
+
+	h := &HyperLogLogOnline{
+		mt:        &sync.RWMutex{},
+		precision: precision,
+		sketches:  map[string]*HyperLogLog{},
+	}
+	h.setFlushedAt()
+
+	return h, nil
+}
+
+func (h *HyperLogLogOnline) SetScheduleHandler(handler func(o OnlineCounter)) {
+	h.scheduleCallback = handler
+}
+
+// повторное добавление не меняет скетч, поэтому проверка на существование не нужна
+func (h *HyperLogLogOnline) Peek(i UniqueIdentity) {
+	h.mt.Lock()
+	sketch, ok := h.sketches[i.Channel]
+
+	if !ok {
+		sketch, _ = NewHyperLogLog(h.precision)
+		h.sketches[i.Channel] = sketch
+	}
+
+	sketch.Add(i.Hash())
+	h.mt.Unlock()
+}
+
+func (h *HyperLogLogOnline) Flush() {
+	h.mt.Lock()
+	h.sketches = map[string]*HyperLogLog{}
+	h.setFlushedAt()
+	h.mt.Unlock()
+}
+
+// оценки считаются сразу, т.к. после Flush скетчи будут заменены
+func (h *HyperLogLogOnline) Connections() map[string]ChannelCounter {
+	h.mt.RLock()
+	defer h.mt.RUnlock()
+
+	connections := make(map[string]ChannelCounter, len(h.sketches))
+	for name, sketch := range h.sketches {
+		connections[name] = channelEstimate(sketch.Count())
+	}
+
+	return connections
+}
+
+func (h *HyperLogLogOnline) Count() int {
+	h.mt.RLock()
+	defer h.mt.RUnlock()
+	return len(h.sketches)
+}
+
+func (h *HyperLogLogOnline) Total() int {
+	total := 0
+	for _, channel := range h.Connections() {
+		total += channel.Count()
+	}
+	return total
+}
+
+func (h *HyperLogLogOnline) Top(n int) SortedList {
+	return topConnections(h.Connections(), n)
+}
+
+func (h *HyperLogLogOnline) String() string {
+	return onlineString(h.Top(10))
+}
+
+func (h *HyperLogLogOnline) Scheduler(ctx context.Context, duration int64) error {
+	return runEvery(ctx, func() time.Duration {
+		return untilFlush(h.flushedAt(), duration)
+	}, func() {
+		h.scheduleCallback(h)
+	})
+}
+
+type hyperLogLogSnapshot struct {
+	LastFlushedAt int64
+	Precision     uint8
+	Sketches      map[string][]uint8
+}
+
+func (h *HyperLogLogOnline) Snapshot(w io.Writer) error {
+	h.mt.RLock()
+	snapshot := hyperLogLogSnapshot{
+		LastFlushedAt: h.lastFlushedAt,
+		Precision:     h.precision,
+		Sketches:      make(map[string][]uint8, len(h.sketches)),
+	}
+
+	for name, sketch := range h.sketches {
+		snapshot.Sketches[name] = append([]uint8(nil), sketch.registers...)
+	}
+	h.mt.RUnlock()
+
+	return gob.NewEncoder(w).Encode(snapshot)
+}
+
+func (h *HyperLogLogOnline) Restore(r io.Reader) (func(), error) {
+	snapshot := hyperLogLogSnapshot{}
+
+	if err := gob.NewDecoder(r).Decode(&snapshot); err != nil {
+		return nil, err
+	}
+
+	if snapshot.Precision != h.precision {
+		return nil, errors.New(constants.HLL_PRECISION_MISMATCH)
+	}
+
+	sketches := make(map[string]*HyperLogLog, len(snapshot.Sketches))
+
+	for name, registers := range snapshot.Sketches {
+		sketch, err := restoreHyperLogLog(snapshot.Precision, registers, name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		sketches[name] = sketch
+	}
+
+	return func() {
+		h.mt.Lock()
+		h.lastFlushedAt = snapshot.LastFlushedAt
+		h.sketches = sketches
+		h.mt.Unlock()
+	}, nil
+}
+
+func (h *HyperLogLogOnline) setFlushedAt() {
+	h.lastFlushedAt = time.Now().Unix()
+}
+
+func (h *HyperLogLogOnline) flushedAt() int64 {
+	h.mt.RLock()
+	defer h.mt.RUnlock()
+	return h.lastFlushedAt
+}
+
+// готовая оценка количества пользователей канала
+type channelEstimate int
+
+func (c channelEstimate) Count() int {
+	return int(c)
+}
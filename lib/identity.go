@@ -0,0 +1,190 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"github.com/LimeHD/limehd-syslog-server/constants"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const IDENTITY_STRATEGY_DELIM = ","
+const IDENTITY_FIELD_DELIM = "+"
+const IDENTITY_ARG_PREFIX = "arg:"
+
+type (
+	// Строит ключ уникального пользователя по настраиваемому списку полей
+	// стратегии перечисляются через запятую и пробуются по очереди, поля стратегии объединяются через +
+	// стратегия подходит, если все ее поля присутствуют в логе, например:
+	// arg:token,sent_http_x_profile,remote_addr+http_user_agent
+	// если не подошла ни одна - пользователь определяется по ip и user-agent
+	IdentityBuilder struct {
+		strategies []identityStrategy
+		// поля лога, которые нужны для ключа, чтобы разбирать только их
+		fields []string
+	}
+
+	identityStrategy struct {
+		// название для среза онлайна identity: поля через +
+		name   string
+		fields []identityField
+	}
+
+	identityField func(l Log) string
+)
+
+var identityFields = map[string]identityField{
+	"remote_addr":          func(l Log) string { return l.GetRemoteAddr() },
+	"http_user_agent":      func(l Log) string { return l.GetUserAgent() },
+	"sent_http_x_profile":  func(l Log) string { return l.GetProfile() },
+	"http_x_forwarded_for": func(l Log) string { return l.GetForwardedFor() },
+	"args":                 func(l Log) string { return l.GetArgs() },
+}
+
+func NewIdentityBuilder(spec string) (*IdentityBuilder, error) {
+	// ip и user-agent нужны всегда, если ни одна стратегия не подойдет
+	b := &IdentityBuilder{
+		fields: []string{"remote_addr", "http_user_agent"},
+	}
+
+	for _, raw := range strings.Split(spec, IDENTITY_STRATEGY_DELIM) {
+		strategy := identityStrategy{}
+		var names []string
+
+		for _, name := range strings.Split(raw, IDENTITY_FIELD_DELIM) {
+			name = strings.TrimSpace(name)
+			field, err := newIdentityField(name)
+
+			if err != nil {
+				return nil, err
+			}
+
+			names = append(names, name)
+			strategy.fields = append(strategy.fields, field)
+			b.addField(name)
+		}
+
+		strategy.name = strings.Join(names, IDENTITY_FIELD_DELIM)
+		b.strategies = append(b.strategies, strategy)
+	}
+
+	return b, nil
+}
+
+// уникальный пользователь канала по первой подходящей стратегии,
+// если ни одна не подошла целиком - по ip и user-agent, как без настройки
+// сработавшая стратегия запоминается в Strategy, чтобы сравнивать способы между собой
+func (b *IdentityBuilder) Build(l Log) UniqueIdentity {
+	identity := UniqueIdentity{
+		Channel: l.GetChannel(),
+		UniqueCombination: UniqueCombination{
+			Ip:        l.GetRemoteAddr(),
+			UserAgent: l.GetUserAgent(),
+		},
+	}
+
+	var values []string
+
+	for index, strategy := range b.strategies {
+		// номер стратегии в ключе, чтобы одинаковые значения разных полей не совпадали
+		values = append(values[:0], strconv.Itoa(index))
+
+		for _, field := range strategy.fields {
+			if value := field(l); isPresent(value) {
+				values = append(values, value)
+			}
+		}
+
+		if len(values) == len(strategy.fields)+1 {
+			identity.Strategy = strategy.name
+			identity.Key = strings.Join(values, constants.LOG_DELIM)
+			identity.hash = identity.computeHash()
+
+			return identity
+		}
+	}
+
+	// номер после всех стратегий, чтобы не совпасть с ключом настроенной стратегии
+	identity.Strategy = constants.DEFAULT_IDENTITY
+	identity.Key = strings.Join([]string{strconv.Itoa(len(b.strategies)), identity.Ip, identity.UserAgent}, constants.LOG_DELIM)
+	identity.hash = identity.computeHash()
+
+	return identity
+}
+
+// поля лога, из которых строится ключ
+func (b *IdentityBuilder) Fields() []string {
+	return b.fields
+}
+
+func (b *IdentityBuilder) addField(name string) {
+	if strings.HasPrefix(name, IDENTITY_ARG_PREFIX) {
+		name = "args"
+	}
+
+	for _, field := range b.fields {
+		if field == name {
+			return
+		}
+	}
+
+	b.fields = append(b.fields, name)
+}
+
+// поле лога или параметр запроса из $args в виде arg:token
+func newIdentityField(name string) (identityField, error) {
+	if strings.HasPrefix(name, IDENTITY_ARG_PREFIX) {
+		arg := strings.TrimPrefix(name, IDENTITY_ARG_PREFIX)
+
+		if len(arg) == 0 {
+			return nil, errors.New(fmt.Sprintf("%s: %s", constants.IDENTITY_UNKNOWN_FIELD, name))
+		}
+
+		return func(l Log) string {
+			return queryArg(l.GetArgs(), arg)
+		}, nil
+	}
+
+	if field, ok := identityFields[name]; ok {
+		return field, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("%s: %s", constants.IDENTITY_UNKNOWN_FIELD, name))
+}
+
+// значение параметра из строки запроса без разбора остальных параметров:
+// битый соседний параметр не должен лишать зрителя ключа
+func queryArg(args string, name string) string {
+	for len(args) > 0 {
+		pair := args
+
+		if end := strings.IndexByte(args, '&'); end >= 0 {
+			pair, args = args[:end], args[end+1:]
+		} else {
+			args = ""
+		}
+
+		key, value := pair, ""
+
+		if eq := strings.IndexByte(pair, '='); eq >= 0 {
+			key, value = pair[:eq], pair[eq+1:]
+		}
+
+		if unescaped, err := url.QueryUnescape(key); err != nil || unescaped != name {
+			continue
+		}
+
+		if unescaped, err := url.QueryUnescape(value); err == nil {
+			return unescaped
+		}
+
+		return value
+	}
+
+	return ""
+}
+
+func isPresent(value string) bool {
+	return len(value) > 0 && value != constants.UNKNOWN && value != constants.EMPTY_VALUE
+}
@@ -1,28 +1,46 @@
 package lib
 
 import (
+	"errors"
 	"fmt"
+	"github.com/LimeHD/limehd-syslog-server/constants"
 	_ "github.com/influxdata/influxdb1-client" // this is important because of the bug in go mod
 	client "github.com/influxdata/influxdb1-client/v2"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type (
 	InfluxClient struct {
-		c                 client.Client
-		Database          string
-		Measurement       string
-		MeasurementOnline string
-		_logger           Logger
+		influxMeasurements
+		c        client.Client
+		Database string
+		_logger  Logger
+	}
+
+	// названия измерений, общие для клиентов influx v1 и v2,
+	// чтобы при смене версии дашборды меняли только источник данных
+	influxMeasurements struct {
+		Measurement          string
+		MeasurementOnline    string
+		MeasurementSessions  string
+		MeasurementWatchTime string
+		MeasurementAudience  string
+		MeasurementInternal  string
 	}
 
 	InfluxClientConfig struct {
-		Addr              string
-		Database          string
-		Logger            Logger
-		Measurement       string
-		MeasurementOnline string
+		Addr                 string
+		Database             string
+		Logger               Logger
+		Measurement          string
+		MeasurementOnline    string
+		MeasurementSessions  string
+		MeasurementWatchTime string
+		MeasurementAudience  string
+		MeasurementInternal  string
 	}
 
 	InfluxRequestTags struct {
@@ -33,12 +51,20 @@ type (
 		StreamServer string
 		Host         string
 		Quality      string
-		Time         time.Time
+		DeviceType   string
+		Os           string
+		App          string
+		Filtered     string
+		// стратегия --identity, по которой определен зритель
+		Identity string
+		Time     time.Time
 	}
 
 	InfluxRequestFields struct {
 		BytesSent   int
 		Connections int
+		// доля выборки зрителей, по которой BytesSent пересчитан в оценку, 0 - без выборки
+		SampleRate float64
 	}
 
 	InfluxRequestParams struct {
@@ -47,7 +73,16 @@ type (
 	}
 
 	InfluxOnlineRequestParams struct {
-		Channels map[string]ChannelConnections
+		Channels map[string]ChannelCounter
+		// дополнительные срезы онлайна по измерениям (страна, ASN и т.д.)
+		Dimensions []OnlineDimensionConnections
+		// сумма по всем каналам на момент отправки
+		Total int
+		// пики внутри окна по каналам и по платформе в целом
+		Peaks     map[string]OnlinePeak
+		TotalPeak OnlinePeak
+		// доля выборки зрителей, по которой значения пересчитаны в оценку, 0 - без выборки
+		SampleRate float64
 	}
 )
 
@@ -59,21 +94,30 @@ func NewInfluxClient(config InfluxClientConfig) (*InfluxClient, error) {
 	})
 	i.Database = config.Database
 	i._logger = config.Logger
-	i.Measurement = config.Measurement
-	i.MeasurementOnline = config.MeasurementOnline
+	i.influxMeasurements = influxMeasurements{
+		Measurement:          config.Measurement,
+		MeasurementOnline:    config.MeasurementOnline,
+		MeasurementSessions:  config.MeasurementSessions,
+		MeasurementWatchTime: config.MeasurementWatchTime,
+		MeasurementAudience:  config.MeasurementAudience,
+		MeasurementInternal:  config.MeasurementInternal,
+	}
 
 	if err != nil {
 		return nil, err
 	}
 
+	// недоступный при запуске influx не отключает приемник: каждая пачка пишется заново
 	d, s, err := i.c.Ping(time.Second * 5)
-	i._logger.Debug(fmt.Sprintf("Connect to Influx server version %s", s))
-	i._logger.Debug(fmt.Sprintf("Connection duration is %v", d))
 
 	if err != nil {
-		return nil, err
+		i._logger.ErrorLog(errors.New(fmt.Sprintf("%s: %s", constants.INFLUX_NOT_AVAILABLE, err)))
+		return i, nil
 	}
 
+	i._logger.Debug(fmt.Sprintf("Connect to Influx server version %s", s))
+	i._logger.Debug(fmt.Sprintf("Connection duration is %v", d))
+
 	return i, nil
 }
 
@@ -81,6 +125,60 @@ type tags map[string]string
 type fields map[string]interface{}
 
 func (i InfluxClient) Point(params []InfluxRequestParams) error {
+	points, err := i.trafficPoints(params)
+
+	if err != nil {
+		return err
+	}
+
+	return i.write(points)
+}
+
+func (i InfluxClient) PointOnline(params InfluxOnlineRequestParams) error {
+	points, err := i.onlinePoints(params)
+
+	if err != nil {
+		return err
+	}
+
+	return i.write(points)
+}
+
+func (i InfluxClient) PointSessions(report SessionReport) error {
+	points, err := i.sessionPoints(report)
+
+	if err != nil {
+		return err
+	}
+
+	return i.write(points)
+}
+
+func (i InfluxClient) PointAudience(report AudienceReport) error {
+	points, err := i.audiencePoints(report)
+
+	if err != nil {
+		return err
+	}
+
+	return i.write(points)
+}
+
+func (i InfluxClient) PointMetrics(snapshot MetricsSnapshot) error {
+	points, err := i.metricsPoints(snapshot)
+
+	if err != nil {
+		return err
+	}
+
+	return i.write(points)
+}
+
+func (i InfluxClient) write(points []*client.Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+
 	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
 		Database: i.Database,
 	})
@@ -89,8 +187,50 @@ func (i InfluxClient) Point(params []InfluxRequestParams) error {
 		return err
 	}
 
+	bp.AddPoints(points)
+
+	if err := i.c.Write(bp); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// реализация Sink
+
+func (i InfluxClient) WriteTraffic(params []InfluxRequestParams) error {
+	return i.Point(params)
+}
+
+func (i InfluxClient) WriteOnline(params InfluxOnlineRequestParams) error {
+	return i.PointOnline(params)
+}
+
+func (i InfluxClient) WriteSessions(report SessionReport) error {
+	return i.PointSessions(report)
+}
+
+func (i InfluxClient) WriteAudience(report AudienceReport) error {
+	return i.PointAudience(report)
+}
+
+func (i InfluxClient) WriteMetrics(snapshot MetricsSnapshot) error {
+	return i.PointMetrics(snapshot)
+}
+
+func (m influxMeasurements) trafficPoints(params []InfluxRequestParams) ([]*client.Point, error) {
+	points := make([]*client.Point, 0, len(params))
+
 	for _, param := range params {
-		pt, err := i.createPoint(i.Measurement,
+		f := fields{
+			"bytes_sent": param.BytesSent,
+		}
+
+		if param.SampleRate > 0 {
+			f["sample_rate"] = param.SampleRate
+		}
+
+		pt, err := createPoint(m.Measurement,
 			tags{
 				"country_name":     param.CountryName,
 				"asn_number":       strconv.FormatUint(uint64(param.AsnNumber), 10),
@@ -99,64 +239,251 @@ func (i InfluxClient) Point(params []InfluxRequestParams) error {
 				"streaming_server": param.StreamServer,
 				"host":             param.Host,
 				"quality":          param.Quality,
+				"device_type":      param.DeviceType,
+				"os":               param.Os,
+				"app":              param.App,
+				"filtered":         param.Filtered,
+				"identity":         param.Identity,
 			},
-			fields{
-				"bytes_sent": param.BytesSent,
-			},
+			f,
 			param.Time,
 		)
 
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		bp.AddPoint(pt)
+		points = append(points, pt)
 	}
 
-	if err := i.c.Write(bp); err != nil {
-		return err
-	}
-
-	return nil
+	return points, nil
 }
 
-func (i InfluxClient) PointOnline(params InfluxOnlineRequestParams) error {
-	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-		Database: i.Database,
+func (m influxMeasurements) onlinePoints(params InfluxOnlineRequestParams) ([]*client.Point, error) {
+	points := make([]*client.Point, 0, len(params.Channels))
+	now := time.Now()
+
+	// формируем данные пачками для отправки в influx
+	for name, channel := range params.Channels {
+		f := onlineFields(params, fields{
+			"value": channel.Count(),
+		})
+
+		if peak, ok := params.Peaks[name]; ok {
+			f["peak"] = peak.Value
+			f["peak_at"] = peak.At.Unix()
+		}
+
+		pt, err := createPoint(m.MeasurementOnline,
+			tags{
+				"channel": name,
+			},
+			f,
+			now,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		points = append(points, pt)
+	}
+
+	// онлайн по платформе в целом
+	total := onlineFields(params, fields{
+		"value": params.Total,
 	})
 
+	if !params.TotalPeak.At.IsZero() {
+		total["peak"] = params.TotalPeak.Value
+		total["peak_at"] = params.TotalPeak.At.Unix()
+	}
+
+	pt, err := createPoint(m.MeasurementOnline+"_total", tags{}, total, now)
+
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// формируем данные пачками для отправки в influx
-	for name, channel := range params.Channels {
-		pt, err := i.createPoint(i.MeasurementOnline,
+	points = append(points, pt)
+
+	// каждое измерение пишется в свой measurement: online_users_country, online_users_asn ...
+	for _, dimension := range params.Dimensions {
+		measurement := m.MeasurementOnline + "_" + dimension.Name
+
+		for name, values := range dimension.Channels {
+			for value, counter := range values {
+				pt, err := createPoint(measurement,
+					tags{
+						"channel":      name,
+						dimension.Name: value,
+					},
+					onlineFields(params, fields{
+						"value": counter.Count(),
+					}),
+					now,
+				)
+
+				if err != nil {
+					return nil, err
+				}
+
+				points = append(points, pt)
+			}
+		}
+	}
+
+	return points, nil
+}
+
+// общие поля измерений онлайна
+func onlineFields(params InfluxOnlineRequestParams, f fields) fields {
+	if params.SampleRate > 0 {
+		f["sample_rate"] = params.SampleRate
+	}
+
+	return f
+}
+
+// сессия - точка на момент закрытия, среднее время просмотра - точка на канал
+func (m influxMeasurements) sessionPoints(report SessionReport) ([]*client.Point, error) {
+	points := make([]*client.Point, 0, len(report.Records)+len(report.WatchTime))
+
+	for _, record := range report.Records {
+		f := fields{
+			"duration":   record.Duration.Seconds(),
+			"bytes_sent": record.BytesSent,
+			"qualities":  strings.Join(record.Qualities, ","),
+			"start":      record.Start.Unix(),
+		}
+
+		if record.SampleRate > 0 {
+			f["sample_rate"] = record.SampleRate
+		}
+
+		pt, err := createPoint(m.MeasurementSessions,
 			tags{
-				"channel": name,
+				"channel":      record.Channel,
+				"country_name": record.Country,
+				"asn_number":   strconv.FormatUint(uint64(record.AsnNumber), 10),
+				"asn_org":      record.AsnOrg,
+			},
+			f,
+			record.End,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		points = append(points, pt)
+	}
+
+	now := time.Now()
+
+	for channel, watchTime := range report.WatchTime {
+		pt, err := createPoint(m.MeasurementWatchTime,
+			tags{
+				"channel": channel,
 			},
 			fields{
-				"value": channel.Count(),
+				"average_duration": watchTime.AverageDuration.Seconds(),
+				"sessions":         watchTime.Sessions,
 			},
-			time.Now(),
+			now,
 		)
 
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		bp.AddPoint(pt)
+		points = append(points, pt)
 	}
 
-	if err := i.c.Write(bp); err != nil {
-		return err
+	return points, nil
+}
+
+// точки ставятся на начало периода, тэг period различает день и месяц
+func (m influxMeasurements) audiencePoints(report AudienceReport) ([]*client.Point, error) {
+	points := make([]*client.Point, 0, len(report.Channels)+1)
+
+	for channel, unique := range report.Channels {
+		pt, err := createPoint(m.MeasurementAudience,
+			tags{
+				"channel": channel,
+				"period":  report.Period,
+			},
+			fields{
+				"unique": unique,
+			},
+			report.Start,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		points = append(points, pt)
 	}
 
-	return nil
+	pt, err := createPoint(m.MeasurementAudience+"_total",
+		tags{
+			"period": report.Period,
+		},
+		fields{
+			"unique": report.Total,
+		},
+		report.Start,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append(points, pt), nil
+}
+
+// все метрики конвейера пишутся одной точкой, тэг host различает экземпляры сервиса
+func (m influxMeasurements) metricsPoints(snapshot MetricsSnapshot) ([]*client.Point, error) {
+	values := fields{}
+
+	for name, value := range snapshot.Counters {
+		values[name] = value
+	}
+
+	for name, value := range snapshot.Gauges {
+		values[name] = value
+	}
+
+	for name, timing := range snapshot.Timings {
+		values[name+"_count"] = timing.Count
+		values[name+"_avg"] = timing.Average
+		values[name+"_max"] = timing.Max
+	}
+
+	// точка без полей невалидна, до первого лога отправлять нечего
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	host, _ := os.Hostname()
+	pt, err := createPoint(m.MeasurementInternal,
+		tags{
+			"host": host,
+		},
+		values,
+		snapshot.Time,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return []*client.Point{pt}, nil
 }
 
 // todo временную метку нужно брать с самого запроса
-func (i InfluxClient) createPoint(m string, t tags, f fields, tt time.Time) (*client.Point, error) {
+func createPoint(m string, t tags, f fields, tt time.Time) (*client.Point, error) {
 	return client.NewPoint(m, t, f, tt)
 }
 
@@ -0,0 +1,228 @@
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/LimeHD/limehd-syslog-server/constants"
+	client "github.com/influxdata/influxdb1-client/v2"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type (
+	// Клиент InfluxDB 2.x, пишет line protocol через /api/v2/write
+	Influx2Client struct {
+		influxMeasurements
+		writeUrl  string
+		token     string
+		precision string
+		gzip      bool
+		http      *http.Client
+		_logger   Logger
+	}
+
+	Influx2ClientConfig struct {
+		Addr                 string
+		Org                  string
+		Bucket               string
+		Token                string
+		Precision            string
+		Gzip                 bool
+		Logger               Logger
+		Measurement          string
+		MeasurementOnline    string
+		MeasurementSessions  string
+		MeasurementWatchTime string
+		MeasurementAudience  string
+		MeasurementInternal  string
+	}
+)
+
+// соответствие точности api v2 и точности line protocol клиента v1
+var influx2Precisions = map[string]string{
+	"ns": "n",
+	"us": "u",
+	"ms": "ms",
+	"s":  "s",
+}
+
+func NewInflux2Client(config Influx2ClientConfig) (*Influx2Client, error) {
+	if _, ok := influx2Precisions[config.Precision]; !ok {
+		return nil, errors.New(fmt.Sprintf("%s: %s", constants.INFLUX_INVALID_PRECISION, config.Precision))
+	}
+
+	if len(config.Org) == 0 || len(config.Bucket) == 0 {
+		return nil, errors.New(constants.INFLUX2_ORG_BUCKET_REQUIRED)
+	}
+
+	addr := strings.TrimRight(config.Addr, "/")
+	query := url.Values{}
+	query.Set("org", config.Org)
+	query.Set("bucket", config.Bucket)
+	query.Set("precision", config.Precision)
+
+	i := &Influx2Client{
+		influxMeasurements: influxMeasurements{
+			Measurement:          config.Measurement,
+			MeasurementOnline:    config.MeasurementOnline,
+			MeasurementSessions:  config.MeasurementSessions,
+			MeasurementWatchTime: config.MeasurementWatchTime,
+			MeasurementAudience:  config.MeasurementAudience,
+			MeasurementInternal:  config.MeasurementInternal,
+		},
+		writeUrl:  fmt.Sprintf("%s/api/v2/write?%s", addr, query.Encode()),
+		token:     config.Token,
+		precision: config.Precision,
+		gzip:      config.Gzip,
+		http:      &http.Client{Timeout: time.Second * 10},
+		_logger:   config.Logger,
+	}
+
+	// недоступный при запуске influx не отключает приемник: каждая пачка пишется заново
+	start := time.Now()
+	response, err := i.http.Get(addr + "/health")
+
+	if err != nil {
+		i._logger.ErrorLog(errors.New(fmt.Sprintf("%s: %s", constants.INFLUX_NOT_AVAILABLE, err)))
+		return i, nil
+	}
+
+	_ = response.Body.Close()
+
+	i._logger.Debug(fmt.Sprintf("Connect to Influx v2 server, status %s", response.Status))
+	i._logger.Debug(fmt.Sprintf("Connection duration is %v", time.Since(start)))
+
+	return i, nil
+}
+
+func (i Influx2Client) WriteTraffic(params []InfluxRequestParams) error {
+	points, err := i.trafficPoints(params)
+
+	if err != nil {
+		return err
+	}
+
+	return i.write(points)
+}
+
+func (i Influx2Client) WriteOnline(params InfluxOnlineRequestParams) error {
+	points, err := i.onlinePoints(params)
+
+	if err != nil {
+		return err
+	}
+
+	return i.write(points)
+}
+
+func (i Influx2Client) WriteSessions(report SessionReport) error {
+	points, err := i.sessionPoints(report)
+
+	if err != nil {
+		return err
+	}
+
+	return i.write(points)
+}
+
+func (i Influx2Client) WriteAudience(report AudienceReport) error {
+	points, err := i.audiencePoints(report)
+
+	if err != nil {
+		return err
+	}
+
+	return i.write(points)
+}
+
+func (i Influx2Client) WriteMetrics(snapshot MetricsSnapshot) error {
+	points, err := i.metricsPoints(snapshot)
+
+	if err != nil {
+		return err
+	}
+
+	return i.write(points)
+}
+
+func (i Influx2Client) write(points []*client.Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+
+	body, err := i.encode(points)
+
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, i.writeUrl, body)
+
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Authorization", "Token "+i.token)
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	if i.gzip {
+		request.Header.Set("Content-Encoding", "gzip")
+	}
+
+	response, err := i.http.Do(request)
+
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(response.Body)
+		return errors.New(fmt.Sprintf("%s: %s %s", constants.INFLUX_WRITE_FAILED, response.Status, message))
+	}
+
+	return nil
+}
+
+// формируем тело запроса в формате line protocol, по точке на строку
+func (i Influx2Client) encode(points []*client.Point) (*bytes.Buffer, error) {
+	precision := influx2Precisions[i.precision]
+	body := &bytes.Buffer{}
+
+	var w io.Writer = body
+	var zw *gzip.Writer
+
+	if i.gzip {
+		zw = gzip.NewWriter(body)
+		w = zw
+	}
+
+	for _, pt := range points {
+		if _, err := io.WriteString(w, pt.PrecisionString(precision)+"\n"); err != nil {
+			return nil, err
+		}
+	}
+
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	return body, nil
+}
+
+func (i Influx2Client) Close() {
+	i.http.CloseIdleConnections()
+}
+
+func (i Influx2Client) CloseMessage() string {
+	return "Close Influx v2 connection"
+}
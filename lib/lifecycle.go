@@ -0,0 +1,272 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/LimeHD/limehd-syslog-server/constants"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const COMPONENT_RUNNING = "running"
+const COMPONENT_STOPPED = "stopped"
+const COMPONENT_FAILED = "failed"
+
+type (
+	// Запускает и останавливает компоненты сервиса: планировщики, прием логов, HTTP сервер
+	// каждый компонент работает, пока не отменен его контекст, останавливаются компоненты в обратном порядке,
+	// поэтому прием логов, добавленный последним, останавливается первым, а HTTP сервер - последним
+	Lifecycle struct {
+		mt         sync.RWMutex
+		components []*lifecycleComponent
+		// ошибка первого упавшего критичного компонента, без которого сервис не работает
+		failed  chan error
+		_logger Logger
+	}
+
+	LifecycleConfig struct {
+		Logger Logger
+	}
+
+	// работает до отмены ctx, ошибка до отмены означает, что компонент упал
+	ComponentRunner func(ctx context.Context) error
+
+	ComponentHealth struct {
+		Name      string    `json:"name"`
+		State     string    `json:"state"`
+		Error     string    `json:"error,omitempty"`
+		StartedAt time.Time `json:"started_at"`
+	}
+
+	lifecycleComponent struct {
+		name      string
+		run       ComponentRunner
+		critical  bool
+		cancel    context.CancelFunc
+		done      chan struct{}
+		state     string
+		err       error
+		startedAt time.Time
+	}
+)
+
+func NewLifecycle(config LifecycleConfig) *Lifecycle {
+	return &Lifecycle{
+		failed:  make(chan error, 1),
+		_logger: config.Logger,
+	}
+}
+
+func (l *Lifecycle) Add(name string, run ComponentRunner) {
+	l.add(name, run, false)
+}
+
+// компонент, без которого сервис бесполезен (например, прием логов):
+// если он упадет сам, ошибка придет в Failed и сервис должен остановиться
+func (l *Lifecycle) AddCritical(name string, run ComponentRunner) {
+	l.add(name, run, true)
+}
+
+// ошибки упавших критичных компонентов, приходит только первая
+func (l *Lifecycle) Failed() <-chan error {
+	return l.failed
+}
+
+func (l *Lifecycle) add(name string, run ComponentRunner, critical bool) {
+	l.mt.Lock()
+	l.components = append(l.components, &lifecycleComponent{
+		name:     name,
+		run:      run,
+		critical: critical,
+		state:    COMPONENT_STOPPED,
+	})
+	l.mt.Unlock()
+}
+
+// запускает все остановленные компоненты в порядке добавления
+func (l *Lifecycle) Start() {
+	l.mt.Lock()
+	defer l.mt.Unlock()
+
+	for _, component := range l.components {
+		if component.state != COMPONENT_RUNNING {
+			l.start(component)
+		}
+	}
+}
+
+// останавливает все компоненты в обратном порядке, дожидаясь завершения каждого
+func (l *Lifecycle) Stop() {
+	l.mt.RLock()
+	components := make([]*lifecycleComponent, len(l.components))
+	copy(components, l.components)
+	l.mt.RUnlock()
+
+	for i := len(components) - 1; i >= 0; i-- {
+		l.stop(components[i])
+	}
+}
+
+func (l *Lifecycle) StartComponent(name string) error {
+	l.mt.Lock()
+	defer l.mt.Unlock()
+
+	component, err := l.find(name)
+
+	if err != nil {
+		return err
+	}
+
+	if component.state != COMPONENT_RUNNING {
+		l.start(component)
+	}
+
+	return nil
+}
+
+func (l *Lifecycle) StopComponent(name string) error {
+	l.mt.RLock()
+	component, err := l.find(name)
+	l.mt.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	l.stop(component)
+
+	return nil
+}
+
+func (l *Lifecycle) Health() []ComponentHealth {
+	l.mt.RLock()
+	defer l.mt.RUnlock()
+
+	health := make([]ComponentHealth, 0, len(l.components))
+
+	for _, component := range l.components {
+		h := ComponentHealth{
+			Name:      component.name,
+			State:     component.state,
+			StartedAt: component.startedAt,
+		}
+
+		if component.err != nil {
+			h.Error = component.err.Error()
+		}
+
+		health = append(health, h)
+	}
+
+	return health
+}
+
+// сервис здоров, если ни один компонент не упал
+func (l *Lifecycle) Healthy() bool {
+	for _, h := range l.Health() {
+		if h.State == COMPONENT_FAILED {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (l *Lifecycle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !l.Healthy() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	_ = json.NewEncoder(w).Encode(l.Health())
+}
+
+// вызывается под блокировкой
+func (l *Lifecycle) start(component *lifecycleComponent) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	component.cancel = cancel
+	component.done = make(chan struct{})
+	component.state = COMPONENT_RUNNING
+	component.err = nil
+	component.startedAt = time.Now()
+
+	go func(done chan struct{}) {
+		defer close(done)
+
+		err := component.run(ctx)
+
+		l.mt.Lock()
+		if ctx.Err() == nil {
+			// компонент завершился сам, без остановки
+			component.state = COMPONENT_FAILED
+			component.err = err
+
+			if err == nil {
+				component.err = errors.New(constants.COMPONENT_EXITED)
+			}
+
+			l._logger.ErrorLog(fmt.Errorf("%s: %w", component.name, component.err))
+
+			if component.critical {
+				select {
+				case l.failed <- fmt.Errorf("%s: %w", component.name, component.err):
+				default:
+				}
+			}
+		} else {
+			component.state = COMPONENT_STOPPED
+			component.err = err
+		}
+		l.mt.Unlock()
+	}(component.done)
+}
+
+func (l *Lifecycle) stop(component *lifecycleComponent) {
+	l.mt.RLock()
+	cancel, done := component.cancel, component.done
+	l.mt.RUnlock()
+
+	if cancel == nil {
+		return
+	}
+
+	cancel()
+	<-done
+}
+
+func (l *Lifecycle) find(name string) (*lifecycleComponent, error) {
+	for _, component := range l.components {
+		if component.name == name {
+			return component, nil
+		}
+	}
+
+	return nil, errors.New(fmt.Sprintf("%s: %s", constants.COMPONENT_NOT_FOUND, name))
+}
+
+// вызывает fn по окончании каждого интервала, пока не отменен ctx
+// интервал пересчитывается перед каждым ожиданием, чтобы окна онлайна могли продолжиться после восстановления
+func runEvery(ctx context.Context, interval func() time.Duration, fn func()) error {
+	for {
+		timer := time.NewTimer(interval())
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+			fn()
+		}
+	}
+}
+
+func every(duration time.Duration) func() time.Duration {
+	return func() time.Duration {
+		return duration
+	}
+}
@@ -0,0 +1,290 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// Внутренние метрики конвейера: счетчики принятых и отброшенных логов, длины очередей,
+	// задержки обработки и длительности отправки, чтобы настраивать pool-size и worker-count не вслепую
+	// на горячем пути метрики берутся заранее через Counter и Timing и обновляются одной атомарной операцией,
+	// Inc, Add и Since с поиском по имени - для редких событий
+	PipelineMetrics struct {
+		mt               sync.RWMutex
+		counters         map[string]*MetricCounter
+		gauges           map[string]func() int64
+		gaugeGroups      []func() map[string]int64
+		timings          map[string]*MetricTiming
+		scheduleCallback func(snapshot MetricsSnapshot)
+	}
+
+	// счетчики накапливаются с момента запуска, тайминги - с прошлой отправки
+	MetricsSnapshot struct {
+		Time     time.Time                 `json:"time"`
+		Counters map[string]int64          `json:"counters"`
+		Gauges   map[string]int64          `json:"gauges"`
+		Timings  map[string]TimingSnapshot `json:"timings"`
+	}
+
+	TimingSnapshot struct {
+		Count   int64   `json:"count"`
+		Average float64 `json:"average"`
+		Max     float64 `json:"max"`
+	}
+
+	// Ошибка обработки лога с причиной, по которой считается отдельный счетчик rejected_<причина>
+	RejectError struct {
+		Reason string
+		Err    error
+	}
+
+	MetricCounter struct {
+		value int64
+	}
+
+	// обновляется атомарно, так как задержки пишутся на каждый лог
+	// количество и сумма только растут, интервал считается разницей с прошлой отправкой,
+	// поэтому замеры, пришедшие во время отправки, не теряются, а попадают в следующий интервал
+	MetricTiming struct {
+		count int64
+		sum   int64
+		max   int64
+		// значения на момент прошлой отправки, меняются под блокировкой PipelineMetrics
+		reportedCount int64
+		reportedSum   int64
+	}
+)
+
+func NewPipelineMetrics() *PipelineMetrics {
+	return &PipelineMetrics{
+		counters: map[string]*MetricCounter{},
+		gauges:   map[string]func() int64{},
+		timings:  map[string]*MetricTiming{},
+	}
+}
+
+func Reject(reason string, err error) error {
+	return RejectError{
+		Reason: reason,
+		Err:    err,
+	}
+}
+
+func (e RejectError) Error() string {
+	return e.Err.Error()
+}
+
+func (e RejectError) Unwrap() error {
+	return e.Err
+}
+
+// причина отказа для счетчика, ошибки без причины считаются как other
+func rejectReason(err error) string {
+	var reject RejectError
+
+	if errors.As(err, &reject) {
+		return reject.Reason
+	}
+
+	return "other"
+}
+
+func (m *PipelineMetrics) SetScheduleHandler(handler func(snapshot MetricsSnapshot)) {
+	m.scheduleCallback = handler
+}
+
+func (m *PipelineMetrics) Inc(name string) {
+	m.Counter(name).Inc()
+}
+
+func (m *PipelineMetrics) Add(name string, delta int64) {
+	m.Counter(name).Add(delta)
+}
+
+// счетчик по имени, созданный при первом обращении
+func (m *PipelineMetrics) Counter(name string) *MetricCounter {
+	m.mt.RLock()
+	counter, ok := m.counters[name]
+	m.mt.RUnlock()
+
+	if ok {
+		return counter
+	}
+
+	m.mt.Lock()
+	defer m.mt.Unlock()
+
+	if counter, ok = m.counters[name]; !ok {
+		counter = &MetricCounter{}
+		m.counters[name] = counter
+	}
+
+	return counter
+}
+
+// тайминг по имени, созданный при первом обращении
+func (m *PipelineMetrics) Timing(name string) *MetricTiming {
+	m.mt.RLock()
+	timing, ok := m.timings[name]
+	m.mt.RUnlock()
+
+	if ok {
+		return timing
+	}
+
+	m.mt.Lock()
+	defer m.mt.Unlock()
+
+	if timing, ok = m.timings[name]; !ok {
+		timing = &MetricTiming{}
+		m.timings[name] = timing
+	}
+
+	return timing
+}
+
+// значение снимается в момент отправки, повторная регистрация заменяет функцию
+func (m *PipelineMetrics) Gauge(name string, value func() int64) {
+	m.mt.Lock()
+	m.gauges[name] = value
+	m.mt.Unlock()
+}
+
+// несколько значений из одного источника, например из /proc: источник читается один раз на снимок
+func (m *PipelineMetrics) Gauges(values func() map[string]int64) {
+	m.mt.Lock()
+	m.gaugeGroups = append(m.gaugeGroups, values)
+	m.mt.Unlock()
+}
+
+func (m *PipelineMetrics) Observe(name string, d time.Duration) {
+	m.Timing(name).Observe(d)
+}
+
+// засекает длительность: defer metrics.Since("flush_stream", time.Now())
+func (m *PipelineMetrics) Since(name string, start time.Time) {
+	m.Timing(name).Since(start)
+}
+
+// текущие значения, тайминги - с прошлого Collect
+func (m *PipelineMetrics) Snapshot() MetricsSnapshot {
+	m.mt.RLock()
+	defer m.mt.RUnlock()
+
+	return m.snapshot(false)
+}
+
+// значения для отправки: тайминги за интервал с прошлого Collect, следующий интервал начинается сразу
+func (m *PipelineMetrics) Collect() MetricsSnapshot {
+	m.mt.Lock()
+	defer m.mt.Unlock()
+
+	return m.snapshot(true)
+}
+
+// вызывается под блокировкой
+func (m *PipelineMetrics) snapshot(reset bool) MetricsSnapshot {
+	snapshot := MetricsSnapshot{
+		Time:     time.Now(),
+		Counters: make(map[string]int64, len(m.counters)),
+		Gauges:   make(map[string]int64, len(m.gauges)),
+		Timings:  make(map[string]TimingSnapshot, len(m.timings)),
+	}
+
+	for name, counter := range m.counters {
+		snapshot.Counters[name] = counter.Value()
+	}
+
+	for name, value := range m.gauges {
+		snapshot.Gauges[name] = value()
+	}
+
+	for _, group := range m.gaugeGroups {
+		for name, value := range group() {
+			snapshot.Gauges[name] = value
+		}
+	}
+
+	for name, timing := range m.timings {
+		// тайминги без замеров за интервал не отправляются
+		if interval := timing.snapshot(reset); interval.Count > 0 {
+			snapshot.Timings[name] = interval
+		}
+	}
+
+	return snapshot
+}
+
+func (m *PipelineMetrics) Scheduler(ctx context.Context, duration int64) error {
+	return runEvery(ctx, every(time.Second*time.Duration(duration)), func() {
+		m.scheduleCallback(m.Collect())
+	})
+}
+
+func (m *PipelineMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(m.Snapshot())
+}
+
+func (c *MetricCounter) Inc() {
+	atomic.AddInt64(&c.value, 1)
+}
+
+func (c *MetricCounter) Add(delta int64) {
+	atomic.AddInt64(&c.value, delta)
+}
+
+func (c *MetricCounter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+func (t *MetricTiming) Observe(d time.Duration) {
+	atomic.AddInt64(&t.count, 1)
+	atomic.AddInt64(&t.sum, int64(d))
+
+	for {
+		max := atomic.LoadInt64(&t.max)
+
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&t.max, max, int64(d)) {
+			return
+		}
+	}
+}
+
+func (t *MetricTiming) Since(start time.Time) {
+	t.Observe(time.Since(start))
+}
+
+// значения за интервал с прошлой отправки, reset начинает новый интервал
+func (t *MetricTiming) snapshot(reset bool) TimingSnapshot {
+	count := atomic.LoadInt64(&t.count)
+	sum := atomic.LoadInt64(&t.sum)
+	max := atomic.LoadInt64(&t.max)
+
+	if reset {
+		// замер, пришедший после чтения, попадет в максимум следующего интервала
+		max = atomic.SwapInt64(&t.max, 0)
+	}
+
+	snapshot := TimingSnapshot{
+		Count: count - t.reportedCount,
+		Max:   time.Duration(max).Seconds(),
+	}
+
+	if snapshot.Count > 0 {
+		snapshot.Average = time.Duration(sum-t.reportedSum).Seconds() / float64(snapshot.Count)
+	}
+
+	if reset {
+		t.reportedCount = count
+		t.reportedSum = sum
+	}
+
+	return snapshot
+}
@@ -15,8 +15,11 @@ type Opener interface {
 	Close()
 }
 
-func Notifier(openers ...Opener) {
-	sig := make(chan os.Signal)
+// Ждет сигнал остановки и вызывает stop (закрытие слушателей),
+// дальше сервис сам дорабатывает накопленное и закрывает ресурсы через Shutdown
+// повторный сигнал завершает процесс сразу, не дожидаясь отправки
+func Notifier(stop func()) {
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
@@ -24,16 +27,25 @@ func Notifier(openers ...Opener) {
 
 		fmt.Println("Stop Syslog server by signal")
 
-		for _, opener := range openers {
-			switch opener.(type) {
-			case Closer:
-				o := opener.(Closer)
-				fmt.Println(o.CloseMessage())
-			}
+		stop()
 
-			opener.Close()
-		}
+		<-sig
 
-		os.Exit(0)
+		fmt.Println("Force stop Syslog server by second signal")
+
+		os.Exit(1)
 	}()
 }
+
+// Закрывает ресурсы в переданном порядке
+func Shutdown(openers ...Opener) {
+	for _, opener := range openers {
+		switch opener.(type) {
+		case Closer:
+			o := opener.(Closer)
+			fmt.Println(o.CloseMessage())
+		}
+
+		opener.Close()
+	}
+}
@@ -2,33 +2,72 @@ package lib
 
 import (
 	"bytes"
-	"crypto/md5"
-	"encoding/hex"
+	"context"
+	"encoding/gob"
 	"fmt"
+	"github.com/LimeHD/limehd-syslog-server/constants"
+	"io"
 	"sort"
 	"sync"
 	"time"
 )
 
 type (
+	// Счетчик уникальных пользователей онлайн по каналам
+	// реализации: точный (Online) и приближенный на HyperLogLog (HyperLogLogOnline)
+	OnlineCounter interface {
+		// учитывает пользователя
+		Peek(i UniqueIdentity)
+		// срез по каналам за текущее окно
+		Connections() map[string]ChannelCounter
+		// сбрасывает накопленные данные, начинается новое окно
+		Flush()
+		// количество каналов
+		Count() int
+		// общая сумма по всем каналам
+		Total() int
+		// ТОП первых N каналов
+		Top(n int) SortedList
+		SetScheduleHandler(handler func(o OnlineCounter))
+		Scheduler(ctx context.Context, duration int64) error
+	}
+
+	// количество уникальных пользователей канала
+	ChannelCounter interface {
+		Count() int
+	}
+
+	// пользователи распределены по шардам по хэшу, у каждого шарда своя блокировка,
+	// поэтому обработчики не ждут друг друга даже на одном популярном канале,
+	// множества шардов не пересекаются и при отправке просто складываются
 	Online struct {
 		mt               *sync.RWMutex
-		connections      map[string]ChannelConnections
+		shards           []*onlineShard
 		lastFlushedAt    int64
-		scheduleCallback func(*Online)
+		scheduleCallback func(OnlineCounter)
 	}
 	ChannelConnections struct {
-		connections map[string]bool
+		connections map[uint64]struct{}
+	}
+	onlineShard struct {
+		mt          sync.Mutex
+		connections map[string]ChannelConnections
 	}
 	UniqueCombination struct {
 		Ip        string
 		UserAgent string
 	}
 	// уникальные пользователи на конкретный канал
-	// определяются из хеша комбинаций ip и user-agent
+	// определяются 64 битным хешем комбинации ip и user-agent или настроенного ключа (см. IdentityBuilder)
 	UniqueIdentity struct {
 		Channel string
 		UniqueCombination
+		// ключ, построенный IdentityBuilder, если задан - используется вместо ip и user-agent
+		Key string
+		// стратегия IdentityBuilder, по которой построен ключ
+		Strategy string
+		// хэш считается один раз в IdentityBuilder.Build, 0 - еще не посчитан
+		hash uint64
 	}
 )
 
@@ -36,89 +75,116 @@ func NewOnline() Online {
 	o := Online{}
 	o.mt = &sync.RWMutex{}
 	o.setFlushedAt()
-	o.connections = map[string]ChannelConnections{}
+	o.shards = make([]*onlineShard, constants.AGGREGATION_SHARDS)
+
+	for index := range o.shards {
+		o.shards[index] = &onlineShard{
+			connections: map[string]ChannelConnections{},
+		}
+	}
 
 	return o
 }
 
-func (o *Online) SetScheduleHandler(handler func(o *Online)) {
+// точный подсчет в виде OnlineCounter
+func NewOnlineExact() OnlineCounter {
+	o := NewOnline()
+	return &o
+}
+
+func (o *Online) SetScheduleHandler(handler func(o OnlineCounter)) {
 	o.scheduleCallback = handler
 }
 
 func (o *Online) Add(i UniqueIdentity) {
-	o.mt.Lock()
-	// смотрим существует ли канал в мапе, т.к. мы не знаем о канал ничего
-	if _, ok := o.connections[i.Channel]; !ok {
-		o.connections[i.Channel] = ChannelConnections{
-			connections: map[string]bool{},
-		}
-	}
-	o.connections[i.Channel].connections[i.hash()] = true
-	o.mt.Unlock()
+	hash := i.Hash()
+	o.shard(hash).add(i.Channel, hash)
 }
 
 // сбрасываем аккумулированные данные
 func (o *Online) Flush() {
+	for _, shard := range o.shards {
+		shard.mt.Lock()
+		shard.connections = make(map[string]ChannelConnections)
+		shard.mt.Unlock()
+	}
+
 	o.mt.Lock()
-	o.connections = make(map[string]ChannelConnections)
 	o.setFlushedAt()
 	o.mt.Unlock()
 }
 
-func (o Online) Connections() map[string]ChannelConnections {
-	o.mt.RLock()
-	defer o.mt.RUnlock()
-	return o.connections
+// количество пользователей каналов, сложенное по шардам
+func (o Online) Connections() map[string]ChannelCounter {
+	counts := map[string]int{}
+
+	for _, shard := range o.shards {
+		shard.mt.Lock()
+		for name, channel := range shard.connections {
+			counts[name] += channel.Count()
+		}
+		shard.mt.Unlock()
+	}
+
+	connections := make(map[string]ChannelCounter, len(counts))
+	for name, count := range counts {
+		connections[name] = channelEstimate(count)
+	}
+
+	return connections
 }
 
 func (o Online) Count() int {
-	o.mt.RLock()
-	defer o.mt.RUnlock()
 	return len(o.Connections())
 }
 
 // Общая сумма по всем каналам
 func (o Online) Total() int {
-	o.mt.RLock()
 	total := 0
-	for _, channel := range o.connections {
+	for _, channel := range o.Connections() {
 		total += channel.Count()
 	}
-	o.mt.RUnlock()
 	return total
 }
 
 // Возвращает ТОП первых N каналов
 func (o Online) Top(n int) SortedList {
-	s := o.sorted()
+	return topConnections(o.Connections(), n)
+}
+
+// реализуем интерфейс для печати онлайн
+// fmt.Println(online)
+func (o Online) String() string {
+	return onlineString(o.Top(10))
+}
+
+// ТОП первых N каналов по количеству пользователей, общий для всех реализаций OnlineCounter
+func topConnections(connections map[string]ChannelCounter, n int) SortedList {
+	s := sortedConnections(connections)
 	if len(s) < n {
 		return s
 	}
 	return s[0:n]
 }
 
-// реализуем интерфейс для печати онлайн
-// fmt.Println(online)
-func (o Online) String() string {
+func onlineString(top SortedList) string {
 	var out bytes.Buffer
 	// first new line
 	out.WriteString("\n")
-	for _, v := range o.Top(10) {
+	for _, v := range top {
 		out.WriteString(fmt.Sprintf("Channel %s -> %d\n", v.key, v.value))
 	}
 	return out.String()
 }
 
 // сортируем мапу из каналов и количества соединений
-func (o Online) sorted() SortedList {
-	o.mt.RLock()
-	s := make(SortedList, len(o.connections))
+func sortedConnections(connections map[string]ChannelCounter) SortedList {
+	s := make(SortedList, len(connections))
 	index := 0
-	for k, v := range o.connections {
+	for k, v := range connections {
 		s[index] = sorted{k, v.Count()}
 		index++
 	}
-	o.mt.RUnlock()
 	sort.Sort(sort.Reverse(s))
 	return s
 }
@@ -138,47 +204,153 @@ func (s SortedList) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 // существует ли данный пользователь для данного канала
 func (o Online) Contains(i UniqueIdentity) bool {
 	exist := false
+	hash := i.Hash()
+	shard := o.shard(hash)
 
-	o.mt.RLock()
+	shard.mt.Lock()
 	// если канал не существует, то и пользователя не существует
-	if c, channelExist := o.connections[i.Channel]; channelExist {
-		_, exist = c.connections[i.hash()]
+	if c, channelExist := shard.connections[i.Channel]; channelExist {
+		_, exist = c.connections[hash]
 	}
-	o.mt.RUnlock()
+	shard.mt.Unlock()
 
 	return exist
 }
 
-// внутренний планировщик для отправки данны в influx
-// можно было бы и циклом
-func (o *Online) Scheduler(duration int64) {
-schedule:
-	time.Sleep(time.Second * time.Duration(duration))
-
-	o.scheduleCallback(o)
-
-	goto schedule
+// внутренний планировщик для отправки данны в influx, работает до отмены ctx
+// окно отсчитывается от последнего сброса, чтобы после восстановления из снимка оно продолжилось
+func (o *Online) Scheduler(ctx context.Context, duration int64) error {
+	return runEvery(ctx, func() time.Duration {
+		return untilFlush(o.flushedAt(), duration)
+	}, func() {
+		o.scheduleCallback(o)
+	})
 }
 
 // смотрит пользователя, если нет - добавляет нового уникального
+// проверка и добавление под одной блокировкой шарда
 func (o Online) Peek(i UniqueIdentity) {
-	if !o.Contains(i) {
-		o.Add(i)
+	o.Add(i)
+}
+
+type onlineSnapshot struct {
+	LastFlushedAt int64
+	Connections   map[string][]uint64
+}
+
+// формат снимка не зависит от количества шардов
+func (o *Online) Snapshot(w io.Writer) error {
+	snapshot := onlineSnapshot{
+		LastFlushedAt: o.flushedAt(),
+		Connections:   map[string][]uint64{},
+	}
+
+	for _, shard := range o.shards {
+		shard.mt.Lock()
+		for name, channel := range shard.connections {
+			for hash := range channel.connections {
+				snapshot.Connections[name] = append(snapshot.Connections[name], hash)
+			}
+		}
+		shard.mt.Unlock()
+	}
+
+	return gob.NewEncoder(w).Encode(snapshot)
+}
+
+func (o *Online) Restore(r io.Reader) (func(), error) {
+	snapshot := onlineSnapshot{}
+
+	if err := gob.NewDecoder(r).Decode(&snapshot); err != nil {
+		return nil, err
 	}
+
+	return func() {
+		o.Flush()
+
+		for name, hashes := range snapshot.Connections {
+			for _, hash := range hashes {
+				o.shard(hash).add(name, hash)
+			}
+		}
+
+		o.mt.Lock()
+		o.lastFlushedAt = snapshot.LastFlushedAt
+		o.mt.Unlock()
+	}, nil
 }
 
 // private
+// шард пользователя по его хэшу, хэш из снимка попадает в тот же шард
+func (o Online) shard(hash uint64) *onlineShard {
+	return o.shards[hash%uint64(len(o.shards))]
+}
+
+func (s *onlineShard) add(channel string, hash uint64) {
+	s.mt.Lock()
+	// смотрим существует ли канал в мапе, т.к. мы не знаем о канал ничего
+	if _, ok := s.connections[channel]; !ok {
+		s.connections[channel] = ChannelConnections{
+			connections: map[uint64]struct{}{},
+		}
+	}
+	s.connections[channel].connections[hash] = struct{}{}
+	s.mt.Unlock()
+}
+
 // метка последнего сброса данных
 func (o *Online) setFlushedAt() {
 	o.lastFlushedAt = time.Now().Unix()
 }
 
-// определяет хеш для определения уникальности поступившего запроса
-func (u UniqueIdentity) hash() string {
-	ipAgent := u.Ip + u.UserAgent
+func (o *Online) flushedAt() int64 {
+	o.mt.RLock()
+	defer o.mt.RUnlock()
+	return o.lastFlushedAt
+}
+
+// 64 битный ключ пользователя вместо md5 в hex строке: не аллоцирует, занимает 8 байт в мапах,
+// вероятность совпадения двух из миллиона пользователей порядка 1e-8, криптостойкость здесь не нужна
+// хэш, посчитанный в IdentityBuilder.Build, не пересчитывается в каждом счетчике
+func (u UniqueIdentity) Hash() uint64 {
+	if u.hash != 0 {
+		return u.hash
+	}
+
+	return u.computeHash()
+}
+
+// FNV-1a 64 по ключу или по ip и user-agent, затем mix64:
+// старшие биты используются HyperLogLog, младшие - шардами, поэтому результат перемешивается целиком
+func (u UniqueIdentity) computeHash() uint64 {
+	if len(u.Key) > 0 {
+		return mix64(fnv1a(constants.FNV_OFFSET_64, u.Key))
+	}
+
+	// разделитель между полями, чтобы "1.2.3.4"+"5x" и "1.2.3.45"+"x" не совпадали,
+	// байт 0xff не встречается в UTF-8
+	h := fnv1a(constants.FNV_OFFSET_64, u.Ip)
+	h = (h ^ 0xff) * constants.FNV_PRIME_64
+	h = fnv1a(h, u.UserAgent)
+
+	return mix64(h)
+}
+
+// FNV-1a 64 как в hash/fnv, но по строке без приведения к []byte
+func fnv1a(h uint64, s string) uint64 {
+	for index := 0; index < len(s); index++ {
+		h ^= uint64(s[index])
+		h *= constants.FNV_PRIME_64
+	}
+
+	return h
+}
 
-	hasher := md5.Sum([]byte(ipAgent))
-	return hex.EncodeToString(hasher[:])
+// финализатор splitmix64: каждый бит входа влияет на все биты результата
+func mix64(x uint64) uint64 {
+	x = (x ^ (x >> 30)) * 0xBF58476D1CE4E5B9
+	x = (x ^ (x >> 27)) * 0x94D049BB133111EB
+	return x ^ (x >> 31)
 }
 
 // количество активных соединений
@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"github.com/LimeHD/limehd-syslog-server/constants"
 	"gopkg.in/mcuadros/go-syslog.v2/format"
+	"math"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type (
@@ -130,30 +132,29 @@ func (s SyslogParser) Parse(parts format.LogParts) (Log, error) {
 		host:           valueOf("host"),
 		remoteAddr:     valueOf("remote_addr"),
 		uri:            valueOf("uri"),
-		serverProtocol: "",
-		requestMethod:  "",
-		args:           "",
-		requestTime:    "",
+		serverProtocol: valueOf("server_protocol"),
+		requestMethod:  valueOf("request_method"),
+		args:           valueOf("args"),
+		requestTime:    valueOf("request_time"),
 	}
 
 	// @see readme
-	streamUri := splitUri(valueOf("uri"), s.config.StreamDelim)
-	_req._splitUri = s.streamParts(streamUri)
+	_req._splitUri = parseStreamUri(valueOf("uri"), s.config.StreamDelim)
 
 	return Log{
 		_time: _time{
-			timeLocal: "",
-			msec:      "",
+			timeLocal: valueOf("time_local"),
+			msec:      valueOf("msec"),
 		},
 		_request: _req,
 		_response: _response{
-			status:        0,
-			bodyBytesSent: 0,
+			status:        strToInt(valueOf("status")),
+			bodyBytesSent: strToInt(valueOf("body_bytes_sent")),
 		},
 		_upstream: _upstream{
-			upstreamResponseTime: "",
-			upstreamAddr:         "",
-			upstreamStatus:       "",
+			upstreamResponseTime: valueOf("upstream_response_time"),
+			upstreamAddr:         valueOf("upstream_addr"),
+			upstreamStatus:       valueOf("upstream_status"),
 		},
 		_http: _http{
 			httpReferer:       getIf(valueOf("http_referer")),
@@ -184,88 +185,6 @@ func (s SyslogParser) toSlice(parts format.LogParts) _logSlice {
 	}
 }
 
-func (s SyslogParser) isStreamUri(splitUri []string) bool {
-	if len(splitUri) == constants.LEN_STREAM_PARTS {
-		return true
-	}
-
-	return false
-}
-
-func (s SyslogParser) defaultStreamUri() _splitUri {
-	return _splitUri{
-		channel: constants.UNKNOWN,
-		quality: constants.UNKNOWN,
-		index:   constants.UNKNOWN,
-		prefix:  constants.UNKNOWN,
-	}
-}
-
-func (s SyslogParser) streamParts(stream []string) _splitUri {
-	// /streaming/muztv/324/vl2w/segment-1597220444-01972046.ts
-	if isInetraTranscoder(len(stream)) {
-		return _splitUri{
-			prefix:  stream[1],
-			channel: stream[2],
-			quality: stream[4],
-			index:   stream[5],
-		}
-	}
-
-	// /streaming/karusel/324/variable.m3u8
-	if isInetraMultibitrate(len(stream)) {
-		return _splitUri{
-			prefix:  constants.UNKNOWN,
-			channel: stream[2],
-			quality: constants.UNKNOWN,
-			index:   stream[4],
-		}
-	}
-
-	// /domashniy/tracks-v1a1/2020/08/13/11/38/56-06000.ts
-	if isFlussonicTranscoder(len(stream)) {
-		quality := s.splitQuality(stream[2])
-		return _splitUri{
-			prefix:  stream[1],
-			channel: stream[1],
-			quality: quality,
-			index:   stream[8],
-		}
-	}
-
-	// /karusel/tracks-v1a1/mono.m3u8
-	if isFlussonicPlaylist(len(stream)) {
-		quality := s.splitQuality(stream[2])
-		return _splitUri{
-			prefix:  constants.UNKNOWN,
-			channel: stream[1],
-			quality: quality,
-			index:   stream[3],
-		}
-	}
-
-	// /karusel/index.m3u8
-	if isFlussonicMultibitrate(len(stream)) {
-		return _splitUri{
-			prefix:  constants.UNKNOWN,
-			channel: stream[1],
-			quality: constants.UNKNOWN,
-			index:   stream[2],
-		}
-	}
-
-	return s.defaultStreamUri()
-}
-
-// tracks-v1a1
-func (s SyslogParser) splitQuality(quality string) string {
-	q := strings.Split(quality, "-")
-	if len(q) == 2 {
-		return q[1]
-	}
-	return constants.UNKNOWN
-}
-
 // export getters
 
 func (l Log) GetConnections() int {
@@ -316,6 +235,55 @@ func (l Log) GetUri() string {
 	return l._request.uri
 }
 
+func (l Log) GetArgs() string {
+	return getIf(l._request.args)
+}
+
+func (l Log) GetRequestMethod() string {
+	return l.requestMethod
+}
+
+func (l Log) GetStatus() int {
+	return l.status
+}
+
+func (l Log) GetBodyBytesSent() int {
+	return l.bodyBytesSent
+}
+
+// время обработки запроса nginx в секундах
+func (l Log) GetRequestTime() float64 {
+	return strToFloat(l.requestTime)
+}
+
+func (l Log) GetReferer() string {
+	return l.httpReferer
+}
+
+func (l Log) GetProfile() string {
+	return l.sentHttpXProfile
+}
+
+func (l Log) GetForwardedFor() string {
+	return l.httpXForwardedFor
+}
+
+func (l Log) GetConnectionRequests() int {
+	return l.connectionRequests
+}
+
+// время запроса из $msec, если его нет в логе - время получения
+func (l Log) GetTime() time.Time {
+	msec := strToFloat(l.msec)
+
+	if msec == 0 {
+		return time.Now()
+	}
+
+	sec, frac := math.Modf(msec)
+	return time.Unix(int64(sec), int64(math.Round(frac*1e3))*int64(time.Millisecond))
+}
+
 // _logSlice methods
 
 func (sl _logSlice) getContent() string {
@@ -338,12 +306,20 @@ func (sp _splitUri) Quality() string {
 
 // safe methods
 
+// значения LogParts приходят из парсера syslog, строкой может оказаться не все
 func ifaceToStr(value interface{}) string {
-	if value == nil {
+	switch v := value.(type) {
+	case nil:
 		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case fmt.Stringer:
+		return v.String()
 	}
 
-	return value.(string)
+	return fmt.Sprint(value)
 }
 
 func strToInt(value string) int {
@@ -356,8 +332,27 @@ func strToInt(value string) int {
 	return converted
 }
 
-func splitUri(uri string, delim string) []string {
-	return strings.Split(uri, delim)
+func strToFloat(value string) float64 {
+	converted, err := strconv.ParseFloat(value, 64)
+
+	if err != nil {
+		return 0
+	}
+
+	return converted
+}
+
+// разбирает список значений из аргумента, например: channel,quality,country
+func splitList(raw string) []string {
+	var list []string
+
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+
+	return list
 }
 
 func getIf(value string) string {
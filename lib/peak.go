@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// Пиковые значения онлайна внутри окна: окно делится на короткие интервалы,
+	// в каждом интервале свой счетчик зрителей, которые были видны за этот интервал,
+	// для каждого канала и платформы в целом запоминается максимум и время, когда он был достигнут
+	// счетчик окна онлайна для этого не подходит: за окно он только растет
+	OnlinePeaks struct {
+		mt             *sync.Mutex
+		counterFactory func() OnlineCounter
+		// счетчик текущего интервала, заменяется целиком, поэтому Peek обходится без блокировки
+		interval atomic.Value
+		channels map[string]OnlinePeak
+		total    OnlinePeak
+	}
+
+	OnlinePeaksConfig struct {
+		// счетчик зрителей интервала, по умолчанию точный
+		CounterFactory func() OnlineCounter
+	}
+
+	OnlinePeak struct {
+		Value int
+		At    time.Time
+	}
+
+	onlineInterval struct {
+		counter OnlineCounter
+	}
+)
+
+func NewOnlinePeaks(config OnlinePeaksConfig) *OnlinePeaks {
+	p := &OnlinePeaks{
+		mt:             &sync.Mutex{},
+		counterFactory: config.CounterFactory,
+		channels:       map[string]OnlinePeak{},
+	}
+
+	if p.counterFactory == nil {
+		p.counterFactory = func() OnlineCounter {
+			return NewOnlineExact()
+		}
+	}
+
+	p.interval.Store(onlineInterval{counter: p.counterFactory()})
+
+	return p
+}
+
+// учитывает зрителя в текущем интервале
+func (p *OnlinePeaks) Peek(i UniqueIdentity) {
+	p.interval.Load().(onlineInterval).counter.Peek(i)
+}
+
+// закрывает текущий интервал и сравнивает его онлайн с пиком окна
+// зритель, учтенный в момент замены счетчика, может не попасть в закрытый интервал,
+// но запросы сегментов повторяются каждые несколько секунд, поэтому он попадет в следующий
+func (p *OnlinePeaks) Sample(at time.Time) {
+	p.mt.Lock()
+	defer p.mt.Unlock()
+
+	closed := p.interval.Load().(onlineInterval)
+	p.interval.Store(onlineInterval{counter: p.counterFactory()})
+
+	total := 0
+
+	for name, channel := range closed.counter.Connections() {
+		count := channel.Count()
+		total += count
+
+		if peak, ok := p.channels[name]; !ok || count > peak.Value {
+			p.channels[name] = OnlinePeak{Value: count, At: at}
+		}
+	}
+
+	if total > p.total.Value || p.total.At.IsZero() {
+		p.total = OnlinePeak{Value: total, At: at}
+	}
+}
+
+func (p *OnlinePeaks) Channels() map[string]OnlinePeak {
+	p.mt.Lock()
+	defer p.mt.Unlock()
+	return p.channels
+}
+
+func (p *OnlinePeaks) Total() OnlinePeak {
+	p.mt.Lock()
+	defer p.mt.Unlock()
+	return p.total
+}
+
+// начинаем новое окно
+func (p *OnlinePeaks) Flush() {
+	p.mt.Lock()
+	p.channels = map[string]OnlinePeak{}
+	p.total = OnlinePeak{}
+	p.mt.Unlock()
+}
+
+// закрывает интервал каждые duration секунд
+func (p *OnlinePeaks) Sampler(ctx context.Context, duration int64) error {
+	return runEvery(ctx, every(time.Second*time.Duration(duration)), func() {
+		p.Sample(time.Now())
+	})
+}
@@ -1,8 +1,17 @@
 package lib
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/LimeHD/limehd-syslog-server/constants"
 	"gopkg.in/mcuadros/go-syslog.v2"
 	"gopkg.in/mcuadros/go-syslog.v2/format"
+	"math"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type (
@@ -10,7 +19,7 @@ type (
 		// Пул для данных, готовых к отправлению
 		pool chan Receiver
 		// Пул асихронных задач для формирования пула готовых данных
-		taskPool chan func() (Receiver, error)
+		taskPool chan poolTask
 		// Пул ошибок при формировании или отправке данных, обрабатываются в отдельных потоках
 		errorPool chan error
 		// Обработчик готовых данных
@@ -27,6 +36,28 @@ type (
 		errorHandlers int
 		// Обработчик, принимающий данные из вне (по UDP)
 		workerFn func(pool *Pool, channel syslog.LogPartsChannel)
+		// потоки каждой стадии, чтобы при остановке дождаться их завершения
+		inputWg *sync.WaitGroup
+		taskWg  *sync.WaitGroup
+		sendWg  *sync.WaitGroup
+		errorWg *sync.WaitGroup
+		// количество обработанных данных, для отчета при остановке
+		processed *int64
+		// отменяется, если при остановке не успели обработать все за timeout:
+		// оставшиеся данные только считаются потерянными, чтобы ничего не попало в уже отправленное состояние
+		ctx     context.Context
+		cancel  context.CancelFunc
+		lost    *int64
+		metrics *PipelineMetrics
+		// метрики, которые пишутся на каждый лог, берутся один раз при создании пула
+		hot poolMetrics
+		// что делать с новым логом, когда очередь задач заполнена
+		overflow string
+		// доля зрителей, которые остаются при выборке, от 0 до 1
+		sampleRate     float64
+		sampler        *ViewerSampler
+		sampleIdentity func(p format.LogParts) UniqueIdentity
+		quarantine     *Quarantine
 	}
 	PoolConfig struct {
 		ListenerCallback    func(q Receiver) error
@@ -39,17 +70,92 @@ type (
 		SenderCount         int
 		ErrorHandlerCount   int
 		WorkerFn            func(pool *Pool, channel syslog.LogPartsChannel)
+		// счетчики, длины очередей и задержки, если не указаны - считаются, но никуда не отдаются
+		Metrics *PipelineMetrics
+		// политика переполнения очереди задач, по умолчанию block
+		OverflowPolicy string
+		// доля зрителей, логи которых принимаются при политике sample, пока очередь почти заполнена
+		SampleRate float64
+		// выборка зрителей агрегации: пул отбирает тех же зрителей, а отброшенное пересчитывается по доле
+		Sampler *ViewerSampler
+		// зритель по сырому логу, тот же, что при агрегации, чтобы при выборке у оставшихся зрителей сохранялись все запросы
+		SampleIdentity func(p format.LogParts) UniqueIdentity
+		// файл для сообщений, на которых обработчик упал с паникой, если не указан - паники только считаются
+		Quarantine *Quarantine
+	}
+	// Паника в обработчике пула, восстановленная вместо падения потока или всего процесса
+	PanicError struct {
+		// стадия пула: parse, aggregate или error
+		Stage   string
+		Value   interface{}
+		Message interface{}
+		Stack   []byte
+	}
+	// сырой лог, время постановки в очередь и доля выборки, с которой он принят
+	poolTask struct {
+		parts      format.LogParts
+		queued     time.Time
+		sampleRate float64
+	}
+	// Итог остановки пула: сколько запросов обработано после сигнала и сколько не успели обработать
+	DrainReport struct {
+		Flushed int64
+		Lost    int64
 	}
 	Receiver struct {
 		Parser Log
 		Finder *GeoFinderResult
+		Device DeviceInfo
+		// правило фильтра, под которое попал запрос, пустая строка - запрос от зрителя
+		Filtered string
+		// доля выборки, с которой лог принят при перегрузке пула, 0 - принят без выборки
+		// после выборки зрителей при агрегации - итоговая доля, с которой зритель учтен в сессиях и событиях
+		SampleRate float64
+	}
+	poolMetrics struct {
+		received        *MetricCounter
+		parsed          *MetricCounter
+		processed       *MetricCounter
+		droppedSampled  *MetricCounter
+		droppedNewest   *MetricCounter
+		droppedOldest   *MetricCounter
+		droppedShutdown *MetricCounter
+		queueWait       *MetricTiming
+		parse           *MetricTiming
+		aggregate       *MetricTiming
 	}
 )
 
+// Размеры очередей, которые помещаются в memoryLimit байт:
+// половина памяти на задачи, 40% на разобранные логи и 10% на ошибки
+func PoolQueueSizes(memoryLimit int64) (tasks int, receivers int, errs int) {
+	tasks = int(memoryLimit / 2 / constants.POOL_TASK_SIZE)
+	receivers = int(memoryLimit * 4 / 10 / constants.POOL_RECEIVER_SIZE)
+	errs = int(memoryLimit / 10 / constants.POOL_ERROR_SIZE)
+
+	return tasks, receivers, errs
+}
+
+// доля проверяется только для sample, остальные политики ее не используют
+func ValidateOverflowPolicy(policy string, sampleRate float64) error {
+	switch policy {
+	case constants.POOL_OVERFLOW_BLOCK, constants.POOL_OVERFLOW_DROP_NEWEST, constants.POOL_OVERFLOW_DROP_OLDEST:
+		return nil
+	case constants.POOL_OVERFLOW_SAMPLE:
+		if sampleRate <= 0 || sampleRate > 1 || math.IsNaN(sampleRate) {
+			return errors.New(fmt.Sprintf("%s: %v", constants.POOL_INVALID_SAMPLE_RATE, sampleRate))
+		}
+
+		return nil
+	}
+
+	return errors.New(fmt.Sprintf("%s: %s", constants.POOL_UNKNOWN_OVERFLOW, policy))
+}
+
 func NewPool(c PoolConfig) *Pool {
 	p := new(Pool)
 	p.pool = make(chan Receiver, c.WorkerPoolSize)
-	p.taskPool = make(chan func() (Receiver, error), c.PoolSize)
+	p.taskPool = make(chan poolTask, c.PoolSize)
 	p.errorPool = make(chan error, c.ErrorPoolSize)
 	p.listener = c.ListenerCallback
 	p.receiver = c.ReceiverCallback
@@ -58,6 +164,58 @@ func NewPool(c PoolConfig) *Pool {
 	p.workers = c.WorkersCount
 	p.senders = c.SenderCount
 	p.workerFn = c.WorkerFn
+	p.inputWg = &sync.WaitGroup{}
+	p.taskWg = &sync.WaitGroup{}
+	p.sendWg = &sync.WaitGroup{}
+	p.errorWg = &sync.WaitGroup{}
+	p.processed = new(int64)
+	p.lost = new(int64)
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.metrics = c.Metrics
+	p.overflow = c.OverflowPolicy
+	p.sampleRate = c.SampleRate
+	p.sampler = c.Sampler
+	p.sampleIdentity = c.SampleIdentity
+	p.quarantine = c.Quarantine
+
+	if len(p.overflow) == 0 {
+		p.overflow = constants.POOL_OVERFLOW_BLOCK
+	}
+
+	if p.sampler == nil {
+		p.sampler, _ = NewViewerSampler(ViewerSamplerConfig{Rate: 1})
+	}
+
+	if p.sampleIdentity == nil {
+		p.sampleIdentity = func(parts format.LogParts) UniqueIdentity {
+			return UniqueIdentity{Key: ifaceToStr(parts["client"])}
+		}
+	}
+
+	if p.senders <= 0 {
+		p.senders = p.workers
+	}
+
+	if p.metrics == nil {
+		p.metrics = NewPipelineMetrics()
+	}
+
+	p.hot = poolMetrics{
+		received:        p.metrics.Counter("received"),
+		parsed:          p.metrics.Counter("parsed"),
+		processed:       p.metrics.Counter("processed"),
+		droppedSampled:  p.metrics.Counter("dropped_sampled"),
+		droppedNewest:   p.metrics.Counter("dropped_newest"),
+		droppedOldest:   p.metrics.Counter("dropped_oldest"),
+		droppedShutdown: p.metrics.Counter("dropped_shutdown"),
+		queueWait:       p.metrics.Timing("queue_wait"),
+		parse:           p.metrics.Timing("parse"),
+		aggregate:       p.metrics.Timing("aggregate"),
+	}
+
+	p.metrics.Gauge("queue_tasks", func() int64 { return int64(len(p.taskPool)) })
+	p.metrics.Gauge("queue_pool", func() int64 { return int64(len(p.pool)) })
+	p.metrics.Gauge("queue_errors", func() int64 { return int64(len(p.errorPool)) })
 
 	p.listen()
 
@@ -75,26 +233,124 @@ func (p *Pool) SetListenerCallback(c func(q Receiver) error) {
 // Запускает в несколько потоков обработку входящих данных
 func (p Pool) Run(channel syslog.LogPartsChannel, parallel int) {
 	for i := 0; i < parallel; i++ {
-		go p.workerFn(&p, channel)
+		p.inputWg.Add(1)
+
+		go func() {
+			defer p.inputWg.Done()
+			p.workerFn(&p, channel)
+		}()
+	}
+}
+
+// Дожидается обработки уже принятых данных, входной канал к этому моменту должен быть закрыт
+// все, что не успело обработаться за timeout, считается потерянным: обработчики дорабатывают текущее сообщение,
+// остальное только вычитывают из очередей, после возврата пул больше ничего не передает дальше
+func (p Pool) Drain(timeout time.Duration) DrainReport {
+	before := atomic.LoadInt64(p.processed)
+	done := make(chan struct{})
+
+	go func() {
+		// каждая стадия закрывает вход следующей, когда закончит
+		p.inputWg.Wait()
+		close(p.taskPool)
+		p.taskWg.Wait()
+		close(p.pool)
+		p.sendWg.Wait()
+		close(p.errorPool)
+		p.errorWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		p.cancel()
+		<-done
+	}
+
+	return DrainReport{
+		Flushed: atomic.LoadInt64(p.processed) - before,
+		Lost:    atomic.LoadInt64(p.lost),
 	}
 }
 
-// Создает новую асихронную задачу
+// Создает новую асихронную задачу, при заполненной очереди поступает согласно политике переполнения,
+// отброшенные логи считаются в dropped_<причина>
 func (p Pool) Task(parts format.LogParts) {
-	p.taskPool <- func() (Receiver, error) {
-		return p.receiver(parts)
+	p.hot.received.Inc()
+
+	task := poolTask{
+		parts:  parts,
+		queued: time.Now(),
+	}
+
+	switch p.overflow {
+	case constants.POOL_OVERFLOW_DROP_NEWEST:
+		p.tryTask(task)
+	case constants.POOL_OVERFLOW_DROP_OLDEST:
+		p.replaceOldest(task)
+	case constants.POOL_OVERFLOW_SAMPLE:
+		if p.overloaded() {
+			rate, sampled := p.sampler.SampleAt(p.sampleIdentity(parts), p.sampleRate)
+
+			if !sampled {
+				p.hot.droppedSampled.Inc()
+				return
+			}
+
+			task.sampleRate = rate
+		}
+
+		p.tryTask(task)
+	default:
+		p.taskPool <- task
+	}
+}
+
+func (p Pool) tryTask(task poolTask) bool {
+	select {
+	case p.taskPool <- task:
+		return true
+	default:
+		p.hot.droppedNewest.Inc()
+		return false
 	}
 }
 
+// вытесняет самую старую задачу, пока новая не поместится
+func (p Pool) replaceOldest(task poolTask) {
+	for {
+		select {
+		case p.taskPool <- task:
+			return
+		default:
+		}
+
+		select {
+		case <-p.taskPool:
+			p.hot.droppedOldest.Inc()
+		default:
+			// очередь успели разобрать обработчики
+		}
+	}
+}
+
+func (p Pool) overloaded() bool {
+	return float64(len(p.taskPool)) >= float64(cap(p.taskPool))*constants.POOL_SAMPLE_WATERMARK
+}
+
 // Слушаем все наши потоки данных, задач и ошибок
 func (p Pool) listen() {
 	for i := 0; i < p.workers; i++ {
+		p.taskWg.Add(1)
 		go p.taskManager()
 	}
-	for i := 0; i < p.workers; i++ {
+	for i := 0; i < p.senders; i++ {
+		p.sendWg.Add(1)
 		go p.sendManager()
 	}
 	for i := 0; i < p.errorHandlers; i++ {
+		p.errorWg.Add(1)
 		go p.errorManager()
 	}
 }
@@ -108,25 +364,123 @@ func (p Pool) error(err error) {
 }
 
 func (p Pool) sendManager() {
+	defer p.sendWg.Done()
+
 	for log := range p.pool {
-		if err := p.listener(log); err != nil {
-			p.error(err)
+		if p.discarded() {
+			continue
 		}
+
+		p.aggregate(log)
+		p.hot.processed.Inc()
+		atomic.AddInt64(p.processed, 1)
+	}
+}
+
+func (p Pool) aggregate(log Receiver) {
+	defer p.recoverPanic("aggregate", log)
+
+	start := time.Now()
+
+	if err := p.listener(log); err != nil {
+		p.metrics.Inc("listener_errors")
+		p.error(err)
 	}
+
+	p.hot.aggregate.Since(start)
 }
 
 func (p Pool) taskManager() {
+	defer p.taskWg.Done()
+
 	for task := range p.taskPool {
-		if receive, err := task(); err == nil {
-			p.send(receive)
-		} else {
-			p.error(err)
+		if p.discarded() {
+			continue
 		}
+
+		p.parse(task)
+	}
+}
+
+func (p Pool) parse(task poolTask) {
+	defer p.recoverPanic("parse", task.parts)
+
+	p.hot.queueWait.Since(task.queued)
+
+	start := time.Now()
+	receive, err := p.receiver(task.parts)
+	p.hot.parse.Since(start)
+
+	if err == nil {
+		p.hot.parsed.Inc()
+		receive.SampleRate = task.sampleRate
+		p.send(receive)
+	} else {
+		p.metrics.Inc("rejected_" + rejectReason(err))
+		p.error(err)
+	}
+}
+
+// после отмены при остановке сообщение не обрабатывается, а считается потерянным
+func (p Pool) discarded() bool {
+	if p.ctx.Err() == nil {
+		return false
 	}
+
+	atomic.AddInt64(p.lost, 1)
+	p.hot.droppedShutdown.Inc()
+
+	return true
 }
 
 func (p Pool) errorManager() {
+	defer p.errorWg.Done()
+
 	for err := range p.errorPool {
-		p.errorHandler(err)
+		p.handleError(err)
+	}
+}
+
+func (p Pool) handleError(err error) {
+	defer p.recoverPanic("error", err)
+
+	p.errorHandler(err)
+}
+
+// вызывается через defer в каждой стадии: поток продолжает работу со следующего сообщения,
+// сообщение и стек уходят в карантин, а сама паника - в обработчик ошибок
+func (p Pool) recoverPanic(stage string, message interface{}) {
+	value := recover()
+
+	if value == nil {
+		return
 	}
+
+	p.metrics.Inc("panics")
+
+	failure := PanicError{
+		Stage:   stage,
+		Value:   value,
+		Message: message,
+		Stack:   debug.Stack(),
+	}
+
+	if p.quarantine != nil {
+		written, err := p.quarantine.Write(failure)
+
+		if err != nil && stage != "error" {
+			p.error(err)
+		} else if err == nil && !written {
+			p.metrics.Inc("quarantine_skipped")
+		}
+	}
+
+	// обработчик ошибок сам упал, повторно отдавать ему ошибку нельзя
+	if stage != "error" {
+		p.error(failure)
+	}
+}
+
+func (e PanicError) Error() string {
+	return fmt.Sprintf("%s (%s): %v", constants.POOL_WORKER_PANIC, e.Stage, e.Value)
 }
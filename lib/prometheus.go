@@ -0,0 +1,191 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/LimeHD/limehd-syslog-server/constants"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type (
+	// Отдает последние значения онлайна и накопительные счетчики трафика в формате Prometheus
+	// набор меток для трафика настраивается, чтобы ограничить количество временных рядов
+	// счетчики в памяти обновляются сразу, без буфера приемника, чтобы не терять пачки при переполнении
+	PrometheusSink struct {
+		mt       sync.RWMutex
+		labels   []string
+		counters map[string]*prometheusCounter
+		online   map[string]int
+	}
+
+	PrometheusSinkConfig struct {
+		Labels []string
+	}
+
+	prometheusCounter struct {
+		values    []string
+		bytesSent int64
+		// оценка с учетом выборки зрителей, поэтому дробная
+		requests float64
+	}
+)
+
+// доступные метки трафика
+var prometheusTrafficLabels = map[string]func(p InfluxRequestParams) string{
+	"channel":          func(p InfluxRequestParams) string { return p.Channel },
+	"quality":          func(p InfluxRequestParams) string { return p.Quality },
+	"country":          func(p InfluxRequestParams) string { return p.CountryName },
+	"asn_number":       func(p InfluxRequestParams) string { return strconv.FormatUint(uint64(p.AsnNumber), 10) },
+	"asn_org":          func(p InfluxRequestParams) string { return p.AsnOrg },
+	"streaming_server": func(p InfluxRequestParams) string { return p.StreamServer },
+	"host":             func(p InfluxRequestParams) string { return p.Host },
+	"device_type":      func(p InfluxRequestParams) string { return p.DeviceType },
+	"os":               func(p InfluxRequestParams) string { return p.Os },
+	"app":              func(p InfluxRequestParams) string { return p.App },
+	"filtered":         func(p InfluxRequestParams) string { return p.Filtered },
+	"identity":         func(p InfluxRequestParams) string { return p.Identity },
+}
+
+func NewPrometheusSink(config PrometheusSinkConfig) (*PrometheusSink, error) {
+	for _, label := range config.Labels {
+		if _, ok := prometheusTrafficLabels[label]; !ok {
+			return nil, errors.New(fmt.Sprintf("%s: %s", constants.PROMETHEUS_UNKNOWN_LABEL, label))
+		}
+	}
+
+	return &PrometheusSink{
+		labels:   config.Labels,
+		counters: map[string]*prometheusCounter{},
+		online:   map[string]int{},
+	}, nil
+}
+
+func (p *PrometheusSink) WriteTraffic(params []InfluxRequestParams) error {
+	p.mt.Lock()
+	defer p.mt.Unlock()
+
+	for _, param := range params {
+		values := make([]string, len(p.labels))
+
+		for i, label := range p.labels {
+			values[i] = prometheusTrafficLabels[label](param)
+		}
+
+		key := strings.Join(values, constants.LOG_DELIM)
+		counter, ok := p.counters[key]
+
+		if !ok {
+			counter = &prometheusCounter{values: values}
+			p.counters[key] = counter
+		}
+
+		// трафик уже пересчитан по доле выборки, запрос из выборки представляет 1/rate запросов
+		counter.bytesSent += int64(param.BytesSent)
+		counter.requests += sampledRequests(param.SampleRate)
+	}
+
+	return nil
+}
+
+// приемник пишет только в память, FanOutSink вызывает его без буфера
+func (p *PrometheusSink) Synchronous() {}
+
+// онлайн - это gauge, поэтому храним только последний срез
+func (p *PrometheusSink) WriteOnline(params InfluxOnlineRequestParams) error {
+	online := make(map[string]int, len(params.Channels))
+
+	for name, channel := range params.Channels {
+		online[name] = channel.Count()
+	}
+
+	p.mt.Lock()
+	p.online = online
+	p.mt.Unlock()
+
+	return nil
+}
+
+func (p *PrometheusSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var out bytes.Buffer
+
+	p.mt.RLock()
+
+	out.WriteString("# HELP limehd_syslog_online_users Unique online users per channel for the last online window.\n")
+	out.WriteString("# TYPE limehd_syslog_online_users gauge\n")
+
+	channels := make([]string, 0, len(p.online))
+	for name := range p.online {
+		channels = append(channels, name)
+	}
+	sort.Strings(channels)
+
+	for _, name := range channels {
+		out.WriteString(fmt.Sprintf("limehd_syslog_online_users{channel=\"%s\"} %d\n", prometheusEscape(name), p.online[name]))
+	}
+
+	keys := make([]string, 0, len(p.counters))
+	for key := range p.counters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	out.WriteString("# HELP limehd_syslog_bytes_sent_total Bytes sent to viewers.\n")
+	out.WriteString("# TYPE limehd_syslog_bytes_sent_total counter\n")
+
+	for _, key := range keys {
+		c := p.counters[key]
+		out.WriteString(fmt.Sprintf("limehd_syslog_bytes_sent_total%s %d\n", p.labelSet(c.values), c.bytesSent))
+	}
+
+	out.WriteString("# HELP limehd_syslog_requests_total Media requests received.\n")
+	out.WriteString("# TYPE limehd_syslog_requests_total counter\n")
+
+	for _, key := range keys {
+		c := p.counters[key]
+		out.WriteString(fmt.Sprintf("limehd_syslog_requests_total%s %s\n", p.labelSet(c.values), strconv.FormatFloat(c.requests, 'f', -1, 64)))
+	}
+
+	p.mt.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write(out.Bytes())
+}
+
+func (p *PrometheusSink) Close() {}
+
+func (p *PrometheusSink) CloseMessage() string {
+	return "Close Prometheus exporter"
+}
+
+// {channel="domashniy",quality="vh1w"}
+func (p *PrometheusSink) labelSet(values []string) string {
+	if len(p.labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(p.labels))
+
+	for i, label := range p.labels {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", label, prometheusEscape(values[i]))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// сколько запросов представляет один запрос из выборки
+func sampledRequests(rate float64) float64 {
+	if rate <= 0 || rate >= 1 {
+		return 1
+	}
+
+	return 1 / rate
+}
+
+func prometheusEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+	"os"
+	"sync"
+	"time"
+)
+
+type (
+	// Файл для сообщений, на которых обработчик пула упал с паникой:
+	// каждая запись - JSON строка с исходным сообщением и стеком, чтобы воспроизвести ошибку
+	// размер файла и количество записей в минуту ограничены, чтобы поток битых логов не занял весь диск
+	Quarantine struct {
+		mt      sync.Mutex
+		handler *os.File
+		config  QuarantineConfig
+		size    int64
+		// записи текущей минуты
+		windowStart time.Time
+		windowCount int
+	}
+
+	QuarantineConfig struct {
+		Path string
+		// предельный размер файла в байтах, 0 - без ограничения
+		MaxSize int64
+		// сколько записей в минуту, 0 - без ограничения
+		Rate int
+	}
+
+	QuarantineRecord struct {
+		Time    time.Time   `json:"time"`
+		Stage   string      `json:"stage"`
+		Panic   string      `json:"panic"`
+		Message interface{} `json:"message"`
+		Stack   string      `json:"stack"`
+	}
+)
+
+func NewQuarantine(config QuarantineConfig) (*Quarantine, error) {
+	handler, err := os.OpenFile(config.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := handler.Stat()
+
+	if err != nil {
+		_ = handler.Close()
+		return nil, err
+	}
+
+	return &Quarantine{
+		handler: handler,
+		config:  config,
+		size:    stat.Size(),
+	}, nil
+}
+
+// пишет сообщение, false - запись пропущена из-за ограничений
+func (q *Quarantine) Write(failure PanicError) (bool, error) {
+	record := QuarantineRecord{
+		Time:    time.Now(),
+		Stage:   failure.Stage,
+		Panic:   fmt.Sprint(failure.Value),
+		Message: failure.Message,
+		Stack:   string(failure.Stack),
+	}
+
+	// сырой лог пишется как есть, остальное (разобранный лог, ошибка) - текстом
+	if _, raw := failure.Message.(format.LogParts); !raw {
+		record.Message = fmt.Sprintf("%+v", failure.Message)
+	}
+
+	line, err := json.Marshal(record)
+
+	if err != nil {
+		record.Message = fmt.Sprintf("%+v", failure.Message)
+
+		if line, err = json.Marshal(record); err != nil {
+			return false, err
+		}
+	}
+
+	line = append(line, '\n')
+
+	q.mt.Lock()
+	defer q.mt.Unlock()
+
+	if !q.allow(record.Time, int64(len(line))) {
+		return false, nil
+	}
+
+	written, err := q.handler.Write(line)
+	q.size += int64(written)
+
+	return err == nil, err
+}
+
+// вызывается под блокировкой
+func (q *Quarantine) allow(now time.Time, size int64) bool {
+	if q.config.MaxSize > 0 && q.size+size > q.config.MaxSize {
+		return false
+	}
+
+	if q.config.Rate <= 0 {
+		return true
+	}
+
+	if now.Sub(q.windowStart) >= time.Minute {
+		q.windowStart = now
+		q.windowCount = 0
+	}
+
+	if q.windowCount >= q.config.Rate {
+		return false
+	}
+
+	q.windowCount++
+
+	return true
+}
+
+func (q *Quarantine) Close() {
+	q.mt.Lock()
+	_ = q.handler.Close()
+	q.mt.Unlock()
+}
+
+func (q *Quarantine) CloseMessage() string {
+	return "Close quarantine file"
+}
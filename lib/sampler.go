@@ -0,0 +1,195 @@
+package lib
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/LimeHD/limehd-syslog-server/constants"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+type (
+	// Выборка зрителей на пиках трафика: зритель попадает в выборку по хэшу идентификатора,
+	// поэтому все его запросы либо учитываются, либо нет, а трафик и онлайн
+	// домножаются на 1/rate, чтобы оставаться оценкой полного значения
+	// доля меняется на лету через HTTP, 1 - учитываются все зрители
+	ViewerSampler struct {
+		// math.Float64bits доли, меняется атомарно
+		rate uint64
+		// наибольшая доля, с которой принимались запросы с прошлой оценки онлайна, 0 - запросов не было
+		// для положительных чисел порядок Float64bits совпадает с порядком значений
+		windowRate uint64
+		// без токена доля через HTTP только читается
+		token string
+	}
+
+	ViewerSamplerConfig struct {
+		Rate float64
+		// токен для изменения доли через POST /sampling, передается в Authorization: Bearer
+		Token string
+	}
+
+	samplerState struct {
+		Rate float64 `json:"rate"`
+	}
+)
+
+func NewViewerSampler(config ViewerSamplerConfig) (*ViewerSampler, error) {
+	s := &ViewerSampler{
+		token: config.Token,
+	}
+
+	if err := s.SetRate(config.Rate); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *ViewerSampler) Rate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&s.rate))
+}
+
+func (s *ViewerSampler) SetRate(rate float64) error {
+	if rate <= 0 || rate > 1 || math.IsNaN(rate) {
+		return errors.New(fmt.Sprintf("%s: %v", constants.SAMPLER_INVALID_RATE, rate))
+	}
+
+	atomic.StoreUint64(&s.rate, math.Float64bits(rate))
+
+	return nil
+}
+
+// доля, действующая в момент решения, и попал ли зритель в выборку
+func (s *ViewerSampler) Sample(i UniqueIdentity) (float64, bool) {
+	return s.SampleAt(i, 1)
+}
+
+// то же, но доля не больше limit: так пул при перегрузке выбирает зрителей из тех же корзин,
+// зритель, принятый с меньшей долей, попадает и в выборку с большей, поэтому решения пула и агрегации совпадают
+// limit 0 - без ограничения
+func (s *ViewerSampler) SampleAt(i UniqueIdentity, limit float64) (float64, bool) {
+	rate := s.Rate()
+
+	if limit > 0 && limit < rate {
+		rate = limit
+	}
+
+	s.observe(rate)
+
+	if rate >= 1 {
+		return rate, true
+	}
+
+	return rate, float64(i.Hash()%constants.SAMPLER_BUCKETS) < rate*constants.SAMPLER_BUCKETS
+}
+
+// запоминает наибольшую долю окна, запись только при росте, чтобы не трогать общую кэш-линию на каждый запрос
+func (s *ViewerSampler) observe(rate float64) {
+	bits := math.Float64bits(rate)
+
+	for {
+		current := atomic.LoadUint64(&s.windowRate)
+
+		if bits <= current || atomic.CompareAndSwapUint64(&s.windowRate, current, bits) {
+			return
+		}
+	}
+}
+
+// онлайн, посчитанный по выборке, в оценку полного: каналы, измерения, итог и пики
+// берется наибольшая доля окна: если хотя бы часть окна запросы принимались с большей долей,
+// зрители за окно успевают попасть в онлайн, и полная оценка по меньшей доле его бы завысила
+// если доля или перегрузка менялись внутри окна, оценка за это окно приблизительная
+func (s *ViewerSampler) ScaleOnline(params InfluxOnlineRequestParams) InfluxOnlineRequestParams {
+	rate := math.Float64frombits(atomic.SwapUint64(&s.windowRate, 0))
+
+	if rate <= 0 {
+		rate = s.Rate()
+	}
+
+	params.SampleRate = rate
+
+	if rate >= 1 {
+		return params
+	}
+
+	params.Channels = scaleConnections(params.Channels, rate)
+	params.Total = ScaleSampled(params.Total, rate)
+
+	dimensions := make([]OnlineDimensionConnections, 0, len(params.Dimensions))
+	for _, dimension := range params.Dimensions {
+		channels := make(map[string]map[string]ChannelCounter, len(dimension.Channels))
+
+		for name, values := range dimension.Channels {
+			channels[name] = scaleConnections(values, rate)
+		}
+
+		dimensions = append(dimensions, OnlineDimensionConnections{
+			Name:     dimension.Name,
+			Channels: channels,
+		})
+	}
+	params.Dimensions = dimensions
+
+	peaks := make(map[string]OnlinePeak, len(params.Peaks))
+	for name, peak := range params.Peaks {
+		peaks[name] = OnlinePeak{Value: ScaleSampled(peak.Value, rate), At: peak.At}
+	}
+	params.Peaks = peaks
+	params.TotalPeak.Value = ScaleSampled(params.TotalPeak.Value, rate)
+
+	return params
+}
+
+// GET - текущая доля, POST rate=0.25 с токеном - новая доля
+func (s *ViewerSampler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if len(s.token) == 0 {
+			http.Error(w, constants.SAMPLER_READ_ONLY, http.StatusForbidden)
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.token)) != 1 {
+			http.Error(w, constants.SAMPLER_UNAUTHORIZED, http.StatusUnauthorized)
+			return
+		}
+
+		rate, err := strconv.ParseFloat(r.FormValue("rate"), 64)
+
+		if err == nil {
+			err = s.SetRate(rate)
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(samplerState{Rate: s.Rate()})
+}
+
+// значение по выборке в оценку полного
+func ScaleSampled(value int, rate float64) int {
+	if rate <= 0 || rate >= 1 {
+		return value
+	}
+
+	return int(math.Round(float64(value) / rate))
+}
+
+func scaleConnections(connections map[string]ChannelCounter, rate float64) map[string]ChannelCounter {
+	scaled := make(map[string]ChannelCounter, len(connections))
+
+	for name, channel := range connections {
+		scaled[name] = channelEstimate(ScaleSampled(channel.Count(), rate))
+	}
+
+	return scaled
+}
@@ -1,18 +1,39 @@
 package lib
 
 import (
+	"errors"
+	"fmt"
 	"github.com/LimeHD/limehd-syslog-server/constants"
 	"github.com/urfave/cli"
+	"time"
 )
 
 type Service struct {
-	logger   Logger
-	influx   *InfluxClient
-	finder   *GeoFinder
-	parser   *SyslogParser
-	stream   *StreamQueue
-	online   *Online
-	template *Template
+	logger         Logger
+	sink           *FanOutSink
+	events         *EventQueue
+	sessions       *SessionTracker
+	http           *HttpServer
+	finder         *GeoFinder
+	parser         *SyslogParser
+	fastParser     *FastParser
+	identityParser *FastParser
+	stream         *StreamQueue
+	online         OnlineCounter
+	dimensions     *DimensionalOnline
+	peaks          *OnlinePeaks
+	identity       *IdentityBuilder
+	classifier     *UserAgentClassifier
+	filter         *RequestFilter
+	sampler        *ViewerSampler
+	quarantine     *Quarantine
+	snapshot       *OnlineSnapshot
+	audience       *AudienceCounter
+	template       *Template
+	onlineInterval int64
+	openers        []Opener
+	lifecycle      *Lifecycle
+	metrics        *PipelineMetrics
 	// todo
 	// online, pool
 }
@@ -41,20 +62,100 @@ func NewService(c *cli.Context) *Service {
 		s.logger.ErrorLog(err)
 	}
 
-	influx, err := NewInfluxClient(
-		InfluxClientConfig{
-			Addr:              c.String("influx-url"),
-			Database:          c.String("influx-db"),
-			Logger:            s.logger,
-			Measurement:       c.String("influx-measurement"),
-			MeasurementOnline: c.String("influx-measurement-online"),
-		},
-	)
+	var sinks []Sink
+
+	influx, err := newInfluxSink(c, s.logger)
 
 	if err != nil {
 		s.logger.ErrorLog(err)
+	} else {
+		sinks = append(sinks, influx)
+	}
+
+	s.metrics = NewPipelineMetrics()
+	s.lifecycle = NewLifecycle(
+		LifecycleConfig{
+			Logger: s.logger,
+		},
+	)
+
+	if len(c.String("http-address")) > 0 {
+		s.http = NewHttpServer(
+			HttpServerConfig{
+				Addr:   c.String("http-address"),
+				Logger: s.logger,
+			},
+		)
+		s.http.Handle("/health", s.lifecycle)
+		s.http.Handle("/pipeline", s.metrics)
+	}
+
+	if c.Bool("prometheus") {
+		prometheus, err := NewPrometheusSink(
+			PrometheusSinkConfig{
+				Labels: splitList(c.String("prometheus-labels")),
+			},
+		)
+
+		if err != nil {
+			s.logger.ErrorLog(err)
+		} else if s.http == nil {
+			s.logger.ErrorLog(errors.New(constants.PROMETHEUS_WITHOUT_HTTP))
+		} else {
+			s.http.Handle("/metrics", prometheus)
+			sinks = append(sinks, prometheus)
+		}
+	}
+
+	if len(c.String("archive-dir")) > 0 {
+		archive, err := NewArchiveSink(
+			ArchiveSinkConfig{
+				Dir:       c.String("archive-dir"),
+				MaxSize:   c.Int64("archive-max-size") * 1024 * 1024,
+				Retention: time.Hour * time.Duration(c.Int("archive-retention")),
+				Logger:    s.logger,
+			},
+		)
+
+		if err != nil {
+			s.logger.ErrorLog(err)
+		} else {
+			sinks = append(sinks, archive)
+		}
 	}
 
+	if len(c.String("clickhouse-url")) > 0 {
+		clickhouse, err := NewClickHouseSink(
+			ClickHouseSinkConfig{
+				Addr:      c.String("clickhouse-url"),
+				Database:  c.String("clickhouse-db"),
+				Table:     c.String("clickhouse-table"),
+				User:      c.String("clickhouse-user"),
+				Password:  c.String("clickhouse-password"),
+				Retries:   c.Int("clickhouse-retries"),
+				BatchSize: c.Int("clickhouse-batch-size"),
+				IpHashKey: c.String("clickhouse-ip-key"),
+				Logger:    s.logger,
+			},
+		)
+
+		if err != nil {
+			s.logger.ErrorLog(err)
+		} else {
+			sinks = append(sinks, clickhouse)
+		}
+	}
+
+	sink := NewFanOutSink(
+		FanOutSinkConfig{
+			Sinks:        sinks,
+			BufferSize:   c.Int("sink-buffer-size"),
+			ErrorHandler: s.logger.ErrorLog,
+			Metrics:      s.metrics,
+			DrainTimeout: time.Second * time.Duration(c.Int64("shutdown-timeout")),
+		},
+	)
+
 	template, err := NewTemplate(
 		TemplateConfig{
 			Template: c.String("nginx-template"),
@@ -65,45 +166,399 @@ func NewService(c *cli.Context) *Service {
 		s.logger.ErrorLog(err)
 	}
 
-	parser := NewSyslogParser(
-		s.logger,
-		ParserConfig{
-			PartsDelim:  constants.LOG_DELIM,
-			StreamDelim: constants.REQUEST_URI_DELIM,
-			Template:    template,
+	parserConfig := ParserConfig{
+		PartsDelim:  constants.LOG_DELIM,
+		StreamDelim: constants.REQUEST_URI_DELIM,
+		Template:    template,
+	}
+
+	parser := NewSyslogParser(s.logger, parserConfig)
+
+	if dimensions := splitList(c.String("online-dimensions")); len(dimensions) > 0 {
+		s.dimensions, err = NewDimensionalOnline(
+			DimensionalOnlineConfig{
+				Dimensions: dimensions,
+				CounterFactory: func() (OnlineCounter, error) {
+					return newOnlineCounter(c)
+				},
+			},
+		)
+
+		if err != nil {
+			s.logger.ErrorLog(err)
+		}
+	}
+
+	if c.Int64("online-peak-interval") > 0 {
+		s.peaks = NewOnlinePeaks(
+			OnlinePeaksConfig{
+				CounterFactory: func() OnlineCounter {
+					return newPeakCounter(c)
+				},
+			},
+		)
+	}
+
+	s.classifier, err = NewUserAgentClassifier(
+		UserAgentClassifierConfig{
+			RulesFile: c.String("ua-rules"),
+			CacheSize: c.Int("ua-cache-size"),
 		},
 	)
 
+	if err != nil {
+		s.logger.ErrorLog(err)
+		// встроенные правила заведомо корректны
+		s.classifier, _ = NewUserAgentClassifier(UserAgentClassifierConfig{CacheSize: c.Int("ua-cache-size")})
+	}
+
+	// правила и режим проверены до запуска в ValidateFilterConfig
+	if filterConfig := newFilterConfig(c); filterConfig.Enabled() {
+		s.filter, _ = NewRequestFilter(filterConfig)
+
+		if s.http != nil {
+			s.http.Handle("/filter", s.filter)
+		}
+	}
+
+	// выборка есть всегда, чтобы ее можно было включить на лету во время пика
+	// --sample-rate проверен до запуска в ValidateSamplerConfig
+	s.sampler, _ = NewViewerSampler(newSamplerConfig(c))
+
+	if s.http != nil {
+		s.http.Handle("/sampling", s.sampler)
+	}
+
+	// --identity проверен до запуска в ValidateIdentityConfig
+	s.identity, _ = NewIdentityBuilder(c.String("identity"))
+
+	s.identityParser = NewFastParser(parserConfig, s.identity.Fields()...)
+
 	stream := NewStream()
-	online := NewOnline()
+	online, err := newOnlineCounter(c)
 
-	Notifier(
-		s.logger,
-		geoFinder,
-		influx,
-	)
+	if err != nil {
+		s.logger.ErrorLog(err)
+		// без онлайна сервис бесполезен, поэтому откатываемся к точному подсчету
+		online = NewOnlineExact()
+	}
+
+	// сначала сохраняется состояние, затем останавливаются приемники, логгер закрывается последним
+	// HTTP сервером управляет Lifecycle, как и остальными компонентами с собственными потоками
+	var openers []Opener
+
+	if path := c.String("online-snapshot"); len(path) > 0 {
+		counters := map[string]OnlineCounter{"online": online}
+
+		if s.dimensions != nil {
+			for name, counter := range s.dimensions.Counters() {
+				counters["dimension:"+name] = counter
+			}
+		}
+
+		s.snapshot = NewOnlineSnapshot(
+			OnlineSnapshotConfig{
+				Path:     path,
+				MaxAge:   time.Second * time.Duration(c.Int64("online-snapshot-max-age")),
+				Counters: counters,
+				Logger:   s.logger,
+			},
+		)
+
+		restored, err := s.snapshot.Restore()
+
+		if err != nil {
+			s.logger.ErrorLog(err)
+		}
+
+		if restored {
+			s.logger.InfoLog(fmt.Sprintf("Online state restored from %s", path))
+		}
+
+		openers = append([]Opener{s.snapshot}, openers...)
+	}
+
+	if c.Bool("audience") {
+		// точность проверяем до приведения к uint8, иначе 270 превратилось бы в 14
+		precision, err := HyperLogLogPrecision(c.Int("audience-hll-precision"))
 
-	s.influx = influx
+		if err == nil {
+			s.audience, err = NewAudienceCounter(
+				AudienceCounterConfig{
+					Path:      c.String("audience-snapshot"),
+					Precision: precision,
+					Logger:    s.logger,
+				},
+			)
+		}
+
+		if err != nil {
+			s.logger.ErrorLog(err)
+		} else {
+			restored, err := s.audience.Restore()
+
+			if err != nil {
+				s.logger.ErrorLog(err)
+			}
+
+			if restored {
+				s.logger.InfoLog(fmt.Sprintf("Audience sketches restored from %s", c.String("audience-snapshot")))
+			}
+
+			if s.http != nil {
+				s.http.Handle("/audience", s.audience)
+			}
+
+			openers = append([]Opener{s.audience}, openers...)
+		}
+	}
+
+	if path := c.String("quarantine"); len(path) > 0 {
+		s.quarantine, err = NewQuarantine(
+			QuarantineConfig{
+				Path:    path,
+				MaxSize: c.Int64("quarantine-max-size") * 1024 * 1024,
+				Rate:    c.Int("quarantine-rate"),
+			},
+		)
+
+		if err != nil {
+			s.logger.ErrorLog(err)
+		} else {
+			openers = append(openers, s.quarantine)
+		}
+	}
+
+	s.openers = append(openers, sink, geoFinder, s.logger)
+
+	s.sink = sink
+
+	if c.Bool("sessions") {
+		s.sessions = NewSessionTracker(
+			SessionTrackerConfig{
+				IdleTimeout:     time.Second * time.Duration(c.Int64("session-idle-timeout")),
+				SegmentDuration: time.Second * time.Duration(c.Int64("session-segment-duration")),
+			},
+		)
+	}
+
+	// сырые события копим только если они кому-то нужны
+	if sink.AcceptsEvents() {
+		s.events = NewEventQueue()
+	}
+
+	s.fastParser = NewFastParser(parserConfig, PipelineFields(s.identity, s.events != nil)...)
 	s.finder = &geoFinder
 	s.parser = &parser
 	s.stream = stream
-	s.online = &online
+	s.online = online
+	s.onlineInterval = c.Int64("online-duration")
+
+	if _, ok := online.(*SlidingOnline); ok {
+		s.onlineInterval = c.Int64("online-tick")
+	}
 
 	return s
 }
 
+// проверка параметров influx до запуска: без influx сервис не имеет смысла, поэтому ошибка останавливает запуск
+func ValidateInfluxConfig(c *cli.Context) error {
+	switch c.Int("influx-version") {
+	case 1:
+		if len(c.String("influx-db")) == 0 {
+			return errors.New(constants.INFLUX_DATABASE_REQUIRED)
+		}
+	case 2:
+		if len(c.String("influx-org")) == 0 || len(c.String("influx-bucket")) == 0 {
+			return errors.New(constants.INFLUX2_ORG_BUCKET_REQUIRED)
+		}
+
+		if _, ok := influx2Precisions[c.String("influx-precision")]; !ok {
+			return errors.New(fmt.Sprintf("%s: %s", constants.INFLUX_INVALID_PRECISION, c.String("influx-precision")))
+		}
+	default:
+		return errors.New(fmt.Sprintf("%s: %d", constants.INFLUX_UNSUPPORTED_VERSION, c.Int("influx-version")))
+	}
+
+	return nil
+}
+
+// секрет для хеша IP проверяется до запуска, чтобы не писать в ClickHouse обратимые хеши
+func ValidateClickHouseConfig(c *cli.Context) error {
+	if len(c.String("clickhouse-url")) > 0 && len(c.String("clickhouse-ip-key")) == 0 {
+		return errors.New(constants.CLICKHOUSE_IP_KEY_REQUIRED)
+	}
+
+	return nil
+}
+
+// с неверным --identity зрители считались бы не так, как настроено, поэтому запуск останавливается
+func ValidateIdentityConfig(c *cli.Context) error {
+	_, err := NewIdentityBuilder(c.String("identity"))
+	return err
+}
+
+// с неверной долей выборки трафик и онлайн пересчитывались бы не так, как настроено, поэтому запуск останавливается
+func ValidateSamplerConfig(c *cli.Context) error {
+	_, err := NewViewerSampler(newSamplerConfig(c))
+	return err
+}
+
+func newSamplerConfig(c *cli.Context) ViewerSamplerConfig {
+	return ViewerSamplerConfig{
+		Rate:  c.Float64("sample-rate"),
+		Token: c.String("sampling-token"),
+	}
+}
+
+// с неверным правилом фильтра запросы мониторинга считались бы зрителями, поэтому запуск останавливается
+func ValidateFilterConfig(c *cli.Context) error {
+	_, err := NewRequestFilter(newFilterConfig(c))
+	return err
+}
+
+func newFilterConfig(c *cli.Context) RequestFilterConfig {
+	return RequestFilterConfig{
+		UserAgents: splitList(c.String("filter-user-agents")),
+		Networks:   splitList(c.String("filter-networks")),
+		Hosts:      splitList(c.String("filter-hosts")),
+		Bots:       c.Bool("filter-bots"),
+		Mode:       c.String("filter-mode"),
+	}
+}
+
+// клиент influx выбранной версии API, измерения и тэги у обеих версий одинаковые
+func newInfluxSink(c *cli.Context, logger Logger) (Sink, error) {
+	switch c.Int("influx-version") {
+	case 1:
+		return NewInfluxClient(
+			InfluxClientConfig{
+				Addr:                 c.String("influx-url"),
+				Database:             c.String("influx-db"),
+				Logger:               logger,
+				Measurement:          c.String("influx-measurement"),
+				MeasurementOnline:    c.String("influx-measurement-online"),
+				MeasurementSessions:  c.String("influx-measurement-sessions"),
+				MeasurementWatchTime: c.String("influx-measurement-watch-time"),
+				MeasurementAudience:  c.String("influx-measurement-audience"),
+				MeasurementInternal:  c.String("influx-measurement-internal"),
+			},
+		)
+	case 2:
+		return NewInflux2Client(
+			Influx2ClientConfig{
+				Addr:                 c.String("influx-url"),
+				Org:                  c.String("influx-org"),
+				Bucket:               c.String("influx-bucket"),
+				Token:                c.String("influx-token"),
+				Precision:            c.String("influx-precision"),
+				Gzip:                 c.BoolT("influx-gzip"),
+				Logger:               logger,
+				Measurement:          c.String("influx-measurement"),
+				MeasurementOnline:    c.String("influx-measurement-online"),
+				MeasurementSessions:  c.String("influx-measurement-sessions"),
+				MeasurementWatchTime: c.String("influx-measurement-watch-time"),
+				MeasurementAudience:  c.String("influx-measurement-audience"),
+				MeasurementInternal:  c.String("influx-measurement-internal"),
+			},
+		)
+	}
+
+	return nil, errors.New(fmt.Sprintf("%s: %d", constants.INFLUX_UNSUPPORTED_VERSION, c.Int("influx-version")))
+}
+
+// реализация подсчета онлайн пользователей по --online-mode
+func newOnlineCounter(c *cli.Context) (OnlineCounter, error) {
+	switch c.String("online-mode") {
+	case constants.ONLINE_MODE_EXACT:
+		return NewOnlineExact(), nil
+	case constants.ONLINE_MODE_HYPERLOGLOG:
+		precision, err := HyperLogLogPrecision(c.Int("online-hll-precision"))
+
+		if err != nil {
+			return nil, err
+		}
+
+		return NewHyperLogLogOnline(precision)
+	case constants.ONLINE_MODE_SLIDING:
+		return NewSlidingOnline(c.Int64("online-duration")), nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("%s: %s", constants.ONLINE_UNKNOWN_MODE, c.String("online-mode")))
+}
+
+// счетчик интервала пиков: в режиме hyperloglog - скетч, чтобы память не зависела от зрителей,
+// иначе точный, интервал короткий и сбрасывается целиком, поэтому скользящее окно не нужно
+func newPeakCounter(c *cli.Context) OnlineCounter {
+	if c.String("online-mode") == constants.ONLINE_MODE_HYPERLOGLOG {
+		if precision, err := HyperLogLogPrecision(c.Int("online-hll-precision")); err == nil {
+			if counter, err := NewHyperLogLogOnline(precision); err == nil {
+				return counter
+			}
+		}
+	}
+
+	return NewOnlineExact()
+}
+
+// сообщения, на которых обработчики пула упали с паникой
+func (s Service) GetQuarantine() *Quarantine {
+	return s.quarantine
+}
+
+// выборка зрителей на пиках трафика
+func (s Service) GetSampler() *ViewerSampler {
+	return s.sampler
+}
+
+// внутренние метрики конвейера
+func (s Service) GetMetrics() *PipelineMetrics {
+	return s.metrics
+}
+
+// запуск и остановка компонентов сервиса
+func (s Service) GetLifecycle() *Lifecycle {
+	return s.lifecycle
+}
+
+// закрывает ресурсы, когда конвейер уже остановлен и финальные данные переданы в приемники
+func (s Service) Close() {
+	Shutdown(s.openers...)
+}
+
 func (s Service) GetLogger() Logger {
 	return s.logger
 }
 
-func (s Service) GetInfluxClient() *InfluxClient {
-	return s.influx
+func (s Service) GetSink() *FanOutSink {
+	return s.sink
+}
+
+// накопитель сырых событий, nil если ни один приемник их не принимает
+func (s Service) GetEvents() *EventQueue {
+	return s.events
+}
+
+// трекер сессий просмотра, nil если --sessions не указан
+func (s Service) GetSessions() *SessionTracker {
+	return s.sessions
+}
+
+// служебный HTTP сервер, nil если --http-address не указан
+func (s Service) GetHttpServer() *HttpServer {
+	return s.http
 }
 
 func (s Service) GetParser() *SyslogParser {
 	return s.parser
 }
 
+// разбор без аллокаций для конвейера, только нужных ему полей
+// SyslogParser разбирает все поля, конвейером не используется
+func (s Service) GetFastParser() *FastParser {
+	return s.fastParser
+}
+
 func (s Service) GetFinder() *GeoFinder {
 	return s.finder
 }
@@ -112,6 +567,50 @@ func (s Service) GetStream() *StreamQueue {
 	return s.stream
 }
 
-func (s Service) GetOnline() *Online {
+func (s Service) GetOnline() OnlineCounter {
 	return s.online
 }
+
+// онлайн в разрезе измерений, nil если --online-dimensions не указан
+func (s Service) GetDimensions() *DimensionalOnline {
+	return s.dimensions
+}
+
+func (s Service) GetIdentity() *IdentityBuilder {
+	return s.identity
+}
+
+// разбор только полей идентификации, для выборки зрителей пулом до полного разбора
+func (s Service) GetIdentityParser() *FastParser {
+	return s.identityParser
+}
+
+// уникальные зрители за день и месяц, nil если --audience не указан
+func (s Service) GetAudience() *AudienceCounter {
+	return s.audience
+}
+
+// сохранение онлайна на диск, nil если --online-snapshot не указан
+func (s Service) GetSnapshot() *OnlineSnapshot {
+	return s.snapshot
+}
+
+// фильтр запросов не от зрителей, nil если правила не заданы
+func (s Service) GetFilter() *RequestFilter {
+	return s.filter
+}
+
+func (s Service) GetClassifier() *UserAgentClassifier {
+	return s.classifier
+}
+
+// пики онлайна внутри окна, nil если --online-peak-interval равен 0
+func (s Service) GetPeaks() *OnlinePeaks {
+	return s.peaks
+}
+
+// как часто отправлять онлайн (в секундах): в скользящем окне - каждый тик,
+// в остальных режимах - по окончании окна
+func (s Service) GetOnlineInterval() int64 {
+	return s.onlineInterval
+}
@@ -0,0 +1,242 @@
+package lib
+
+import (
+	"context"
+	"github.com/LimeHD/limehd-syslog-server/constants"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// Отслеживает сессии просмотра: сессия открывается на первом медиа сегменте пользователя
+	// и закрывается, если от пользователя не было сегментов дольше idleTimeout
+	// сессии разложены по шардам по хэшу зрителя, у каждого шарда своя блокировка, как у онлайна
+	SessionTracker struct {
+		shards           []*sessionShard
+		idleTimeout      time.Duration
+		segmentDuration  time.Duration
+		scheduleCallback func(s *SessionTracker)
+	}
+
+	sessionShard struct {
+		mt       sync.Mutex
+		sessions map[sessionKey]*session
+		closed   []SessionRecord
+	}
+
+	SessionTrackerConfig struct {
+		IdleTimeout time.Duration
+		// сколько видео в одном сегменте: последний сегмент досматривается уже после его запроса,
+		// поэтому сессия из одного сегмента длится не 0, а один сегмент
+		SegmentDuration time.Duration
+	}
+
+	// Закрытая сессия просмотра
+	SessionRecord struct {
+		Channel   string
+		Start     time.Time
+		End       time.Time
+		Duration  time.Duration
+		BytesSent int64
+		Qualities []string
+		Country   string
+		AsnNumber uint
+		AsnOrg    string
+		// доля выборки зрителей на последнем запросе сессии, 0 - без выборки
+		SampleRate float64
+	}
+
+	// Среднее время просмотра канала по сессиям, закрытым за окно
+	// по выборке зрителей количество сессий пересчитывается в оценку полного, каждая сессия весит 1/rate
+	WatchTime struct {
+		Sessions        int
+		AverageDuration time.Duration
+	}
+
+	// Пачка для отправки в приемники
+	SessionReport struct {
+		Records   []SessionRecord
+		WatchTime map[string]WatchTime
+	}
+
+	session struct {
+		record    SessionRecord
+		qualities map[string]bool
+	}
+
+	// сессия зрителя на канале
+	sessionKey struct {
+		channel string
+		viewer  uint64
+	}
+)
+
+func NewSessionTracker(config SessionTrackerConfig) *SessionTracker {
+	s := &SessionTracker{
+		idleTimeout:     config.IdleTimeout,
+		segmentDuration: config.SegmentDuration,
+		shards:          make([]*sessionShard, constants.AGGREGATION_SHARDS),
+	}
+
+	for index := range s.shards {
+		s.shards[index] = &sessionShard{
+			sessions: map[sessionKey]*session{},
+		}
+	}
+
+	return s
+}
+
+func (s *SessionTracker) SetScheduleHandler(handler func(s *SessionTracker)) {
+	s.scheduleCallback = handler
+}
+
+// учитывает запрос пользователя, сессии открываются только медиа сегментами, плейлисты не в счет
+func (s *SessionTracker) Track(i UniqueIdentity, r Receiver) {
+	if !r.Parser.IsMediaStream() {
+		return
+	}
+
+	now := time.Now()
+	key := sessionKey{channel: i.Channel, viewer: i.Hash()}
+	shard := s.shards[key.viewer%uint64(len(s.shards))]
+
+	shard.mt.Lock()
+	defer shard.mt.Unlock()
+
+	current, ok := shard.sessions[key]
+
+	// сессия могла истечь, но еще не быть закрыта планировщиком
+	if ok && now.Sub(current.record.End) > s.idleTimeout {
+		s.close(shard, key, current)
+		ok = false
+	}
+
+	if !ok {
+		current = &session{
+			record: SessionRecord{
+				Channel: i.Channel,
+				Start:   now,
+			},
+			qualities: map[string]bool{},
+		}
+
+		if r.Finder != nil {
+			current.record.Country = r.Finder.GetCountryIsoCode()
+			current.record.AsnNumber = r.Finder.GetOrganizationNumber()
+			current.record.AsnOrg = r.Finder.GetOrganization()
+		}
+
+		shard.sessions[key] = current
+	}
+
+	current.record.End = now
+	current.record.SampleRate = r.SampleRate
+	current.record.BytesSent += int64(r.Parser.GetBytesSent())
+	current.qualities[r.Parser.GetQuality()] = true
+}
+
+// закрывает сессии, простаивающие дольше idleTimeout
+func (s *SessionTracker) Sweep() {
+	now := time.Now()
+
+	for _, shard := range s.shards {
+		shard.mt.Lock()
+		for key, current := range shard.sessions {
+			if now.Sub(current.record.End) > s.idleTimeout {
+				s.close(shard, key, current)
+			}
+		}
+		shard.mt.Unlock()
+	}
+}
+
+// закрывает все открытые сессии, например при остановке сервиса
+func (s *SessionTracker) CloseAll() {
+	for _, shard := range s.shards {
+		shard.mt.Lock()
+		for key, current := range shard.sessions {
+			s.close(shard, key, current)
+		}
+		shard.mt.Unlock()
+	}
+}
+
+// забирает сессии, закрытые с прошлого вызова, и среднее время просмотра по ним
+// закрытые сессии шарда забираются под его блокировкой, чтобы сессии, закрытые в это время, попали в следующую пачку
+func (s *SessionTracker) Collect() SessionReport {
+	closed := []SessionRecord{}
+
+	for _, shard := range s.shards {
+		shard.mt.Lock()
+		closed = append(closed, shard.closed...)
+		shard.closed = nil
+		shard.mt.Unlock()
+	}
+
+	return SessionReport{
+		Records:   closed,
+		WatchTime: watchTime(closed),
+	}
+}
+
+// количество открытых сессий
+func (s *SessionTracker) Open() int {
+	open := 0
+
+	for _, shard := range s.shards {
+		shard.mt.Lock()
+		open += len(shard.sessions)
+		shard.mt.Unlock()
+	}
+
+	return open
+}
+
+func (s *SessionTracker) Scheduler(ctx context.Context, duration int64) error {
+	return runEvery(ctx, every(time.Second*time.Duration(duration)), func() {
+		s.scheduleCallback(s)
+	})
+}
+
+// вызывается под блокировкой шарда
+func (s *SessionTracker) close(shard *sessionShard, key sessionKey, current *session) {
+	record := current.record
+	record.Duration = record.End.Sub(record.Start) + s.segmentDuration
+
+	for quality := range current.qualities {
+		record.Qualities = append(record.Qualities, quality)
+	}
+	sort.Strings(record.Qualities)
+
+	shard.closed = append(shard.closed, record)
+	delete(shard.sessions, key)
+}
+
+func watchTime(records []SessionRecord) map[string]WatchTime {
+	weights := map[string]float64{}
+	total := map[string]float64{}
+
+	for _, record := range records {
+		weight := 1.0
+		if record.SampleRate > 0 && record.SampleRate < 1 {
+			weight = 1 / record.SampleRate
+		}
+
+		weights[record.Channel] += weight
+		total[record.Channel] += weight * float64(record.Duration)
+	}
+
+	result := make(map[string]WatchTime, len(weights))
+
+	for channel, weight := range weights {
+		result[channel] = WatchTime{
+			Sessions:        int(math.Round(weight)),
+			AverageDuration: time.Duration(math.Round(total[channel] / weight)),
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,334 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"github.com/LimeHD/limehd-syslog-server/constants"
+	"sync"
+	"time"
+)
+
+type (
+	// Приемник агрегированных данных: influx, prometheus и т.д.
+	Sink interface {
+		// пачка трафика, накопленная за stream-duration
+		WriteTraffic(params []InfluxRequestParams) error
+		// онлайн пользователи, накопленные за online-duration
+		WriteOnline(params InfluxOnlineRequestParams) error
+		Close()
+	}
+
+	// Приемник, который пишет только в память и не блокируется (опционально):
+	// вызывается сразу при рассылке, без буфера, поэтому не теряет пачки при переполнении
+	// метод-метка, реализация ничего не делает
+	SynchronousSink interface {
+		Synchronous()
+	}
+
+	// Приемник сырых событий: каждый разобранный и обогащенный геоданными запрос
+	// реализуется приемником опционально, в дополнение к Sink
+	EventSink interface {
+		WriteEvents(events []Receiver) error
+	}
+
+	// Приемник закрытых сессий просмотра и среднего времени просмотра (опционально)
+	SessionSink interface {
+		WriteSessions(report SessionReport) error
+	}
+
+	// Приемник внутренних метрик конвейера (опционально)
+	MetricsSink interface {
+		WriteMetrics(snapshot MetricsSnapshot) error
+	}
+
+	// Приемник уникальных зрителей за закончившийся день или месяц (опционально)
+	AudienceSink interface {
+		WriteAudience(report AudienceReport) error
+	}
+
+	// Рассылает данные сразу в несколько приемников
+	// у каждого приемника свой буфер и свой поток, поэтому медленный или недоступный приемник
+	// не блокирует и не роняет остальные
+	FanOutSink struct {
+		mt           sync.RWMutex
+		closed       bool
+		workers      []*sinkWorker
+		errorHandler func(err error)
+		wg           *sync.WaitGroup
+		metrics      *PipelineMetrics
+		drainTimeout time.Duration
+		// закрывается по таймауту остановки, оставшиеся пачки вычитываются без отправки
+		abort chan struct{}
+	}
+
+	FanOutSinkConfig struct {
+		Sinks []Sink
+		// количество пачек, которые могут ожидать отправки в каждый из приемников
+		BufferSize   int
+		ErrorHandler func(err error)
+		Metrics      *PipelineMetrics
+		// сколько при остановке ждать отправки накопленных пачек, 0 - без ограничения
+		DrainTimeout time.Duration
+	}
+
+	// у синхронного приемника нет ни буфера, ни потока
+	sinkWorker struct {
+		sink  Sink
+		queue chan sinkTask
+		done  chan struct{}
+	}
+
+	sinkTask func(s Sink) error
+)
+
+func NewFanOutSink(config FanOutSinkConfig) *FanOutSink {
+	f := &FanOutSink{
+		errorHandler: config.ErrorHandler,
+		wg:           &sync.WaitGroup{},
+		metrics:      config.Metrics,
+		drainTimeout: config.DrainTimeout,
+		abort:        make(chan struct{}),
+	}
+
+	if f.metrics == nil {
+		f.metrics = NewPipelineMetrics()
+	}
+
+	for _, sink := range config.Sinks {
+		w := &sinkWorker{
+			sink: sink,
+		}
+
+		f.workers = append(f.workers, w)
+
+		if isSynchronousSink(sink) {
+			continue
+		}
+
+		w.queue = make(chan sinkTask, config.BufferSize)
+		w.done = make(chan struct{})
+		f.wg.Add(1)
+
+		go f.work(w)
+	}
+
+	return f
+}
+
+func (f *FanOutSink) WriteTraffic(params []InfluxRequestParams) error {
+	return f.dispatch(anySink, func(s Sink) error {
+		return s.WriteTraffic(params)
+	})
+}
+
+func (f *FanOutSink) WriteOnline(params InfluxOnlineRequestParams) error {
+	return f.dispatch(anySink, func(s Sink) error {
+		return s.WriteOnline(params)
+	})
+}
+
+// события получают только приемники, реализующие EventSink
+func (f *FanOutSink) WriteEvents(events []Receiver) error {
+	return f.dispatch(isEventSink, func(s Sink) error {
+		return s.(EventSink).WriteEvents(events)
+	})
+}
+
+// сессии получают только приемники, реализующие SessionSink
+func (f *FanOutSink) WriteSessions(report SessionReport) error {
+	return f.dispatch(isSessionSink, func(s Sink) error {
+		return s.(SessionSink).WriteSessions(report)
+	})
+}
+
+// итоги периода получают только приемники, реализующие AudienceSink
+func (f *FanOutSink) WriteAudience(report AudienceReport) error {
+	return f.dispatch(isAudienceSink, func(s Sink) error {
+		return s.(AudienceSink).WriteAudience(report)
+	})
+}
+
+// метрики получают только приемники, реализующие MetricsSink
+func (f *FanOutSink) WriteMetrics(snapshot MetricsSnapshot) error {
+	return f.dispatch(isMetricsSink, func(s Sink) error {
+		return s.(MetricsSink).WriteMetrics(snapshot)
+	})
+}
+
+// Есть ли среди приемников те, кому нужны сырые события
+// если нет - события можно не накапливать
+func (f *FanOutSink) AcceptsEvents() bool {
+	for _, w := range f.workers {
+		if isEventSink(w.sink) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Количество подключенных приемников
+func (f *FanOutSink) Len() int {
+	return len(f.workers)
+}
+
+// дожидаемся отправки всех накопленных пачек и закрываем приемники
+func (f *FanOutSink) Close() {
+	// планировщики могут сработать и после остановки, их пачки уже никуда не попадут
+	f.mt.Lock()
+	f.closed = true
+	for _, w := range f.workers {
+		if w.queue != nil {
+			close(w.queue)
+		}
+	}
+	f.mt.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(drained)
+	}()
+
+	var timeout <-chan time.Time
+	if f.drainTimeout > 0 {
+		timer := time.NewTimer(f.drainTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-drained:
+	case <-timeout:
+		lost := 0
+		for _, w := range f.workers {
+			if w.queue != nil {
+				lost += len(w.queue)
+			}
+		}
+
+		close(f.abort)
+		f.metrics.Add("sink_dropped_shutdown", int64(lost))
+
+		if f.errorHandler != nil {
+			f.errorHandler(errors.New(fmt.Sprintf("%s: %d", constants.SINK_DRAIN_TIMEOUT, lost)))
+		}
+	}
+
+	for _, w := range f.workers {
+		// приемник, зависший на записи, не закрываем, чтобы не закрыть его посреди отправки
+		if w.done != nil && !w.finished() {
+			continue
+		}
+
+		w.sink.Close()
+	}
+}
+
+func (f *FanOutSink) CloseMessage() string {
+	return "Close sinks"
+}
+
+// раскладываем задачу по буферам приемников, не дожидаясь записи
+// если буфер приемника переполнен - пачка для него теряется, остальные приемники ее получат
+func (f *FanOutSink) dispatch(accept func(s Sink) bool, task sinkTask) error {
+	f.mt.RLock()
+	defer f.mt.RUnlock()
+
+	if f.closed {
+		return errors.New(constants.SINK_CLOSED)
+	}
+
+	overflowed := 0
+
+	for _, w := range f.workers {
+		if !accept(w.sink) {
+			continue
+		}
+
+		if w.queue == nil {
+			f.write(w, task)
+			continue
+		}
+
+		select {
+		case w.queue <- task:
+		default:
+			overflowed++
+		}
+	}
+
+	if overflowed > 0 {
+		f.metrics.Add("sink_overflow", int64(overflowed))
+		return errors.New(fmt.Sprintf("%s: %d", constants.SINK_BUFFER_OVERFLOW, overflowed))
+	}
+
+	return nil
+}
+
+func (f *FanOutSink) work(w *sinkWorker) {
+	defer f.wg.Done()
+	defer close(w.done)
+
+	for task := range w.queue {
+		select {
+		case <-f.abort:
+			continue
+		default:
+		}
+
+		f.write(w, task)
+	}
+}
+
+func (w *sinkWorker) finished() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (f *FanOutSink) write(w *sinkWorker, task sinkTask) {
+	start := time.Now()
+	err := task(w.sink)
+	f.metrics.Since("sink_write", start)
+
+	if err != nil {
+		f.metrics.Inc("sink_errors")
+
+		if f.errorHandler != nil {
+			f.errorHandler(fmt.Errorf("%T: %w", w.sink, err))
+		}
+	}
+}
+
+func isSynchronousSink(s Sink) bool {
+	_, ok := s.(SynchronousSink)
+	return ok
+}
+
+func anySink(s Sink) bool {
+	return true
+}
+
+func isEventSink(s Sink) bool {
+	_, ok := s.(EventSink)
+	return ok
+}
+
+func isSessionSink(s Sink) bool {
+	_, ok := s.(SessionSink)
+	return ok
+}
+
+func isAudienceSink(s Sink) bool {
+	_, ok := s.(AudienceSink)
+	return ok
+}
+
+func isMetricsSink(s Sink) bool {
+	_, ok := s.(MetricsSink)
+	return ok
+}
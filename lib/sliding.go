@@ -0,0 +1,175 @@
+package lib
+
+import (
+	"context"
+	"encoding/gob"
+	"io"
+	"sync"
+	"time"
+)
+
+type (
+	// Онлайн пользователи в скользящем окне: пользователь онлайн, если был виден за последние window секунд
+	// в отличие от Online данные не сбрасываются целиком, Flush только вытесняет устаревших пользователей,
+	// поэтому значение можно отправлять на каждом тике без "пилы" на графике
+	SlidingOnline struct {
+		mt               *sync.RWMutex
+		window           int64
+		connections      map[string]map[uint64]int64
+		lastFlushedAt    int64
+		scheduleCallback func(OnlineCounter)
+	}
+)
+
+func NewSlidingOnline(window int64) *SlidingOnline {
+	o := &SlidingOnline{
+		mt:          &sync.RWMutex{},
+		window:      window,
+		connections: map[string]map[uint64]int64{},
+	}
+	o.setFlushedAt()
+
+	return o
+}
+
+func (o *SlidingOnline) SetScheduleHandler(handler func(o OnlineCounter)) {
+	o.scheduleCallback = handler
+}
+
+// запоминаем, когда пользователь был виден последний раз
+func (o *SlidingOnline) Peek(i UniqueIdentity) {
+	now := time.Now().Unix()
+
+	o.mt.Lock()
+	channel, ok := o.connections[i.Channel]
+
+	if !ok {
+		channel = map[uint64]int64{}
+		o.connections[i.Channel] = channel
+	}
+
+	channel[i.Hash()] = now
+	o.mt.Unlock()
+}
+
+// вытесняем пользователей, которых не было видно дольше окна, и пустые каналы
+func (o *SlidingOnline) Flush() {
+	cutoff := o.cutoff()
+
+	o.mt.Lock()
+	for name, channel := range o.connections {
+		for hash, lastSeen := range channel {
+			if lastSeen < cutoff {
+				delete(channel, hash)
+			}
+		}
+
+		if len(channel) == 0 {
+			delete(o.connections, name)
+		}
+	}
+	o.setFlushedAt()
+	o.mt.Unlock()
+}
+
+func (o *SlidingOnline) Connections() map[string]ChannelCounter {
+	cutoff := o.cutoff()
+
+	o.mt.RLock()
+	defer o.mt.RUnlock()
+
+	connections := make(map[string]ChannelCounter, len(o.connections))
+	for name, channel := range o.connections {
+		count := 0
+
+		for _, lastSeen := range channel {
+			if lastSeen >= cutoff {
+				count++
+			}
+		}
+
+		if count > 0 {
+			connections[name] = channelEstimate(count)
+		}
+	}
+
+	return connections
+}
+
+func (o *SlidingOnline) Count() int {
+	return len(o.Connections())
+}
+
+func (o *SlidingOnline) Total() int {
+	total := 0
+	for _, channel := range o.Connections() {
+		total += channel.Count()
+	}
+	return total
+}
+
+func (o *SlidingOnline) Top(n int) SortedList {
+	return topConnections(o.Connections(), n)
+}
+
+func (o *SlidingOnline) String() string {
+	return onlineString(o.Top(10))
+}
+
+// здесь duration - это период отправки (тик), а не размер окна
+func (o *SlidingOnline) Scheduler(ctx context.Context, duration int64) error {
+	return runEvery(ctx, func() time.Duration {
+		return untilFlush(o.flushedAt(), duration)
+	}, func() {
+		o.scheduleCallback(o)
+	})
+}
+
+func (o *SlidingOnline) cutoff() int64 {
+	return time.Now().Unix() - o.window
+}
+
+type slidingSnapshot struct {
+	LastFlushedAt int64
+	Connections   map[string]map[uint64]int64
+}
+
+func (o *SlidingOnline) Snapshot(w io.Writer) error {
+	o.mt.RLock()
+	defer o.mt.RUnlock()
+
+	return gob.NewEncoder(w).Encode(slidingSnapshot{
+		LastFlushedAt: o.lastFlushedAt,
+		Connections:   o.connections,
+	})
+}
+
+// устаревшие за время простоя пользователи вытеснятся на ближайшем Flush
+func (o *SlidingOnline) Restore(r io.Reader) (func(), error) {
+	snapshot := slidingSnapshot{}
+
+	if err := gob.NewDecoder(r).Decode(&snapshot); err != nil {
+		return nil, err
+	}
+
+	if snapshot.Connections == nil {
+		snapshot.Connections = map[string]map[uint64]int64{}
+	}
+
+	return func() {
+		o.mt.Lock()
+		o.lastFlushedAt = snapshot.LastFlushedAt
+		o.connections = snapshot.Connections
+		o.mt.Unlock()
+	}, nil
+}
+
+func (o *SlidingOnline) setFlushedAt() {
+	o.lastFlushedAt = time.Now().Unix()
+}
+
+func (o *SlidingOnline) flushedAt() int64 {
+	o.mt.RLock()
+	defer o.mt.RUnlock()
+	return o.lastFlushedAt
+}
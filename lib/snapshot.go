@@ -0,0 +1,219 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/LimeHD/limehd-syslog-server/constants"
+	"io"
+	"os"
+	"time"
+)
+
+type (
+	// Счетчик онлайна, состояние которого можно сохранить на диск и восстановить
+	OnlineSnapshotter interface {
+		Snapshot(w io.Writer) error
+		// только читает свою часть снимка, состояние меняет возвращаемая функция
+		Restore(r io.Reader) (func(), error)
+	}
+
+	// Сохраняет состояние счетчиков онлайна при остановке и периодически,
+	// чтобы после перезапуска окно продолжилось, а не началось с нуля
+	OnlineSnapshot struct {
+		path     string
+		maxAge   time.Duration
+		counters map[string]OnlineCounter
+		_logger  Logger
+	}
+
+	OnlineSnapshotConfig struct {
+		Path string
+		// снимок старше этого возраста не восстанавливается
+		MaxAge time.Duration
+		// счетчики по именам: основной онлайн и срезы по измерениям
+		Counters map[string]OnlineCounter
+		Logger   Logger
+	}
+
+	onlineSnapshotHeader struct {
+		SavedAt int64
+		// версия хэша пользователей, см. constants.IDENTITY_HASH
+		Hash     string
+		Counters []onlineSnapshotCounter
+	}
+
+	onlineSnapshotCounter struct {
+		Name string
+		// тип счетчика, снимок другого режима не восстанавливаем
+		Kind string
+	}
+)
+
+func NewOnlineSnapshot(config OnlineSnapshotConfig) *OnlineSnapshot {
+	return &OnlineSnapshot{
+		path:     config.Path,
+		maxAge:   config.MaxAge,
+		counters: config.Counters,
+		_logger:  config.Logger,
+	}
+}
+
+// пишем во временный файл и переименовываем, чтобы не оставить на диске половину снимка
+func (s *OnlineSnapshot) Save() error {
+	tmp := s.path + ".tmp"
+	file, err := os.Create(tmp)
+
+	if err != nil {
+		return err
+	}
+
+	if err := s.write(file); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+// восстанавливает счетчики, если снимок есть и он достаточно свежий
+func (s *OnlineSnapshot) Restore() (bool, error) {
+	file, err := os.Open(s.path)
+
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	defer file.Close()
+
+	// gob не читает лишнего из io.ByteReader, поэтому счетчики могут читать свои части из того же потока
+	r := bufio.NewReader(file)
+	decoder := gob.NewDecoder(r)
+	header := onlineSnapshotHeader{}
+
+	if err := decoder.Decode(&header); err != nil {
+		return false, err
+	}
+
+	if age := time.Since(time.Unix(header.SavedAt, 0)); age > s.maxAge {
+		s._logger.InfoLog(fmt.Sprintf("Online snapshot is too old (%v), start from scratch", age.Round(time.Second)))
+		return false, nil
+	}
+
+	if header.Hash != constants.IDENTITY_HASH {
+		s._logger.InfoLog("Online snapshot uses another identity hash, start from scratch")
+		return false, nil
+	}
+
+	if len(header.Counters) != len(s.counters) {
+		return false, errors.New(constants.SNAPSHOT_MISMATCH)
+	}
+
+	for _, c := range header.Counters {
+		counter, ok := s.counters[c.Name]
+
+		if !ok || counterKind(counter) != c.Kind {
+			return false, errors.New(fmt.Sprintf("%s: %s", constants.SNAPSHOT_MISMATCH, c.Name))
+		}
+	}
+
+	// все счетчики пишутся в один поток друг за другом,
+	// применяем их только после того, как весь снимок прочитан без ошибок
+	applies := make([]func(), 0, len(header.Counters))
+
+	for _, c := range header.Counters {
+		apply, err := s.counters[c.Name].(OnlineSnapshotter).Restore(r)
+
+		if err != nil {
+			return false, err
+		}
+
+		applies = append(applies, apply)
+	}
+
+	for _, apply := range applies {
+		apply()
+	}
+
+	return true, nil
+}
+
+func (s *OnlineSnapshot) Scheduler(ctx context.Context, duration int64) error {
+	return runEvery(ctx, every(time.Second*time.Duration(duration)), func() {
+		if err := s.Save(); err != nil {
+			s._logger.ErrorLog(err)
+		}
+	})
+}
+
+// сохраняем снимок при остановке сервиса
+func (s *OnlineSnapshot) Close() {
+	if err := s.Save(); err != nil {
+		s._logger.ErrorLog(err)
+	}
+}
+
+func (s *OnlineSnapshot) CloseMessage() string {
+	return "Save online snapshot"
+}
+
+func (s *OnlineSnapshot) write(w io.Writer) error {
+	header := onlineSnapshotHeader{
+		SavedAt: time.Now().Unix(),
+		Hash:    constants.IDENTITY_HASH,
+	}
+
+	for name, counter := range s.counters {
+		if _, ok := counter.(OnlineSnapshotter); !ok {
+			return errors.New(fmt.Sprintf("%s: %s", constants.SNAPSHOT_NOT_SUPPORTED, name))
+		}
+
+		header.Counters = append(header.Counters, onlineSnapshotCounter{
+			Name: name,
+			Kind: counterKind(counter),
+		})
+	}
+
+	if err := gob.NewEncoder(w).Encode(header); err != nil {
+		return err
+	}
+
+	// порядок счетчиков в потоке совпадает с порядком в заголовке
+	for _, c := range header.Counters {
+		if err := s.counters[c.Name].(OnlineSnapshotter).Snapshot(w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func counterKind(counter OnlineCounter) string {
+	return fmt.Sprintf("%T", counter)
+}
+
+// сколько ждать до конца текущего окна, начавшегося в lastFlushedAt
+func untilFlush(lastFlushedAt int64, duration int64) time.Duration {
+	remaining := time.Until(time.Unix(lastFlushedAt+duration, 0))
+
+	if remaining < 0 {
+		return 0
+	}
+
+	return remaining
+}
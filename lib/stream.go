@@ -1,21 +1,36 @@
 package lib
 
 import (
+	"context"
+	"github.com/LimeHD/limehd-syslog-server/constants"
 	"sync"
 	"time"
 )
 
 type (
+	// запросы раскладываются по шардам по хэшу зрителя, у каждого шарда своя блокировка,
+	// поэтому обработчики не делят между собой ни блокировку, ни общий счетчик
+	// порядок запросов для приемников не важен
 	StreamQueue struct {
-		mt               sync.RWMutex
-		internal         []InfluxRequestParams
+		shards           []*streamShard
 		scheduleCallback func(s *StreamQueue)
 	}
+
+	streamShard struct {
+		mt       sync.Mutex
+		internal []InfluxRequestParams
+	}
 )
 
 func NewStream() *StreamQueue {
 	s := new(StreamQueue)
-	s.internal = []InfluxRequestParams{}
+	s.shards = make([]*streamShard, constants.AGGREGATION_SHARDS)
+
+	for index := range s.shards {
+		s.shards[index] = &streamShard{
+			internal: []InfluxRequestParams{},
+		}
+	}
 
 	return s
 }
@@ -24,29 +39,63 @@ func (s *StreamQueue) SetScheduleHandler(handler func(s *StreamQueue)) {
 	s.scheduleCallback = handler
 }
 
-func (s *StreamQueue) Add(item InfluxRequestParams) {
-	s.mt.Lock()
-	s.internal = append(s.internal, item)
-	s.mt.Unlock()
+func (s *StreamQueue) Add(i UniqueIdentity, item InfluxRequestParams) {
+	shard := s.shards[i.Hash()%uint64(len(s.shards))]
+
+	shard.mt.Lock()
+	shard.internal = append(shard.internal, item)
+	shard.mt.Unlock()
 }
 
 func (s *StreamQueue) All() []InfluxRequestParams {
-	s.mt.Lock()
-	defer s.mt.Unlock()
-	return s.internal
+	all := make([]InfluxRequestParams, 0, s.Len())
+
+	for _, shard := range s.shards {
+		shard.mt.Lock()
+		all = append(all, shard.internal...)
+		shard.mt.Unlock()
+	}
+
+	return all
 }
 
-func (s *StreamQueue) Flush() {
-	s.mt.Lock()
-	s.internal = []InfluxRequestParams{}
-	s.mt.Unlock()
+func (s *StreamQueue) Len() int {
+	total := 0
+
+	for _, shard := range s.shards {
+		shard.mt.Lock()
+		total += len(shard.internal)
+		shard.mt.Unlock()
+	}
+
+	return total
 }
 
-func (s *StreamQueue) Scheduler(duration int) {
-schedule:
-	time.Sleep(time.Second * time.Duration(duration))
+// забирает накопленные запросы и начинает новое накопление,
+// каждый шард меняется под своей блокировкой, поэтому запросы, добавленные в это время, не теряются
+func (s *StreamQueue) Collect() []InfluxRequestParams {
+	all := make([]InfluxRequestParams, 0, s.Len())
 
-	s.scheduleCallback(s)
+	for _, shard := range s.shards {
+		shard.mt.Lock()
+		all = append(all, shard.internal...)
+		shard.internal = []InfluxRequestParams{}
+		shard.mt.Unlock()
+	}
+
+	return all
+}
+
+func (s *StreamQueue) Flush() {
+	for _, shard := range s.shards {
+		shard.mt.Lock()
+		shard.internal = []InfluxRequestParams{}
+		shard.mt.Unlock()
+	}
+}
 
-	goto schedule
+func (s *StreamQueue) Scheduler(ctx context.Context, duration int) error {
+	return runEvery(ctx, every(time.Second*time.Duration(duration)), func() {
+		s.scheduleCallback(s)
+	})
 }
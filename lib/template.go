@@ -43,7 +43,7 @@ func (t Template) valueOf(key string, from []string) string {
 		return ""
 	}
 	// существует ли такой индекс в слайсе
-	if len(from) >= pos {
+	if pos < len(from) {
 		return from[pos]
 	}
 	return ""
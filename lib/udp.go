@@ -0,0 +1,261 @@
+package lib
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/LimeHD/limehd-syslog-server/constants"
+	"gopkg.in/mcuadros/go-syslog.v2"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// максимальный размер датаграммы, как у go-syslog
+const UDP_DATAGRAM_SIZE = 64 * 1024
+
+type (
+	// Прием syslog по UDP через несколько сокетов на одном порту (SO_REUSEPORT):
+	// ядро распределяет датаграммы между сокетами, каждый сокет читается своим потоком пачками (recvmmsg),
+	// разобранные сообщения попадают в тот же канал, что и у go-syslog, поэтому пул не меняется
+	UdpIngest struct {
+		config  UdpIngestConfig
+		conns   []*net.UDPConn
+		wg      *sync.WaitGroup
+		metrics *PipelineMetrics
+		// считается на каждую датаграмму, поэтому берется один раз
+		datagrams *MetricCounter
+		_logger   Logger
+	}
+
+	UdpIngestConfig struct {
+		Address string
+		// количество сокетов и потоков чтения
+		Sockets int
+		// размер приемного буфера каждого сокета в байтах (SO_RCVBUF), 0 - по умолчанию ядра
+		ReadBuffer int
+		// сколько датаграмм читается одним системным вызовом
+		BatchSize int
+		Metrics   *PipelineMetrics
+		Logger    Logger
+	}
+
+	// состояние UDP сокетов порта по данным ядра (/proc/net/udp)
+	UdpSocketStats struct {
+		Sockets int
+		// байт в приемных буферах, еще не прочитанных сервисом
+		RxQueue int64
+		// датаграммы, отброшенные ядром из-за переполнения приемного буфера
+		Drops int64
+	}
+)
+
+func NewUdpIngest(config UdpIngestConfig) *UdpIngest {
+	u := &UdpIngest{
+		config:  config,
+		wg:      &sync.WaitGroup{},
+		metrics: config.Metrics,
+		_logger: config.Logger,
+	}
+
+	if u.config.BatchSize <= 0 {
+		u.config.BatchSize = 1
+	}
+
+	if u.metrics == nil {
+		u.metrics = NewPipelineMetrics()
+	}
+
+	u.datagrams = u.metrics.Counter("udp_datagrams")
+
+	return u
+}
+
+// открывает сокеты, если порт не указан - остальные сокеты открываются на порту, выбранном для первого
+func (u *UdpIngest) Listen() error {
+	address := u.config.Address
+
+	for i := 0; i < u.config.Sockets; i++ {
+		conn, err := listenReusePort(address, u.config.ReadBuffer)
+
+		if err != nil {
+			u.Close()
+			return err
+		}
+
+		address = conn.LocalAddr().String()
+		u.conns = append(u.conns, conn)
+	}
+
+	return nil
+}
+
+// адрес, на котором открыты сокеты
+func (u *UdpIngest) Addr() net.Addr {
+	if len(u.conns) == 0 {
+		return nil
+	}
+
+	return u.conns[0].LocalAddr()
+}
+
+// запускает чтение каждого сокета в отдельном потоке, потоки завершаются после Close
+func (u *UdpIngest) Run(channel syslog.LogPartsChannel) {
+	for _, conn := range u.conns {
+		u.wg.Add(1)
+
+		go func(conn *net.UDPConn) {
+			defer u.wg.Done()
+
+			err := u.receive(conn, func(line []byte, client string) {
+				u.handle(channel, line, client)
+			})
+
+			if err != nil && !isClosedConn(err) {
+				u._logger.ErrorLog(err)
+			}
+		}(conn)
+	}
+}
+
+func (u *UdpIngest) Close() {
+	for _, conn := range u.conns {
+		_ = conn.Close()
+	}
+}
+
+// ожидает завершения потоков чтения, после этого канал можно закрывать
+func (u *UdpIngest) Wait() {
+	u.wg.Wait()
+}
+
+// разбирает датаграмму так же, как go-syslog в формате RFC3164
+func (u *UdpIngest) handle(channel syslog.LogPartsChannel, line []byte, client string) {
+	// управляющие символы и NUL в конце не нужны
+	n := len(line)
+	for ; n > 0 && line[n-1] < 32; n-- {
+	}
+
+	if n == 0 {
+		return
+	}
+
+	u.datagrams.Inc()
+
+	parser := syslog.RFC3164.GetParser(line[:n])
+
+	if err := parser.Parse(); err != nil {
+		u.metrics.Inc("udp_parse_errors")
+	}
+
+	parts := parser.Dump()
+	parts["client"] = client
+
+	// адрес отправителя без порта, в том числе IPv6: [::1]:514
+	if parts["hostname"] == "" {
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			parts["hostname"] = host
+		} else {
+			parts["hostname"] = client
+		}
+	}
+
+	parts["tls_peer"] = ""
+
+	channel <- parts
+}
+
+// состояние сокетов порта по /proc/net/udp и /proc/net/udp6, вместо netstat -suna
+func ReadUdpStats(port int) (UdpSocketStats, error) {
+	total := UdpSocketStats{}
+	found := false
+
+	for _, path := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		file, err := os.Open(path)
+
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return total, err
+		}
+
+		stats, err := ParseProcNetUdp(file, port)
+		_ = file.Close()
+
+		if err != nil {
+			return total, err
+		}
+
+		found = true
+		total.Sockets += stats.Sockets
+		total.RxQueue += stats.RxQueue
+		total.Drops += stats.Drops
+	}
+
+	if !found {
+		return total, errors.New(constants.UDP_STATS_NOT_AVAILABLE)
+	}
+
+	return total, nil
+}
+
+// строки формата /proc/net/udp:
+// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode ref pointer drops
+func ParseProcNetUdp(r io.Reader, port int) (UdpSocketStats, error) {
+	stats := UdpSocketStats{}
+	scanner := bufio.NewScanner(r)
+
+	// заголовок
+	scanner.Scan()
+
+	for scanner.Scan() {
+		columns := strings.Fields(scanner.Text())
+
+		if len(columns) < 13 {
+			continue
+		}
+
+		local := strings.Split(columns[1], ":")
+		localPort, err := strconv.ParseInt(local[len(local)-1], 16, 32)
+
+		if err != nil {
+			return stats, errors.New(fmt.Sprintf("%s: %s", constants.UDP_STATS_INVALID, scanner.Text()))
+		}
+
+		if int(localPort) != port {
+			continue
+		}
+
+		queues := strings.Split(columns[4], ":")
+		rxQueue, _ := strconv.ParseInt(queues[len(queues)-1], 16, 64)
+		drops, _ := strconv.ParseInt(columns[len(columns)-1], 10, 64)
+
+		stats.Sockets++
+		stats.RxQueue += rxQueue
+		stats.Drops += drops
+	}
+
+	return stats, scanner.Err()
+}
+
+// порт из адреса вида host:port
+func UdpPort(address string) int {
+	_, port, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return 0
+	}
+
+	value, _ := strconv.Atoi(port)
+
+	return value
+}
+
+func isClosedConn(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
@@ -0,0 +1,139 @@
+//go:build linux
+// +build linux
+
+package lib
+
+import (
+	"context"
+	"golang.org/x/sys/unix"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// struct mmsghdr из <sys/socket.h>, выравнивание до размера указателя делает компилятор
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+func listenReusePort(address string, readBuffer int) (*net.UDPConn, error) {
+	config := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+
+			err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+
+				if sockErr != nil || readBuffer <= 0 {
+					return
+				}
+
+				// SO_RCVBUFFORCE позволяет превысить net.core.rmem_max, но требует CAP_NET_ADMIN
+				if unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, readBuffer) != nil {
+					sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, readBuffer)
+				}
+			})
+
+			if err != nil {
+				return err
+			}
+
+			return sockErr
+		},
+	}
+
+	conn, err := config.ListenPacket(context.Background(), "udp", address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.UDPConn), nil
+}
+
+// читает датаграммы пачками через recvmmsg, пока сокет не закрыт
+func (u *UdpIngest) receive(conn *net.UDPConn, handle func(line []byte, client string)) error {
+	raw, err := conn.SyscallConn()
+
+	if err != nil {
+		return err
+	}
+
+	batch := u.config.BatchSize
+	buffers := make([][]byte, batch)
+	names := make([]unix.RawSockaddrAny, batch)
+	iovecs := make([]unix.Iovec, batch)
+	messages := make([]mmsghdr, batch)
+
+	for i := range messages {
+		buffers[i] = make([]byte, UDP_DATAGRAM_SIZE)
+		iovecs[i].Base = &buffers[i][0]
+		iovecs[i].SetLen(UDP_DATAGRAM_SIZE)
+		messages[i].hdr.Name = (*byte)(unsafe.Pointer(&names[i]))
+		messages[i].hdr.Iov = &iovecs[i]
+		messages[i].hdr.SetIovlen(1)
+	}
+
+	for {
+		var received int
+		var errno syscall.Errno
+
+		err := raw.Read(func(fd uintptr) bool {
+			for i := range messages {
+				messages[i].hdr.Namelen = unix.SizeofSockaddrAny
+				messages[i].hdr.Flags = 0
+				messages[i].len = 0
+			}
+
+			n, _, e := unix.Syscall6(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&messages[0])), uintptr(batch), 0, 0, 0)
+
+			// данных нет, ждем готовности сокета
+			if e == unix.EAGAIN {
+				return false
+			}
+
+			received, errno = int(n), e
+			return true
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if errno != 0 {
+			if errno != unix.EINTR {
+				u.metrics.Inc("udp_read_errors")
+			}
+			continue
+		}
+
+		u.metrics.Inc("udp_batches")
+
+		for i := 0; i < received; i++ {
+			handle(buffers[i][:messages[i].len], sockaddrString(&names[i]))
+		}
+	}
+}
+
+// адрес отправителя в том же виде, что и у go-syslog: ip:port
+func sockaddrString(name *unix.RawSockaddrAny) string {
+	switch name.Addr.Family {
+	case unix.AF_INET:
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(name))
+		return (&net.UDPAddr{IP: net.IP(sa.Addr[:]).To16(), Port: networkPort(sa.Port)}).String()
+	case unix.AF_INET6:
+		sa := (*unix.RawSockaddrInet6)(unsafe.Pointer(name))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa.Addr[:])
+		return (&net.UDPAddr{IP: ip, Port: networkPort(sa.Port)}).String()
+	}
+
+	return ""
+}
+
+// порт в sockaddr хранится в сетевом порядке байт
+func networkPort(port uint16) int {
+	bytes := (*[2]byte)(unsafe.Pointer(&port))
+	return int(bytes[0])<<8 | int(bytes[1])
+}
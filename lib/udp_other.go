@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package lib
+
+import (
+	"errors"
+	"github.com/LimeHD/limehd-syslog-server/constants"
+	"net"
+)
+
+func listenReusePort(address string, readBuffer int) (*net.UDPConn, error) {
+	return nil, errors.New(constants.UDP_REUSEPORT_NOT_SUPPORTED)
+}
+
+func (u *UdpIngest) receive(conn *net.UDPConn, handle func(line []byte, client string)) error {
+	return errors.New(constants.UDP_REUSEPORT_NOT_SUPPORTED)
+}
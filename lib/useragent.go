@@ -0,0 +1,230 @@
+package lib
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/LimeHD/limehd-syslog-server/constants"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const UA_RULE_FIELDS = 4
+const UA_RULE_SKIP = "-"
+const UA_RULE_COMMENT = "#"
+
+type (
+	// Определяет тип устройства, ОС и приложение по User-Agent
+	// правила проверяются по порядку, каждое поле берется из первого подходящего правила, которое его задает,
+	// правила из файла проверяются раньше встроенных, поэтому могут их переопределить
+	UserAgentClassifier struct {
+		mt        sync.RWMutex
+		rules     []userAgentRule
+		cache     map[string]DeviceInfo
+		cacheSize int
+	}
+
+	UserAgentClassifierConfig struct {
+		// файл правил в формате device_type|os|app|регулярное выражение, "-" - поле не задается
+		RulesFile string
+		// сколько различных User-Agent помнить, при переполнении кэш очищается
+		CacheSize int
+	}
+
+	DeviceInfo struct {
+		DeviceType string
+		Os         string
+		App        string
+	}
+
+	userAgentRule struct {
+		pattern *regexp.Regexp
+		info    DeviceInfo
+	}
+)
+
+// встроенные правила, порядок важен: SmartTV и приставки на Linux/Android проверяются раньше телефонов и десктопов.
+// bot ищем отдельным словом или как имя продукта (YandexBot/3.0), чтобы не задеть модели вроде CUBOT
+var userAgentRules = []string{
+	`bot|-|-|(?i)\bbots?\b|[a-z]bot/|crawl|spider|curl/|wget/|python-requests|go-http-client|zabbix|prometheus`,
+	`smarttv|webos|-|(?i)web0s|webos|netcast`,
+	`smarttv|tizen|-|(?i)tizen`,
+	`smarttv|android_tv|-|(?i)android ?tv|bravia|googletv|aft[a-z]\b`,
+	`smarttv|-|-|(?i)smart-?tv|hbbtv|viera|philipstv|vidaa`,
+	`stb|tvos|-|(?i)apple ?tv|tvos`,
+	`stb|-|-|(?i)\bstb\b|mag\d{3}|infomir|set-?top`,
+	`tablet|ios|-|(?i)ipad`,
+	`mobile|ios|-|(?i)iphone|ipod`,
+	`mobile|android|-|(?i)android`,
+	`desktop|windows|-|(?i)windows nt`,
+	`desktop|macos|-|(?i)macintosh|mac os x`,
+	`desktop|linux|-|(?i)x11|linux`,
+	`-|-|limehd|(?i)limehd`,
+	`-|-|exoplayer|(?i)exoplayer`,
+	`-|-|vlc|(?i)vlc`,
+	`-|-|kodi|(?i)kodi`,
+	`-|-|ffmpeg|(?i)lavf`,
+	`-|-|avplayer|(?i)applecoremedia`,
+	`-|-|browser|(?i)mozilla/`,
+}
+
+func NewUserAgentClassifier(config UserAgentClassifierConfig) (*UserAgentClassifier, error) {
+	c := &UserAgentClassifier{
+		cache:     map[string]DeviceInfo{},
+		cacheSize: config.CacheSize,
+	}
+
+	if len(config.RulesFile) > 0 {
+		lines, err := readUserAgentRules(config.RulesFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := c.addRules(lines); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.addRules(userAgentRules); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *UserAgentClassifier) Classify(userAgent string) DeviceInfo {
+	c.mt.RLock()
+	info, ok := c.cache[userAgent]
+	c.mt.RUnlock()
+
+	if ok {
+		return info
+	}
+
+	info = c.match(userAgent)
+
+	c.mt.Lock()
+	if c.cacheSize > 0 && len(c.cache) >= c.cacheSize {
+		c.cache = map[string]DeviceInfo{}
+	}
+	c.cache[userAgent] = info
+	c.mt.Unlock()
+
+	return info
+}
+
+func (c *UserAgentClassifier) match(userAgent string) DeviceInfo {
+	info := DeviceInfo{}
+
+	for _, rule := range c.rules {
+		if info.DeviceType != "" && info.Os != "" && info.App != "" {
+			break
+		}
+
+		if !rule.pattern.MatchString(userAgent) {
+			continue
+		}
+
+		if info.DeviceType == "" {
+			info.DeviceType = rule.info.DeviceType
+		}
+
+		if info.Os == "" {
+			info.Os = rule.info.Os
+		}
+
+		if info.App == "" {
+			info.App = rule.info.App
+		}
+	}
+
+	info.DeviceType = orUnknown(info.DeviceType)
+	info.Os = orUnknown(info.Os)
+	info.App = orUnknown(info.App)
+
+	return info
+}
+
+func (c *UserAgentClassifier) addRules(lines []string) error {
+	for _, line := range lines {
+		rule, err := newUserAgentRule(line)
+
+		if err != nil {
+			return err
+		}
+
+		c.rules = append(c.rules, rule)
+	}
+
+	return nil
+}
+
+// регулярное выражение последнее, так как само может содержать разделитель
+func newUserAgentRule(line string) (userAgentRule, error) {
+	parts := strings.SplitN(line, constants.LOG_DELIM, UA_RULE_FIELDS)
+
+	if len(parts) != UA_RULE_FIELDS {
+		return userAgentRule{}, errors.New(fmt.Sprintf("%s: %s", constants.UA_RULE_INVALID, line))
+	}
+
+	pattern, err := regexp.Compile(parts[3])
+
+	if err != nil {
+		return userAgentRule{}, errors.New(fmt.Sprintf("%s: %s", constants.UA_RULE_INVALID, err))
+	}
+
+	return userAgentRule{
+		pattern: pattern,
+		info: DeviceInfo{
+			DeviceType: ruleValue(parts[0]),
+			Os:         ruleValue(parts[1]),
+			App:        ruleValue(parts[2]),
+		},
+	}, nil
+}
+
+func readUserAgentRules(path string) ([]string, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if len(line) == 0 || strings.HasPrefix(line, UA_RULE_COMMENT) {
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines, scanner.Err()
+}
+
+func ruleValue(value string) string {
+	value = strings.TrimSpace(value)
+
+	if value == UA_RULE_SKIP {
+		return ""
+	}
+
+	return value
+}
+
+func orUnknown(value string) string {
+	if len(value) == 0 {
+		return constants.UNKNOWN
+	}
+
+	return value
+}
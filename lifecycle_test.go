@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/LimeHD/limehd-syslog-server/lib"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func _componentState(l *lib.Lifecycle, name string) string {
+	for _, h := range l.Health() {
+		if h.Name == name {
+			return h.State
+		}
+	}
+
+	return ""
+}
+
+func TestLifecycle(t *testing.T) {
+	lifecycle := lib.NewLifecycle(lib.LifecycleConfig{Logger: lib.NewFileLogger(lib.LoggerConfig{})})
+
+	var ticks int64
+	stream := lib.NewStream()
+	stream.SetScheduleHandler(func(s *lib.StreamQueue) {
+		atomic.AddInt64(&ticks, 1)
+	})
+
+	var order []string
+
+	lifecycle.Add("first", func(ctx context.Context) error {
+		<-ctx.Done()
+		order = append(order, "first")
+		return nil
+	})
+	lifecycle.Add("stream", func(ctx context.Context) error {
+		err := stream.Scheduler(ctx, 0)
+		order = append(order, "stream")
+		return err
+	})
+
+	lifecycle.Start()
+
+	time.Sleep(time.Millisecond * 20)
+
+	if atomic.LoadInt64(&ticks) == 0 {
+		t.Error("stream scheduler is not running")
+	}
+
+	if err := lifecycle.StopComponent("stream"); err != nil {
+		t.Fatal(err)
+	}
+
+	if state := _componentState(lifecycle, "stream"); state != lib.COMPONENT_STOPPED {
+		t.Errorf("expected stopped stream, got %s", state)
+	}
+
+	stopped := atomic.LoadInt64(&ticks)
+	time.Sleep(time.Millisecond * 10)
+
+	if atomic.LoadInt64(&ticks) != stopped {
+		t.Error("stopped scheduler must not tick")
+	}
+
+	if err := lifecycle.StartComponent("stream"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lifecycle.StartComponent("missing"); err == nil {
+		t.Error("expected unknown component error")
+	}
+
+	lifecycle.Stop()
+
+	// последний добавленный останавливается первым
+	if len(order) != 3 || order[1] != "stream" || order[2] != "first" {
+		t.Errorf("unexpected stop order: %v", order)
+	}
+
+	if !lifecycle.Healthy() {
+		t.Error("stopped components are healthy")
+	}
+}
+
+func TestLifecycleHealth(t *testing.T) {
+	lifecycle := lib.NewLifecycle(lib.LifecycleConfig{Logger: lib.NewFileLogger(lib.LoggerConfig{})})
+
+	lifecycle.Add("broken", func(ctx context.Context) error {
+		return errors.New("address already in use")
+	})
+
+	lifecycle.Start()
+	time.Sleep(time.Millisecond * 10)
+
+	recorder := httptest.NewRecorder()
+	lifecycle.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 for failed component, got %d", recorder.Code)
+	}
+
+	if state := _componentState(lifecycle, "broken"); state != lib.COMPONENT_FAILED {
+		t.Errorf("expected failed component, got %s", state)
+	}
+
+	lifecycle.Stop()
+}
+
+func TestLifecycleCriticalFailure(t *testing.T) {
+	lifecycle := lib.NewLifecycle(lib.LifecycleConfig{Logger: lib.NewFileLogger(lib.LoggerConfig{})})
+
+	lifecycle.Add("optional", func(ctx context.Context) error {
+		return errors.New("optional component failed")
+	})
+
+	lifecycle.Start()
+
+	select {
+	case err := <-lifecycle.Failed():
+		t.Fatalf("non-critical component must not stop the service: %v", err)
+	case <-time.After(time.Millisecond * 20):
+	}
+
+	lifecycle.AddCritical("syslog", func(ctx context.Context) error {
+		return errors.New("address already in use")
+	})
+
+	lifecycle.Start()
+
+	select {
+	case err := <-lifecycle.Failed():
+		if err.Error() != "syslog: address already in use" {
+			t.Errorf("unexpected failure %q", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("critical component failure is not reported")
+	}
+
+	lifecycle.Stop()
+
+	// остановленный критичный компонент упавшим не считается
+	lifecycle.AddCritical("stopped", func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	})
+	_ = lifecycle.StartComponent("stopped")
+	_ = lifecycle.StopComponent("stopped")
+
+	select {
+	case err := <-lifecycle.Failed():
+		t.Errorf("stopped component reported as failed: %v", err)
+	default:
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/LimeHD/limehd-syslog-server/constants"
 	"github.com/LimeHD/limehd-syslog-server/lib"
 	"math/rand"
+	"reflect"
 	"strings"
 	"sync"
 	"testing"
@@ -107,3 +108,216 @@ func TestLog(t *testing.T) {
 
 	wg.Wait()
 }
+
+// настройки разбора по шаблону из репозитория, общие для всех тестов
+func _parserConfig(t testing.TB) lib.ParserConfig {
+	template, err := lib.NewTemplate(lib.TemplateConfig{Template: "./template.conf"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return lib.ParserConfig{
+		PartsDelim:  constants.LOG_DELIM,
+		StreamDelim: constants.REQUEST_URI_DELIM,
+		Template:    template,
+	}
+}
+
+func _parsers(t testing.TB) (lib.SyslogParser, *lib.FastParser) {
+	config := _parserConfig(t)
+	return lib.NewSyslogParser(lib.NewFileLogger(lib.LoggerConfig{}), config), lib.NewFastParser(config)
+}
+
+func TestParseMalformedParts(t *testing.T) {
+	parser, fast := _parsers(t)
+
+	// обрезанная строка и значения не строкой раньше роняли обработчик:
+	// недостающие поля остаются пустыми, значения не строкой приводятся к строке
+	cases := []struct {
+		parts     map[string]interface{}
+		addr      string
+		channel   string
+		userAgent string
+		bytesSent int
+		client    string
+	}{
+		{
+			map[string]interface{}{"client": 38001, "content": "11/Aug/2020:14:01:32 +0300|1597143692.596|127.0.0.1"},
+			"127.0.0.1", constants.UNKNOWN, constants.UNKNOWN, 0, "38001",
+		},
+		{
+			map[string]interface{}{"client": "127.0.0.1:38001", "content": strings.Join(nginxLogFormatSlice[:21], "|")},
+			"127.0.0.1", "domashniy", nginxLogFormatSlice[17], 0, "127.0.0.1",
+		},
+		{
+			map[string]interface{}{"client": []byte("127.0.0.1:38001"), "content": []byte(_getNginxFormatString()), "tag": 7},
+			"127.0.0.1", "domashniy", nginxLogFormatSlice[17], 404, "127.0.0.1",
+		},
+	}
+
+	for index, c := range cases {
+		log, err := parser.Parse(c.parts)
+
+		if err != nil {
+			t.Fatalf("%d: %v", index, err)
+		}
+
+		if log.GetRemoteAddr() != c.addr || log.GetChannel() != c.channel || log.GetUserAgent() != c.userAgent ||
+			log.GetBytesSent() != c.bytesSent || log.GetClientAddr() != c.client {
+			t.Errorf("%d: unexpected log %+v", index, log)
+		}
+
+		var result lib.Log
+
+		if err := fast.Parse(c.parts, &result); err != nil {
+			t.Fatalf("%d: %v", index, err)
+		}
+
+		if !reflect.DeepEqual(log, result) {
+			t.Errorf("%d: fast parser differs:\n%+v\n%+v", index, log, result)
+		}
+	}
+
+	// пустое сообщение не разбирается
+	empty := map[string]interface{}{"client": "127.0.0.1:38001"}
+
+	if _, err := parser.Parse(empty); err == nil {
+		t.Error("expected error for empty content")
+	}
+
+	if err := fast.Parse(empty, &lib.Log{}); err == nil {
+		t.Error("expected error for empty content in fast parser")
+	}
+}
+
+func TestFastParserMatchesSyslogParser(t *testing.T) {
+	parser, fast := _parsers(t)
+
+	uris := []string{
+		"/streaming/domashniy/324/vh1w/playlist.m3u8",
+		"/streaming/muztv/324/vl2w/segment-1597220444-01972046.ts",
+		"/streaming/karusel/324/variable.m3u8",
+		"/domashniy/tracks-v1a1/2020/08/13/11/38/56-06000.ts",
+		"/karusel/tracks-v1a1/mono.m3u8",
+		"/karusel/tracks-v1-a1/mono.m3u8",
+		"/karusel/index.m3u8",
+		"/favicon.ico",
+		"",
+	}
+
+	var reused lib.Log
+
+	for _, uri := range uris {
+		line := make([]string, len(nginxLogFormatSlice))
+		copy(line, nginxLogFormatSlice)
+		line[constants.POS_URI] = uri
+
+		parts := _generateRandomParts()
+		parts["content"] = strings.Join(line, constants.LOG_DELIM)
+
+		expected, err := parser.Parse(parts)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := fast.Parse(parts, &reused); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(expected, reused) {
+			t.Errorf("%s: fast parser differs:\n%+v\n%+v", uri, expected, reused)
+		}
+	}
+}
+
+// выборка пула по полям идентификации должна выбирать того же зрителя, что и агрегация после полного разбора
+func TestIdentityParserMatchesFullParse(t *testing.T) {
+	config := _parserConfig(t)
+
+	for _, spec := range []string{constants.DEFAULT_IDENTITY, "arg:token,sent_http_x_profile,remote_addr+http_user_agent"} {
+		builder, err := lib.NewIdentityBuilder(spec)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		full := lib.NewFastParser(config)
+		partial := lib.NewFastParser(config, builder.Fields()...)
+
+		parts := _generateRandomParts()
+		parts["content"] = strings.Replace(parts["content"].(string), "127.0.0.1", "10.0.0.1", 1)
+
+		var expected, result lib.Log
+
+		if err := full.Parse(parts, &expected); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := partial.Parse(parts, &result); err != nil {
+			t.Fatal(err)
+		}
+
+		if builder.Build(expected) != builder.Build(result) {
+			t.Errorf("%s: identity differs:\n%+v\n%+v", spec, builder.Build(expected), builder.Build(result))
+		}
+	}
+}
+
+// конвейер разбирает только нужные поля, события из такого разбора не должны отличаться от полного
+func TestPipelineFieldsCoverEvents(t *testing.T) {
+	parser, full := _parsers(t)
+	builder, _ := lib.NewIdentityBuilder(constants.DEFAULT_IDENTITY)
+	partial := lib.NewFastParser(_parserConfig(t), lib.PipelineFields(builder, true)...)
+
+	parts := _generateRandomParts()
+	expected, err := parser.Parse(parts)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fast, result lib.Log
+	_ = full.Parse(parts, &fast)
+	_ = partial.Parse(parts, &result)
+
+	if !reflect.DeepEqual(lib.NewEventRecord(lib.Receiver{Parser: expected}), lib.NewEventRecord(lib.Receiver{Parser: result})) {
+		t.Errorf("expected the same event from partial parse:\n%+v\n%+v", lib.NewEventRecord(lib.Receiver{Parser: expected}), lib.NewEventRecord(lib.Receiver{Parser: result}))
+	}
+
+	if reflect.DeepEqual(fast, result) {
+		t.Error("expected fields outside of the pipeline to be skipped")
+	}
+}
+
+// аллокации и скорость разбора одной строки: go test -run xxx -bench Parser -benchmem .
+func BenchmarkSyslogParser(b *testing.B) {
+	parser, _ := _parsers(b)
+	parts := _generateRandomParts()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(parts["content"].(string))))
+
+	for i := 0; i < b.N; i++ {
+		if _, err := parser.Parse(parts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFastParser(b *testing.B) {
+	_, fast := _parsers(b)
+	parts := _generateRandomParts()
+
+	var log lib.Log
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(parts["content"].(string))))
+
+	for i := 0; i < b.N; i++ {
+		if err := fast.Parse(parts, &log); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/LimeHD/limehd-syslog-server/constants"
@@ -21,39 +22,80 @@ func main() {
 
 	// todo вынести инициализацию всех компонентов
 	app.Action = func(c *cli.Context) error {
-		var err error
+		if err := lib.ValidateInfluxConfig(c); err != nil {
+			return err
+		}
+
+		if err := lib.ValidateClickHouseConfig(c); err != nil {
+			return err
+		}
+
+		if err := lib.ValidateIdentityConfig(c); err != nil {
+			return err
+		}
+
+		if err := lib.ValidateFilterConfig(c); err != nil {
+			return err
+		}
+
+		if err := lib.ValidateSamplerConfig(c); err != nil {
+			return err
+		}
 
 		service := lib.NewService(c)
 		logger := service.GetLogger()
 		finder := service.GetFinder()
-		influx := service.GetInfluxClient()
-		parser := service.GetParser()
+		sink := service.GetSink()
+		fastParser := service.GetFastParser()
+		identityParser := service.GetIdentityParser()
 		stream := service.GetStream()
 		online := service.GetOnline()
+		dimensions := service.GetDimensions()
+		peaks := service.GetPeaks()
+		identity := service.GetIdentity()
+		classifier := service.GetClassifier()
+		filter := service.GetFilter()
+		audience := service.GetAudience()
+		events := service.GetEvents()
+		sessions := service.GetSessions()
+		lifecycle := service.GetLifecycle()
+		metrics := service.GetMetrics()
+		sampler := service.GetSampler()
 
 		lib.StartupMessage(fmt.Sprintf("LimeHD Syslog Server v%s", version), logger)
 
-		channel := make(syslog.LogPartsChannel)
-		handler := syslog.NewChannelHandler(channel)
-		server := syslog.NewServer()
-		// RFC5424 - не подходит
-		server.SetFormat(syslog.RFC3164)
-		server.SetHandler(handler)
-		err = server.ListenUDP(c.String("bind-address"))
+		// считаются на каждый запрос, поэтому берутся один раз
+		filteredCounter := metrics.Counter("filtered")
+		sampledOutCounter := metrics.Counter("sampled_out")
 
-		if err != nil {
-			logger.ErrorLog(err)
-		}
+		aggregationCallback := func(receive lib.Receiver) error {
+			filtered := len(receive.Filtered) > 0
 
-		err = server.Boot()
+			if filtered && filter.Drops() {
+				filteredCounter.Inc()
+				return nil
+			}
 
-		if err != nil {
-			logger.ErrorLog(err)
-		}
+			unique := identity.Build(receive.Parser)
+
+			// уникальные зрители считаются по всем запросам, скетч не растет от нагрузки
+			if !filtered && audience != nil {
+				audience.Peek(unique)
+			}
+
+			// на пиках учитывается только выборка зрителей, остальное пересчитывается по доле
+			rate, sampled := sampler.SampleAt(unique, receive.SampleRate)
+
+			if !sampled {
+				sampledOutCounter.Inc()
+				return nil
+			}
+
+			// сессии и события тоже идут по выборке, поэтому помечаются долей для пересчета
+			receive.SampleRate = rate
 
-		aggregationCallback := func(receive lib.Receiver) error {
 			// трафик
-			stream.Add(lib.InfluxRequestParams{
+			stream.Add(unique, lib.InfluxRequestParams{
 				InfluxRequestTags: lib.InfluxRequestTags{
 					CountryName:  receive.Finder.GetCountryIsoCode(),
 					AsnNumber:    receive.Finder.GetOrganizationNumber(),
@@ -62,111 +104,368 @@ func main() {
 					StreamServer: receive.Parser.GetClientAddr(),
 					Host:         receive.Parser.GetStreamingServer(),
 					Quality:      receive.Parser.GetQuality(),
+					DeviceType:   receive.Device.DeviceType,
+					Os:           receive.Device.Os,
+					App:          receive.Device.App,
+					Filtered:     receive.Filtered,
+					Identity:     unique.Strategy,
 					Time:         time.Now(),
 				},
 				InfluxRequestFields: lib.InfluxRequestFields{
-					BytesSent: receive.Parser.GetBytesSent(),
+					BytesSent:  lib.ScaleSampled(receive.Parser.GetBytesSent(), rate),
+					SampleRate: rate,
 				},
 			})
 
-			// Пользователи онлайн
-			unique := lib.UniqueIdentity{
-				Channel: receive.Parser.GetChannel(),
-				UniqueCombination: lib.UniqueCombination{
-					Ip:        receive.Parser.GetRemoteAddr(),
-					UserAgent: receive.Parser.GetUserAgent(),
-				},
+			// Пользователи онлайн, роботы и мониторинг зрителями не считаются
+			if !filtered {
+				online.Peek(unique)
+
+				if peaks != nil {
+					peaks.Peek(unique)
+				}
+
+				if dimensions != nil {
+					dimensions.Peek(unique, receive)
+				}
+
+				// сессии просмотра
+				if sessions != nil {
+					sessions.Track(unique, receive)
+				}
 			}
 
-			online.Peek(unique)
+			// сырые события для архива и аналитики
+			if events != nil {
+				events.Add(unique, receive)
+			}
 
 			return nil
 		}
 
 		receiveAndParseLogsCallback := func(p format.LogParts) (lib.Receiver, error) {
-			result, err := parser.Parse(p)
+			var result lib.Log
 
-			if err != nil {
-				return lib.Receiver{}, err
+			if err := fastParser.Parse(p, &result); err != nil {
+				return lib.Receiver{}, lib.Reject("parse", err)
 			}
 
 			if !result.IsAvailableUri() {
-				return lib.Receiver{}, errors.New(fmt.Sprintf("%s: %s", constants.NOT_AVAILABLE_URI, result.GetUri()))
+				return lib.Receiver{}, lib.Reject("uri", errors.New(fmt.Sprintf("%s: %s", constants.NOT_AVAILABLE_URI, result.GetUri())))
 			}
 
 			finderResult, err := finder.Find(result.GetRemoteAddr())
 
 			if err != nil {
-				return lib.Receiver{}, err
+				return lib.Receiver{}, lib.Reject("geo", err)
 			}
 
-			return lib.Receiver{
+			receiver := lib.Receiver{
 				Parser: result,
 				Finder: finderResult,
-			}, nil
-		}
-
-		pool := lib.NewPool(
-			lib.PoolConfig{
-				ListenerCallback: aggregationCallback,
-				ReceiverCallback: receiveAndParseLogsCallback,
-				PoolSize:         c.Int("pool-size"),
-				WorkersCount:     c.Int("worker-count"),
-				SenderCount:      c.Int("sender-count"),
-				WorkerPoolSize:   c.Int("worker-pool-size"),
-				ErrorPoolSize:    c.Int("error-pool-size"),
-				WorkerFn: func(p *lib.Pool, channel syslog.LogPartsChannel) {
-					for logParts := range channel {
-						p.Task(logParts)
+				Device: classifier.Classify(result.GetUserAgent()),
+			}
+
+			if filter != nil {
+				receiver.Filtered = filter.Match(receiver)
+			}
+
+			return receiver, nil
+		}
+
+		metrics.Gauge("stream_items", func() int64 { return int64(stream.Len()) })
+		metrics.Gauge("online_channels", func() int64 { return int64(online.Count()) })
+
+		// потери в приемных буферах ядра, которые раньше смотрели через netstat -suna
+		if port := lib.UdpPort(c.String("bind-address")); port > 0 {
+			if _, err := lib.ReadUdpStats(port); err == nil {
+				metrics.Gauges(func() map[string]int64 {
+					stats, _ := lib.ReadUdpStats(port)
+
+					return map[string]int64{
+						"udp_drops":    stats.Drops,
+						"udp_rx_queue": stats.RxQueue,
 					}
-				},
-				ErrorHandleCallback: func(err error) {
-					logger.ErrorLog(err)
-				},
-				ErrorHandlerCount: c.Int("error-handler-count"),
+				})
+			}
+		}
+
+		if sessions != nil {
+			metrics.Gauge("sessions_open", func() int64 { return int64(sessions.Open()) })
+		}
+
+		if err := lib.ValidateOverflowPolicy(c.String("pool-overflow"), c.Float64("pool-sample-rate")); err != nil {
+			return err
+		}
+
+		// очереди ограничены памятью, явно указанные размеры важнее
+		poolSize, workerPoolSize, errorPoolSize := lib.PoolQueueSizes(c.Int64("pool-memory-limit") * 1024 * 1024)
+
+		if c.Int("pool-size") > 0 {
+			poolSize = c.Int("pool-size")
+		}
+
+		if c.Int("worker-pool-size") > 0 {
+			workerPoolSize = c.Int("worker-pool-size")
+		}
+
+		if c.Int("error-pool-size") > 0 {
+			errorPoolSize = c.Int("error-pool-size")
+		}
+
+		poolConfig := lib.PoolConfig{
+			ListenerCallback: aggregationCallback,
+			ReceiverCallback: receiveAndParseLogsCallback,
+			PoolSize:         poolSize,
+			WorkersCount:     c.Int("worker-count"),
+			SenderCount:      c.Int("sender-count"),
+			WorkerPoolSize:   workerPoolSize,
+			ErrorPoolSize:    errorPoolSize,
+			OverflowPolicy:   c.String("pool-overflow"),
+			SampleRate:       c.Float64("pool-sample-rate"),
+			Sampler:          sampler,
+			SampleIdentity: func(p format.LogParts) lib.UniqueIdentity {
+				var result lib.Log
+
+				// при ошибке зритель определяется по ip и user-agent, такой лог все равно будет отклонен при разборе
+				_ = identityParser.Parse(p, &result)
+
+				return identity.Build(result)
+			},
+			Quarantine: service.GetQuarantine(),
+			WorkerFn: func(p *lib.Pool, channel syslog.LogPartsChannel) {
+				for logParts := range channel {
+					p.Task(logParts)
+				}
+			},
+			ErrorHandleCallback: func(err error) {
+				logger.ErrorLog(err)
 			},
-		)
+			ErrorHandlerCount: c.Int("error-handler-count"),
+			Metrics:           metrics,
+		}
+
+		onlineHandler := func(o lib.OnlineCounter) {
+			defer metrics.Since("flush_online", time.Now())
 
-		online.SetScheduleHandler(func(o *lib.Online) {
 			// запрашиваем агрегацию
 			channelConnections := o.Connections()
 			// передаем управление
 			o.Flush()
 
-			err := influx.PointOnline(lib.InfluxOnlineRequestParams{
-				Channels: channelConnections,
-			})
+			var channelPeaks map[string]lib.OnlinePeak
+			var totalPeak lib.OnlinePeak
+
+			if peaks != nil {
+				// последний, неполный интервал окна тоже может оказаться пиком
+				peaks.Sample(time.Now())
+				channelPeaks = peaks.Channels()
+				totalPeak = peaks.Total()
+				peaks.Flush()
+			}
+
+			total := 0
+			for _, channel := range channelConnections {
+				total += channel.Count()
+			}
+
+			var dimensionConnections []lib.OnlineDimensionConnections
+
+			if dimensions != nil {
+				dimensionConnections = dimensions.Connections()
+				dimensions.Flush()
+			}
+
+			err := sink.WriteOnline(sampler.ScaleOnline(lib.InfluxOnlineRequestParams{
+				Channels:   channelConnections,
+				Dimensions: dimensionConnections,
+				Total:      total,
+				Peaks:      channelPeaks,
+				TotalPeak:  totalPeak,
+			}))
 
 			if err != nil {
 				logger.ErrorLog(err)
 			}
 
 			logger.InfoLog("The online scheduler did its job successfully!")
-		})
+		}
 
-		stream.SetScheduleHandler(func(s *lib.StreamQueue) {
-			// аолучаем накопленные данные
-			streams := s.All()
-			// отдаем управление для нового накопления
-			s.Flush()
+		streamHandler := func(s *lib.StreamQueue) {
+			defer metrics.Since("flush_stream", time.Now())
 
-			if err := influx.Point(streams); err != nil {
+			// получаем накопленные данные и отдаем управление для нового накопления
+			streams := s.Collect()
+
+			if err := sink.WriteTraffic(streams); err != nil {
 				logger.ErrorLog(err)
 			}
 
+			if filter != nil {
+				logger.InfoLog(fmt.Sprintf("Filtered requests by rule: %v", filter.Counters()))
+			}
+
 			logger.InfoLog("The stream scheduler did its job successfully!")
+		}
+
+		sessionsHandler := func(s *lib.SessionTracker) {
+			defer metrics.Since("flush_sessions", time.Now())
+
+			// закрываем простаивающие сессии
+			s.Sweep()
+			report := s.Collect()
+
+			if err := sink.WriteSessions(report); err != nil {
+				logger.ErrorLog(err)
+			}
+
+			logger.InfoLog(fmt.Sprintf("The session scheduler closed %d sessions, %d are still open", len(report.Records), s.Open()))
+		}
+
+		eventsHandler := func(e *lib.EventQueue) {
+			defer metrics.Since("flush_events", time.Now())
+
+			batch := e.Collect()
+
+			if err := sink.WriteEvents(batch); err != nil {
+				logger.ErrorLog(err)
+			}
+		}
+
+		online.SetScheduleHandler(onlineHandler)
+		stream.SetScheduleHandler(streamHandler)
+
+		// компоненты останавливаются в обратном порядке: сначала прием логов, HTTP сервер - последним
+		if httpServer := service.GetHttpServer(); httpServer != nil {
+			lifecycle.Add("http", httpServer.Run)
+		}
+
+		if sessions != nil {
+			sessions.SetScheduleHandler(sessionsHandler)
+
+			lifecycle.Add("sessions", func(ctx context.Context) error {
+				return sessions.Scheduler(ctx, c.Int64("session-duration"))
+			})
+		}
+
+		if events != nil {
+			events.SetScheduleHandler(eventsHandler)
+
+			lifecycle.Add("events", func(ctx context.Context) error {
+				return events.Scheduler(ctx, c.Int("stream-duration"))
+			})
+		}
+
+		lifecycle.Add("online", func(ctx context.Context) error {
+			return online.Scheduler(ctx, service.GetOnlineInterval())
+		})
+
+		if peaks != nil {
+			lifecycle.Add("peaks", func(ctx context.Context) error {
+				return peaks.Sampler(ctx, c.Int64("online-peak-interval"))
+			})
+		}
+
+		if audience != nil {
+			audience.SetScheduleHandler(func(report lib.AudienceReport) {
+				if err := sink.WriteAudience(report); err != nil {
+					logger.ErrorLog(err)
+				}
+
+				logger.InfoLog(fmt.Sprintf("The audience for the %s since %s is %d unique viewers", report.Period, report.Start.Format("2006-01-02"), report.Total))
+			})
+
+			lifecycle.Add("audience", func(ctx context.Context) error {
+				return audience.Scheduler(ctx, c.Int64("audience-interval"))
+			})
+		}
+
+		if snapshot := service.GetSnapshot(); snapshot != nil {
+			lifecycle.Add("snapshot", func(ctx context.Context) error {
+				return snapshot.Scheduler(ctx, c.Int64("online-snapshot-interval"))
+			})
+		}
+
+		if interval := c.Int64("metrics-interval"); interval > 0 {
+			metrics.SetScheduleHandler(func(snapshot lib.MetricsSnapshot) {
+				if err := sink.WriteMetrics(snapshot); err != nil {
+					logger.ErrorLog(err)
+				}
+			})
+
+			lifecycle.Add("metrics", func(ctx context.Context) error {
+				return metrics.Scheduler(ctx, interval)
+			})
+		}
+
+		lifecycle.Add("stream", func(ctx context.Context) error {
+			return stream.Scheduler(ctx, c.Int("stream-duration"))
 		})
 
-		go online.Scheduler(c.Int64("online-duration"))
-		go stream.Scheduler(c.Int("stream-duration"))
+		// прием логов: при остановке закрываем слушателей и дорабатываем то, что уже принято
+		// пул после остановки не переиспользуется, при повторном запуске создается новый
+		lifecycle.AddCritical("syslog", func(ctx context.Context) error {
+			channel := make(syslog.LogPartsChannel)
+			stop, err := listenSyslog(c, channel, metrics, logger)
+
+			if err != nil {
+				return err
+			}
 
-		go func(channel syslog.LogPartsChannel) {
+			pool := lib.NewPool(poolConfig)
 			pool.Run(channel, c.Int("max-parallel"))
-		}(channel)
 
-		server.Wait()
+			<-ctx.Done()
+
+			stop()
+
+			// новых логов больше не будет
+			close(channel)
+			drained := pool.Drain(time.Second * time.Duration(c.Int64("shutdown-timeout")))
+			logger.InfoLog(fmt.Sprintf("The pool is drained: %d requests processed, %d lost", drained.Flushed, drained.Lost))
+
+			return nil
+		})
+
+		ctx, stop := context.WithCancel(context.Background())
+		lib.Notifier(stop)
+
+		lifecycle.Start()
+
+		// без приема логов работать дальше нет смысла: останавливаемся так же, как по сигналу, и выходим с ошибкой
+		var failure error
+
+		select {
+		case <-ctx.Done():
+		case failure = <-lifecycle.Failed():
+			stop()
+		}
+
+		lifecycle.Stop()
+
+		traffic := stream.Len()
+		streamHandler(stream)
+
+		// при сохранении снимка окно продолжится после запуска, иначе отправляем неполное окно
+		if service.GetSnapshot() == nil {
+			onlineHandler(online)
+		}
+
+		if sessions != nil {
+			sessions.CloseAll()
+			sessionsHandler(sessions)
+		}
+
+		if events != nil {
+			eventsHandler(events)
+		}
 
-		return err
+		logger.InfoLog(fmt.Sprintf("The final flush sent %d traffic items to %d sinks", traffic, sink.Len()))
+
+		// приемники дожидаются отправки своих очередей, логгер закрывается последним
+		service.Close()
+
+		return failure
 	}
 
 	err := app.Run(os.Args)
@@ -174,5 +473,53 @@ func main() {
 	if err != nil {
 		// todo signal notify
 		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// открывает прием syslog по UDP: один сокет go-syslog или несколько сокетов с SO_REUSEPORT,
+// возвращает функцию остановки, после которой в канал больше ничего не пишется
+func listenSyslog(c *cli.Context, channel syslog.LogPartsChannel, metrics *lib.PipelineMetrics, logger lib.Logger) (func(), error) {
+	if sockets := c.Int("udp-sockets"); sockets > 0 {
+		ingest := lib.NewUdpIngest(lib.UdpIngestConfig{
+			Address:    c.String("bind-address"),
+			Sockets:    sockets,
+			ReadBuffer: c.Int("udp-read-buffer"),
+			BatchSize:  c.Int("udp-batch-size"),
+			Metrics:    metrics,
+			Logger:     logger,
+		})
+
+		if err := ingest.Listen(); err != nil {
+			return nil, err
+		}
+
+		ingest.Run(channel)
+
+		return func() {
+			ingest.Close()
+			ingest.Wait()
+		}, nil
 	}
+
+	server := syslog.NewServer()
+	// RFC5424 - не подходит
+	server.SetFormat(syslog.RFC3164)
+	server.SetHandler(syslog.NewChannelHandler(channel))
+
+	if err := server.ListenUDP(c.String("bind-address")); err != nil {
+		return nil, err
+	}
+
+	if err := server.Boot(); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		if err := server.Kill(); err != nil {
+			logger.ErrorLog(err)
+		}
+
+		server.Wait()
+	}, nil
 }
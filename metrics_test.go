@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"github.com/LimeHD/limehd-syslog-server/lib"
+	"gopkg.in/mcuadros/go-syslog.v2"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+	"testing"
+	"time"
+)
+
+func TestPipelineMetrics(t *testing.T) {
+	metrics := lib.NewPipelineMetrics()
+
+	pool := lib.NewPool(lib.PoolConfig{
+		ListenerCallback: func(q lib.Receiver) error {
+			return nil
+		},
+		ReceiverCallback: func(p format.LogParts) (lib.Receiver, error) {
+			if _, ok := p["reject"]; ok {
+				return lib.Receiver{}, lib.Reject("uri", errors.New("not available uri"))
+			}
+			return lib.Receiver{}, nil
+		},
+		ErrorHandleCallback: func(err error) {},
+		PoolSize:            10,
+		WorkerPoolSize:      10,
+		ErrorPoolSize:       10,
+		WorkersCount:        2,
+		ErrorHandlerCount:   1,
+		WorkerFn: func(p *lib.Pool, channel syslog.LogPartsChannel) {
+			for logParts := range channel {
+				p.Task(logParts)
+			}
+		},
+		Metrics: metrics,
+	})
+
+	channel := make(syslog.LogPartsChannel, 100)
+	pool.Run(channel, 1)
+
+	for i := 0; i < 100; i++ {
+		parts := format.LogParts{}
+
+		if i%4 == 0 {
+			parts["reject"] = true
+		}
+
+		channel <- parts
+	}
+	close(channel)
+
+	pool.Drain(time.Second * 5)
+
+	snapshot := metrics.Snapshot()
+	expected := map[string]int64{
+		"received":     100,
+		"parsed":       75,
+		"processed":    75,
+		"rejected_uri": 25,
+	}
+
+	for name, value := range expected {
+		if snapshot.Counters[name] != value {
+			t.Errorf("%s: expected %d, got %d", name, value, snapshot.Counters[name])
+		}
+	}
+
+	if _, ok := snapshot.Gauges["queue_tasks"]; !ok {
+		t.Error("expected task queue length gauge")
+	}
+
+	if snapshot.Timings["parse"].Count != 100 {
+		t.Errorf("expected 100 parse timings, got %d", snapshot.Timings["parse"].Count)
+	}
+
+	// тайминги считаются за интервал, счетчики - с момента запуска
+	if collected := metrics.Collect(); collected.Timings["parse"].Count != 100 {
+		t.Errorf("expected 100 collected parse timings, got %d", collected.Timings["parse"].Count)
+	}
+
+	snapshot = metrics.Snapshot()
+
+	if len(snapshot.Timings) != 0 || snapshot.Counters["received"] != 100 {
+		t.Errorf("unexpected snapshot after collect: %+v", snapshot)
+	}
+}
+
+func TestPipelineMetricsCollectDoesNotLoseTimings(t *testing.T) {
+	metrics := lib.NewPipelineMetrics()
+	timing := metrics.Timing("parse")
+	counter := metrics.Counter("parsed")
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100000; i++ {
+			timing.Observe(time.Millisecond)
+			counter.Inc()
+		}
+		close(done)
+	}()
+
+	var observed int64
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+
+		observed += metrics.Collect().Timings["parse"].Count
+	}
+
+	if observed != 100000 || metrics.Snapshot().Counters["parsed"] != 100000 {
+		t.Errorf("expected 100000 timings and counters, got %d and %d", observed, metrics.Snapshot().Counters["parsed"])
+	}
+}
+
+func BenchmarkPipelineMetrics(b *testing.B) {
+	metrics := lib.NewPipelineMetrics()
+
+	b.Run("by-name", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				metrics.Inc("received")
+				metrics.Observe("parse", time.Millisecond)
+			}
+		})
+	})
+
+	b.Run("handle", func(b *testing.B) {
+		received := metrics.Counter("received")
+		parse := metrics.Timing("parse")
+
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				received.Inc()
+				parse.Observe(time.Millisecond)
+			}
+		})
+	})
+}
+
+func TestPipelineMetricsGaugeGroup(t *testing.T) {
+	metrics := lib.NewPipelineMetrics()
+	reads := 0
+
+	metrics.Gauges(func() map[string]int64 {
+		reads++
+		return map[string]int64{"udp_drops": 3, "udp_rx_queue": 512}
+	})
+
+	snapshot := metrics.Snapshot()
+
+	if reads != 1 || snapshot.Gauges["udp_drops"] != 3 || snapshot.Gauges["udp_rx_queue"] != 512 {
+		t.Errorf("expected both gauges from one read, got %d reads and %v", reads, snapshot.Gauges)
+	}
+}
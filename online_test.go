@@ -0,0 +1,377 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"github.com/LimeHD/limehd-syslog-server/constants"
+	"github.com/LimeHD/limehd-syslog-server/lib"
+	"hash/fnv"
+	"math"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func _identity(channel string, i int) lib.UniqueIdentity {
+	return lib.UniqueIdentity{
+		Channel: channel,
+		UniqueCombination: lib.UniqueCombination{
+			Ip:        fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff),
+			UserAgent: "Mozilla/5.0 (Web0S; Linux/SmartTV)",
+		},
+	}
+}
+
+func TestHyperLogLogOnline(t *testing.T) {
+	exact := lib.NewOnlineExact()
+	hll, err := lib.NewHyperLogLogOnline(14)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	viewers := map[string]int{"domashniy": 50000, "karusel": 300}
+
+	for channel, count := range viewers {
+		for i := 0; i < count; i++ {
+			// каждый зритель запрашивает несколько сегментов
+			for segment := 0; segment < 3; segment++ {
+				exact.Peek(_identity(channel, i))
+				hll.Peek(_identity(channel, i))
+			}
+		}
+	}
+
+	estimates := hll.Connections()
+
+	for channel, counter := range exact.Connections() {
+		if counter.Count() != viewers[channel] {
+			t.Errorf("exact counter for %s: %d != %d", channel, counter.Count(), viewers[channel])
+		}
+
+		deviation := math.Abs(float64(estimates[channel].Count()-viewers[channel])) / float64(viewers[channel])
+
+		if deviation > 0.03 {
+			t.Errorf("hyperloglog estimate for %s is %d, expected ~%d", channel, estimates[channel].Count(), viewers[channel])
+		}
+	}
+
+	if top := hll.Top(1); len(top) != 1 {
+		t.Errorf("expected one channel in top, got %d", len(top))
+	}
+
+	hll.Flush()
+
+	if hll.Total() != 0 {
+		t.Error("flush must reset sketches")
+	}
+
+	if _, err := lib.NewHyperLogLogOnline(20); err == nil {
+		t.Error("precision above 18 must be rejected")
+	}
+}
+
+// splitmix64, равномерно распределенные хеши для скетча
+func _mix(x uint64) uint64 {
+	x += 0x9E3779B97F4A7C15
+	x = (x ^ (x >> 30)) * 0xBF58476D1CE4E5B9
+	x = (x ^ (x >> 27)) * 0x94D049BB133111EB
+	return x ^ (x >> 31)
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	a, _ := lib.NewHyperLogLog(12)
+	b, _ := lib.NewHyperLogLog(12)
+
+	for i := uint64(0); i < 1000; i++ {
+		a.Add(_mix(i))
+		b.Add(_mix(i + 500))
+	}
+
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if count := a.Count(); math.Abs(float64(count-1500)) > 45 {
+		t.Errorf("merged estimate %d, expected ~1500", count)
+	}
+
+	c, _ := lib.NewHyperLogLog(10)
+
+	if err := a.Merge(c); err == nil {
+		t.Error("sketches with different precision must not be merged")
+	}
+}
+
+func TestHyperLogLogPrecision(t *testing.T) {
+	// 260 при приведении к uint8 превращается в 4 и прошло бы проверку скетча
+	for _, value := range []int{-1, 3, 19, 260} {
+		if _, err := lib.HyperLogLogPrecision(value); err == nil {
+			t.Errorf("expected precision %d to be rejected", value)
+		}
+	}
+
+	if precision, err := lib.HyperLogLogPrecision(14); err != nil || precision != 14 {
+		t.Errorf("expected precision 14, got %d (%v)", precision, err)
+	}
+}
+
+func TestSlidingOnline(t *testing.T) {
+	online := lib.NewSlidingOnline(1)
+
+	online.Peek(_identity("domashniy", 1))
+	online.Peek(_identity("domashniy", 2))
+	online.Peek(_identity("karusel", 1))
+
+	// Flush не сбрасывает пользователей, которые еще в окне
+	online.Flush()
+
+	if total := online.Total(); total != 3 {
+		t.Fatalf("expected 3 viewers inside the window, got %d", total)
+	}
+
+	time.Sleep(time.Millisecond * 2100)
+	online.Peek(_identity("domashniy", 2))
+	online.Flush()
+
+	connections := online.Connections()
+
+	if len(connections) != 1 || connections["domashniy"].Count() != 1 {
+		t.Errorf("stale viewers must be evicted, got %v", online)
+	}
+}
+
+func TestDimensionalOnline(t *testing.T) {
+	dimensions, err := lib.NewDimensionalOnline(lib.DimensionalOnlineConfig{
+		Dimensions: []string{"quality"},
+		CounterFactory: func() (lib.OnlineCounter, error) {
+			return lib.NewOnlineExact(), nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	low := lib.Receiver{Parser: _parseUri(t, "/streaming/muztv/324/vl2w/segment-1597220444-01972046.ts")}
+	high := lib.Receiver{Parser: _parseUri(t, "/streaming/muztv/324/vh1w/segment-1597220444-01972046.ts")}
+
+	dimensions.Peek(_identity("muztv", 1), low)
+	dimensions.Peek(_identity("muztv", 1), low)
+	dimensions.Peek(_identity("muztv", 2), low)
+	dimensions.Peek(_identity("muztv", 3), high)
+
+	connections := dimensions.Connections()
+
+	if len(connections) != 1 || connections[0].Name != "quality" {
+		t.Fatalf("unexpected dimensions %+v", connections)
+	}
+
+	qualities := connections[0].Channels["muztv"]
+
+	if qualities["vl2w"].Count() != 2 || qualities["vh1w"].Count() != 1 {
+		t.Errorf("unexpected viewers per quality: vl2w=%d vh1w=%d", qualities["vl2w"].Count(), qualities["vh1w"].Count())
+	}
+
+	_, err = lib.NewDimensionalOnline(lib.DimensionalOnlineConfig{
+		Dimensions: []string{"user_agent"},
+		CounterFactory: func() (lib.OnlineCounter, error) {
+			return lib.NewOnlineExact(), nil
+		},
+	})
+
+	if err == nil {
+		t.Error("unknown dimensions must be rejected")
+	}
+}
+
+func TestOnlinePeaks(t *testing.T) {
+	online := lib.NewOnlineExact()
+	peaks := lib.NewOnlinePeaks(lib.OnlinePeaksConfig{
+		CounterFactory: func() lib.OnlineCounter {
+			return lib.NewOnlineExact()
+		},
+	})
+	first := time.Unix(1597143692, 0)
+
+	peek := func(channel string, i int) {
+		online.Peek(_identity(channel, i))
+		peaks.Peek(_identity(channel, i))
+	}
+
+	// первый интервал: 5 зрителей domashniy и 1 karusel
+	for i := 0; i < 5; i++ {
+		peek("domashniy", i)
+	}
+	peek("karusel", 1)
+	peaks.Sample(first)
+
+	// второй интервал: часть зрителей ушла, зато пришли новые на karusel
+	peek("domashniy", 0)
+	for i := 1; i < 4; i++ {
+		peek("karusel", i)
+	}
+	peaks.Sample(first.Add(time.Minute))
+
+	// онлайн окна за окно только растет и пика не показывает
+	if online.Total() != 8 {
+		t.Errorf("unexpected window online %d", online.Total())
+	}
+
+	if peak := peaks.Channels()["domashniy"]; peak.Value != 5 || !peak.At.Equal(first) {
+		t.Errorf("unexpected channel peak %+v", peak)
+	}
+
+	if peak := peaks.Channels()["karusel"]; peak.Value != 3 || !peak.At.Equal(first.Add(time.Minute)) {
+		t.Errorf("unexpected channel peak %+v", peak)
+	}
+
+	if peak := peaks.Total(); peak.Value != 6 || !peak.At.Equal(first) {
+		t.Errorf("unexpected total peak %+v", peak)
+	}
+
+	peaks.Flush()
+
+	if len(peaks.Channels()) != 0 || peaks.Total().Value != 0 {
+		t.Error("flush must reset peaks")
+	}
+
+	// интервал начинается с нуля после каждого среза
+	peaks.Sample(first.Add(time.Minute * 2))
+
+	if peak := peaks.Total(); peak.Value != 0 {
+		t.Errorf("closed interval leaked into the next one: %+v", peak)
+	}
+}
+
+func TestIdentityHashCollisions(t *testing.T) {
+	seen := make(map[uint64]int, 1000000)
+
+	for i := 0; i < 1000000; i++ {
+		hash := _identity("karusel", i).Hash()
+
+		if j, ok := seen[hash]; ok {
+			t.Fatalf("Identities %d and %d have the same hash %x", j, i, hash)
+		}
+		seen[hash] = i
+	}
+
+	// разделитель между полями: "ab" + "c" и "a" + "bc" - разные зрители
+	a := lib.UniqueCombination{Ip: "ab", UserAgent: "c"}
+	b := lib.UniqueCombination{Ip: "a", UserAgent: "bc"}
+
+	if (lib.UniqueIdentity{UniqueCombination: a}).Hash() == (lib.UniqueIdentity{UniqueCombination: b}).Hash() {
+		t.Fatal("Identity fields are not separated in hash")
+	}
+}
+
+// хэш зрителя - FNV-1a 64 из hash/fnv, перемешанный финализатором splitmix64
+// известные значения закреплены: их изменение делает несовместимыми снимки онлайна и аудитории
+func TestIdentityHashKnownAnswer(t *testing.T) {
+	key := lib.UniqueIdentity{Key: "0|token"}
+	pair := lib.UniqueIdentity{UniqueCombination: lib.UniqueCombination{Ip: "83.219.236.137", UserAgent: "Mozilla/5.0"}}
+
+	if key.Hash() != 0x7f94e7b208bd262f || pair.Hash() != 0x416c181612ca346a {
+		t.Fatalf("identity hash changed: %#x, %#x, bump constants.IDENTITY_HASH", key.Hash(), pair.Hash())
+	}
+
+	if constants.IDENTITY_HASH != "fnv1a-mix64" {
+		t.Errorf("unexpected identity hash version %s", constants.IDENTITY_HASH)
+	}
+
+	for _, i := range []lib.UniqueIdentity{key, pair, _identity("karusel", 12345), {Key: ""}} {
+		h := fnv.New64a()
+
+		if len(i.Key) > 0 {
+			_, _ = h.Write([]byte(i.Key))
+		} else {
+			_, _ = h.Write([]byte(i.Ip))
+			_, _ = h.Write([]byte{0xff})
+			_, _ = h.Write([]byte(i.UserAgent))
+		}
+
+		if expected := _mix64(h.Sum64()); i.Hash() != expected {
+			t.Errorf("%+v: expected %#x, got %#x", i, expected, i.Hash())
+		}
+	}
+
+	// хэш считается при построении ключа и совпадает с посчитанным заново
+	builder, _ := lib.NewIdentityBuilder(constants.DEFAULT_IDENTITY)
+	built := builder.Build(_parseWith(t, map[int]string{}))
+
+	if built.Hash() != (lib.UniqueIdentity{Key: built.Key}).Hash() {
+		t.Error("cached identity hash differs from the computed one")
+	}
+}
+
+func _mix64(x uint64) uint64 {
+	x = (x ^ (x >> 30)) * 0xBF58476D1CE4E5B9
+	x = (x ^ (x >> 27)) * 0x94D049BB133111EB
+	return x ^ (x >> 31)
+}
+
+// прежний ключ зрителя: md5 в hex строке
+func _md5Identity(i lib.UniqueIdentity) string {
+	hash := md5.Sum([]byte(i.Ip + i.UserAgent))
+	return hex.EncodeToString(hash[:])
+}
+
+func BenchmarkIdentityHash(b *testing.B) {
+	identity := _identity("karusel", 12345)
+
+	b.Run("md5", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = _md5Identity(identity)
+		}
+	})
+
+	b.Run("fnv1a-mix64", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = identity.Hash()
+		}
+	})
+}
+
+// память на миллион одновременных зрителей: одно и то же множество с ключами md5 в hex строке и uint64
+func BenchmarkOnlineMemory(b *testing.B) {
+	const viewers = 1000000
+
+	measure := func(b *testing.B, fill func() interface{}) {
+		var before, after runtime.MemStats
+
+		for n := 0; n < b.N; n++ {
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			state := fill()
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			runtime.KeepAlive(state)
+		}
+
+		// после сборки мусора куча может оказаться меньше, чем до заполнения
+		b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/viewers, "bytes/viewer")
+	}
+
+	b.Run("md5", func(b *testing.B) {
+		measure(b, func() interface{} {
+			connections := make(map[string]struct{})
+			for i := 0; i < viewers; i++ {
+				connections[_md5Identity(_identity("karusel", i))] = struct{}{}
+			}
+			return connections
+		})
+	})
+
+	b.Run("uint64", func(b *testing.B) {
+		measure(b, func() interface{} {
+			connections := make(map[uint64]struct{})
+			for i := 0; i < viewers; i++ {
+				connections[_identity("karusel", i).Hash()] = struct{}{}
+			}
+			return connections
+		})
+	})
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"github.com/LimeHD/limehd-syslog-server/constants"
+	"github.com/LimeHD/limehd-syslog-server/lib"
+	"gopkg.in/mcuadros/go-syslog.v2"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolDrain(t *testing.T) {
+	var received int64
+
+	pool := lib.NewPool(lib.PoolConfig{
+		ListenerCallback: func(q lib.Receiver) error {
+			atomic.AddInt64(&received, 1)
+			return nil
+		},
+		ReceiverCallback: func(p format.LogParts) (lib.Receiver, error) {
+			return lib.Receiver{}, nil
+		},
+		ErrorHandleCallback: func(err error) {},
+		PoolSize:            10,
+		WorkerPoolSize:      10,
+		ErrorPoolSize:       10,
+		WorkersCount:        2,
+		ErrorHandlerCount:   1,
+		WorkerFn: func(p *lib.Pool, channel syslog.LogPartsChannel) {
+			for logParts := range channel {
+				p.Task(logParts)
+			}
+		},
+	})
+
+	channel := make(syslog.LogPartsChannel, 1000)
+	pool.Run(channel, 2)
+
+	for i := 0; i < 1000; i++ {
+		channel <- format.LogParts{}
+	}
+	close(channel)
+
+	report := pool.Drain(time.Second * 5)
+
+	if report.Lost != 0 || atomic.LoadInt64(&received) != 1000 {
+		t.Errorf("expected all 1000 requests processed, got %d (report %+v)", received, report)
+	}
+}
+
+func TestPoolOverflow(t *testing.T) {
+	for _, policy := range []string{constants.POOL_OVERFLOW_DROP_NEWEST, constants.POOL_OVERFLOW_DROP_OLDEST} {
+		var mt sync.Mutex
+		seen := map[string]bool{}
+		release := make(chan struct{})
+		metrics := lib.NewPipelineMetrics()
+
+		pool := lib.NewPool(lib.PoolConfig{
+			ListenerCallback: func(q lib.Receiver) error {
+				return nil
+			},
+			ReceiverCallback: func(p format.LogParts) (lib.Receiver, error) {
+				// обработчик занят, пока очередь не переполнится
+				<-release
+
+				mt.Lock()
+				seen[p["content"].(string)] = true
+				mt.Unlock()
+
+				return lib.Receiver{}, nil
+			},
+			ErrorHandleCallback: func(err error) {},
+			PoolSize:            5,
+			WorkerPoolSize:      20,
+			ErrorPoolSize:       1,
+			WorkersCount:        1,
+			ErrorHandlerCount:   1,
+			OverflowPolicy:      policy,
+			Metrics:             metrics,
+		})
+
+		for i := 0; i < 20; i++ {
+			pool.Task(format.LogParts{"content": strconv.Itoa(i)})
+		}
+
+		close(release)
+		report := pool.Drain(time.Second * 5)
+		counters := metrics.Snapshot().Counters
+		dropped := counters["dropped_newest"] + counters["dropped_oldest"]
+
+		if dropped < 14 || report.Flushed+dropped != 20 {
+			t.Errorf("%s: expected 20 requests processed or dropped, got %d processed and %d dropped", policy, report.Flushed, dropped)
+		}
+
+		if last := seen["19"]; last != (policy == constants.POOL_OVERFLOW_DROP_OLDEST) {
+			t.Errorf("%s: unexpected processing of the newest request: %v", policy, last)
+		}
+	}
+}
+
+func TestPoolSampleByViewer(t *testing.T) {
+	metrics := lib.NewPipelineMetrics()
+	viewers := map[string]int{}
+
+	pool := lib.NewPool(lib.PoolConfig{
+		ListenerCallback: func(q lib.Receiver) error {
+			return nil
+		},
+		ReceiverCallback: func(p format.LogParts) (lib.Receiver, error) {
+			return lib.Receiver{}, nil
+		},
+		ErrorHandleCallback: func(err error) {},
+		// емкость 0: выборка работает на каждый лог, а принятые логи упираются в переполнение
+		PoolSize:          0,
+		WorkerPoolSize:    1,
+		ErrorPoolSize:     1,
+		ErrorHandlerCount: 1,
+		OverflowPolicy:    constants.POOL_OVERFLOW_SAMPLE,
+		SampleRate:        0.5,
+		SampleIdentity: func(p format.LogParts) lib.UniqueIdentity {
+			return lib.UniqueIdentity{Key: strconv.Itoa(p["viewer"].(int))}
+		},
+		Metrics: metrics,
+	})
+
+	for round := 0; round < 3; round++ {
+		for viewer := 0; viewer < 20000; viewer++ {
+			before := metrics.Snapshot().Counters["dropped_sampled"]
+			pool.Task(format.LogParts{"viewer": viewer})
+
+			if metrics.Snapshot().Counters["dropped_sampled"] > before {
+				viewers[strconv.Itoa(viewer)]++
+			}
+		}
+	}
+
+	pool.Drain(time.Second)
+
+	for viewer, drops := range viewers {
+		if drops != 3 {
+			t.Fatalf("viewer %s expected to be sampled out in every round, got %d", viewer, drops)
+		}
+	}
+
+	if len(viewers) < 9500 || len(viewers) > 10500 {
+		t.Errorf("expected half of viewers sampled out, got %d", len(viewers))
+	}
+
+	if lib.ValidateOverflowPolicy("random", 0.5) == nil {
+		t.Error("expected unknown overflow policy to be rejected")
+	}
+
+	for _, rate := range []float64{0, -0.5, 1.5} {
+		if lib.ValidateOverflowPolicy(constants.POOL_OVERFLOW_SAMPLE, rate) == nil {
+			t.Errorf("expected sample rate %v to be rejected", rate)
+		}
+	}
+
+	if lib.ValidateOverflowPolicy(constants.POOL_OVERFLOW_BLOCK, 0) != nil {
+		t.Error("sample rate is not used by the block policy")
+	}
+}
+
+func TestPoolDrainTimeout(t *testing.T) {
+	var received int64
+
+	pool := lib.NewPool(lib.PoolConfig{
+		ListenerCallback: func(q lib.Receiver) error {
+			time.Sleep(time.Millisecond * 5)
+			atomic.AddInt64(&received, 1)
+			return nil
+		},
+		ReceiverCallback: func(p format.LogParts) (lib.Receiver, error) {
+			return lib.Receiver{}, nil
+		},
+		ErrorHandleCallback: func(err error) {},
+		PoolSize:            10,
+		WorkerPoolSize:      10,
+		ErrorPoolSize:       10,
+		WorkersCount:        1,
+		SenderCount:         1,
+		ErrorHandlerCount:   1,
+		WorkerFn: func(p *lib.Pool, channel syslog.LogPartsChannel) {
+			for logParts := range channel {
+				p.Task(logParts)
+			}
+		},
+	})
+
+	channel := make(syslog.LogPartsChannel, 200)
+	pool.Run(channel, 1)
+
+	for i := 0; i < 200; i++ {
+		channel <- format.LogParts{}
+	}
+	close(channel)
+
+	report := pool.Drain(time.Millisecond * 50)
+	processed := atomic.LoadInt64(&received)
+
+	if report.Lost == 0 {
+		t.Fatalf("expected lost requests on timeout, got %+v", report)
+	}
+
+	// каждый запрос либо обработан, либо посчитан потерянным
+	if processed+report.Lost != 200 {
+		t.Errorf("processed %d and lost %d do not add up to 200", processed, report.Lost)
+	}
+
+	// после возврата Drain обработчики больше ничего не передают дальше
+	time.Sleep(time.Millisecond * 50)
+
+	if atomic.LoadInt64(&received) != processed {
+		t.Errorf("requests processed after drain: %d, then %d", processed, atomic.LoadInt64(&received))
+	}
+}
+
+func TestPoolRecoversPanics(t *testing.T) {
+	path := "./tmp/quarantine_test.log"
+	_ = os.Remove(path)
+	defer os.Remove(path)
+
+	quarantine, err := lib.NewQuarantine(lib.QuarantineConfig{Path: path})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received, handled int64
+	metrics := lib.NewPipelineMetrics()
+
+	pool := lib.NewPool(lib.PoolConfig{
+		ListenerCallback: func(q lib.Receiver) error {
+			if q.Filtered == "poison" {
+				panic("listener")
+			}
+			atomic.AddInt64(&received, 1)
+			return nil
+		},
+		ReceiverCallback: func(p format.LogParts) (lib.Receiver, error) {
+			switch p["content"] {
+			case "parse":
+				var parts map[string]int
+				parts["crash"]++
+			case "aggregate":
+				return lib.Receiver{Filtered: "poison"}, nil
+			}
+			return lib.Receiver{}, nil
+		},
+		ErrorHandleCallback: func(err error) {
+			if atomic.AddInt64(&handled, 1) == 1 {
+				panic("error handler")
+			}
+		},
+		PoolSize:          10,
+		WorkerPoolSize:    10,
+		ErrorPoolSize:     10,
+		WorkersCount:      1,
+		ErrorHandlerCount: 1,
+		Metrics:           metrics,
+		Quarantine:        quarantine,
+		WorkerFn: func(p *lib.Pool, channel syslog.LogPartsChannel) {
+			for logParts := range channel {
+				p.Task(logParts)
+			}
+		},
+	})
+
+	channel := make(syslog.LogPartsChannel, 100)
+	pool.Run(channel, 1)
+
+	for i := 0; i < 100; i++ {
+		content := "ok"
+
+		if i == 10 {
+			content = "parse"
+		} else if i == 20 {
+			content = "aggregate"
+		}
+
+		channel <- format.LogParts{"content": content}
+	}
+	close(channel)
+
+	pool.Drain(time.Second * 5)
+	quarantine.Close()
+
+	// 98 нормальных сообщений обработаны тем же единственным потоком, ошибки обеих паник дошли до обработчика,
+	// который сам упал на первой из них
+	if received != 98 || handled != 2 || metrics.Snapshot().Counters["panics"] != 3 {
+		t.Errorf("expected 98 processed, 2 handled errors and 3 panics, got %d, %d and %v", received, handled, metrics.Snapshot().Counters)
+	}
+
+	content, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+
+	if len(lines) != 3 || !strings.Contains(lines[0], `"message":{"content":"parse"}`) || !strings.Contains(lines[0], "goroutine") {
+		t.Errorf("expected 3 quarantined messages with stack, got %s", content)
+	}
+}
+
+func TestQuarantineLimits(t *testing.T) {
+	path := "./tmp/quarantine_limits_test.log"
+	defer os.Remove(path)
+
+	failure := lib.PanicError{Stage: "parse", Value: "poison", Message: format.LogParts{"content": "poison"}, Stack: []byte("goroutine 1")}
+
+	for _, config := range []lib.QuarantineConfig{{Path: path, Rate: 2}, {Path: path, MaxSize: 300}} {
+		_ = os.Remove(path)
+		quarantine, err := lib.NewQuarantine(config)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		written := 0
+		for i := 0; i < 5; i++ {
+			ok, err := quarantine.Write(failure)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ok {
+				written++
+			}
+		}
+		quarantine.Close()
+
+		content, _ := ioutil.ReadFile(path)
+		lines := strings.Count(string(content), "\n")
+
+		if written != lines || written == 0 || written >= 5 || (config.Rate > 0 && written != 2) {
+			t.Errorf("%+v: expected limited quarantine, got %d written and %d lines", config, written, lines)
+		}
+	}
+}
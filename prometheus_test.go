@@ -0,0 +1,89 @@
+package main
+
+import (
+	"github.com/LimeHD/limehd-syslog-server/lib"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrometheusSinkExposition(t *testing.T) {
+	prometheus, err := lib.NewPrometheusSink(lib.PrometheusSinkConfig{
+		Labels: []string{"channel", "quality"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := lib.InfluxRequestParams{
+		InfluxRequestTags:   lib.InfluxRequestTags{Channel: "domashniy", Quality: "vh1w", CountryName: "RU"},
+		InfluxRequestFields: lib.InfluxRequestFields{BytesSent: 100},
+	}
+
+	_ = prometheus.WriteTraffic([]lib.InfluxRequestParams{params, params})
+	_ = prometheus.WriteTraffic([]lib.InfluxRequestParams{params})
+
+	recorder := httptest.NewRecorder()
+	prometheus.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+
+	for _, line := range []string{
+		`limehd_syslog_bytes_sent_total{channel="domashniy",quality="vh1w"} 300`,
+		`limehd_syslog_requests_total{channel="domashniy",quality="vh1w"} 3`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("exposition does not contain %q:\n%s", line, body)
+		}
+	}
+
+	if strings.Contains(body, "country") {
+		t.Error("labels outside of the configured set must not be exported")
+	}
+
+	if _, err := lib.NewPrometheusSink(lib.PrometheusSinkConfig{Labels: []string{"user_agent"}}); err == nil {
+		t.Error("unknown labels must be rejected")
+	}
+}
+
+func TestPrometheusSinkSampledAndUnbuffered(t *testing.T) {
+	prometheus, err := lib.NewPrometheusSink(lib.PrometheusSinkConfig{
+		Labels: []string{"channel"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// без буфера: асинхронный приемник терял бы пачки, счетчики Prometheus обновляются сразу
+	fanOut := lib.NewFanOutSink(lib.FanOutSinkConfig{
+		Sinks:      []lib.Sink{prometheus},
+		BufferSize: 0,
+	})
+	defer fanOut.Close()
+
+	// четверть зрителей в выборке: трафик уже пересчитан, запрос представляет 4 запроса
+	params := lib.InfluxRequestParams{
+		InfluxRequestTags:   lib.InfluxRequestTags{Channel: "domashniy"},
+		InfluxRequestFields: lib.InfluxRequestFields{BytesSent: 400, SampleRate: 0.25},
+	}
+
+	for i := 0; i < 100; i++ {
+		if err := fanOut.WriteTraffic([]lib.InfluxRequestParams{params}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	prometheus.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+
+	for _, line := range []string{
+		`limehd_syslog_bytes_sent_total{channel="domashniy"} 40000`,
+		`limehd_syslog_requests_total{channel="domashniy"} 400`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("exposition does not contain %q:\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"github.com/LimeHD/limehd-syslog-server/lib"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestViewerSampler(t *testing.T) {
+	sampler, err := lib.NewViewerSampler(lib.ViewerSamplerConfig{Rate: 0.25})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	online := lib.NewOnline()
+	kept := 0
+
+	for i := 0; i < 40000; i++ {
+		identity := _identity("karusel", i)
+		rate, sampled := sampler.Sample(identity)
+
+		// решение по зрителю не меняется от запроса к запросу
+		if _, again := sampler.Sample(identity); again != sampled || rate != 0.25 {
+			t.Fatalf("viewer %d sampled inconsistently", i)
+		}
+
+		if sampled {
+			kept++
+			online.Peek(identity)
+		}
+	}
+
+	if kept < 9000 || kept > 11000 {
+		t.Errorf("expected about a quarter of viewers sampled, got %d", kept)
+	}
+
+	params := sampler.ScaleOnline(lib.InfluxOnlineRequestParams{
+		Channels: online.Connections(),
+		Total:    kept,
+	})
+
+	if estimate := params.Channels["karusel"].Count(); estimate < 36000 || estimate > 44000 || params.SampleRate != 0.25 {
+		t.Errorf("expected scaled online about 40000 at rate 0.25, got %d at %v", estimate, params.SampleRate)
+	}
+
+	if lib.ScaleSampled(1000, 0.25) != 4000 || lib.ScaleSampled(1000, 1) != 1000 {
+		t.Error("unexpected bytes scaling")
+	}
+}
+
+// пул при перегрузке выбирает из тех же зрителей, онлайн пересчитывается по наибольшей доле окна
+func TestViewerSamplerLimit(t *testing.T) {
+	sampler, _ := lib.NewViewerSampler(lib.ViewerSamplerConfig{Rate: 0.5})
+
+	for i := 0; i < 10000; i++ {
+		identity := _identity("karusel", i)
+		limited, inPool := sampler.SampleAt(identity, 0.25)
+		rate, sampled := sampler.Sample(identity)
+
+		if limited != 0.25 || rate != 0.5 || (inPool && !sampled) {
+			t.Fatalf("viewer %d: sampled by the pool at %v but not at %v", i, limited, rate)
+		}
+	}
+
+	if params := sampler.ScaleOnline(lib.InfluxOnlineRequestParams{Total: 100}); params.SampleRate != 0.5 || params.Total != 200 {
+		t.Errorf("expected online scaled by the largest window rate 0.5, got %d at %v", params.Total, params.SampleRate)
+	}
+
+	sampler.SampleAt(_identity("karusel", 1), 0.25)
+
+	if params := sampler.ScaleOnline(lib.InfluxOnlineRequestParams{Total: 100}); params.SampleRate != 0.25 || params.Total != 400 {
+		t.Errorf("expected online scaled by the pool rate 0.25 for a fully overloaded window, got %d at %v", params.Total, params.SampleRate)
+	}
+}
+
+// без токена доля только читается, с токеном меняется по Authorization: Bearer
+func TestViewerSamplerHttp(t *testing.T) {
+	readOnly, _ := lib.NewViewerSampler(lib.ViewerSamplerConfig{Rate: 1})
+
+	if status := _postRate(t, readOnly, "0.1", ""); status != http.StatusForbidden || readOnly.Rate() != 1 {
+		t.Errorf("expected read-only sampler, got %v (status %d)", readOnly.Rate(), status)
+	}
+
+	sampler, _ := lib.NewViewerSampler(lib.ViewerSamplerConfig{Rate: 1, Token: "secret"})
+
+	if status := _postRate(t, sampler, "0.1", "wrong"); status != http.StatusUnauthorized || sampler.Rate() != 1 {
+		t.Errorf("expected wrong token rejected, got %v (status %d)", sampler.Rate(), status)
+	}
+
+	if status := _postRate(t, sampler, "0.1", "secret"); status != http.StatusOK || sampler.Rate() != 0.1 {
+		t.Errorf("expected rate changed to 0.1, got %v (status %d)", sampler.Rate(), status)
+	}
+
+	if status := _postRate(t, sampler, "2", "secret"); status != http.StatusBadRequest || sampler.Rate() != 0.1 {
+		t.Errorf("expected invalid rate rejected, got %v (status %d)", sampler.Rate(), status)
+	}
+
+	if _, err := lib.NewViewerSampler(lib.ViewerSamplerConfig{Rate: 0}); err == nil {
+		t.Error("expected invalid rate error")
+	}
+}
+
+func _postRate(t *testing.T, sampler *lib.ViewerSampler, rate string, token string) int {
+	request := httptest.NewRequest(http.MethodPost, "/sampling", strings.NewReader(url.Values{"rate": {rate}}.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	if len(token) > 0 {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	recorder := httptest.NewRecorder()
+	sampler.ServeHTTP(recorder, request)
+
+	return recorder.Code
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"github.com/LimeHD/limehd-syslog-server/constants"
+	"github.com/LimeHD/limehd-syslog-server/lib"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// разбирает строку лога с заданным uri через настоящий шаблон
+func _parseUri(t *testing.T, uri string) lib.Log {
+	return _parseWith(t, map[int]string{6: uri})
+}
+
+// разбирает строку лога, заменив значения на указанных позициях шаблона
+func _parseWith(t *testing.T, values map[int]string) lib.Log {
+	line := make([]string, len(nginxLogFormatSlice))
+	copy(line, nginxLogFormatSlice)
+
+	for pos, value := range values {
+		line[pos] = value
+	}
+
+	parser, _ := _parsers(t)
+	log, err := parser.Parse(map[string]interface{}{
+		"client":  "127.0.0.1:38001",
+		"content": strings.Join(line, constants.LOG_DELIM),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return log
+}
+
+func TestSessionTracker(t *testing.T) {
+	sessions := lib.NewSessionTracker(lib.SessionTrackerConfig{
+		IdleTimeout:     time.Millisecond * 100,
+		SegmentDuration: time.Second * 6,
+	})
+
+	viewer := _identity("muztv", 1)
+	low := lib.Receiver{Parser: _parseUri(t, "/streaming/muztv/324/vl2w/segment-1597220444-01972046.ts")}
+	high := lib.Receiver{Parser: _parseUri(t, "/streaming/muztv/324/vh1w/segment-1597220445-01972047.ts")}
+	playlist := lib.Receiver{Parser: _parseUri(t, "/streaming/muztv/324/vh1w/playlist.m3u8")}
+
+	// плейлисты сессию не открывают
+	sessions.Track(viewer, playlist)
+
+	if sessions.Open() != 0 {
+		t.Fatal("playlist must not open a session")
+	}
+
+	sessions.Track(viewer, low)
+	time.Sleep(time.Millisecond * 50)
+	sessions.Track(viewer, high)
+
+	sessions.Sweep()
+
+	if sessions.Open() != 1 {
+		t.Fatal("active session must not be closed")
+	}
+
+	time.Sleep(time.Millisecond * 150)
+	sessions.Sweep()
+
+	report := sessions.Collect()
+
+	if len(report.Records) != 1 {
+		t.Fatalf("expected 1 closed session, got %d", len(report.Records))
+	}
+
+	record := report.Records[0]
+
+	if record.Channel != "muztv" || record.BytesSent != 808 || strings.Join(record.Qualities, ",") != "vh1w,vl2w" {
+		t.Errorf("unexpected session %+v", record)
+	}
+
+	if record.Duration < time.Second*6+time.Millisecond*50 {
+		t.Errorf("session duration %v is too short", record.Duration)
+	}
+
+	if watchTime := report.WatchTime["muztv"]; watchTime.Sessions != 1 || watchTime.AverageDuration != record.Duration {
+		t.Errorf("unexpected watch time %+v", watchTime)
+	}
+
+	if len(sessions.Collect().Records) != 0 {
+		t.Error("collect must drop reported sessions")
+	}
+
+	// сессия из одного сегмента длится один сегмент
+	sessions.Track(viewer, low)
+	sessions.CloseAll()
+
+	if records := sessions.Collect().Records; len(records) != 1 || records[0].Duration != time.Second*6 {
+		t.Errorf("unexpected single segment session %+v", records)
+	}
+}
+
+// по выборке зрителей каждая сессия весит 1/rate
+func TestSessionWatchTimeSampled(t *testing.T) {
+	sessions := lib.NewSessionTracker(lib.SessionTrackerConfig{
+		IdleTimeout:     time.Minute,
+		SegmentDuration: time.Second * 6,
+	})
+	segment := lib.Receiver{
+		Parser:     _parseUri(t, "/streaming/muztv/324/vl2w/segment-1597220444-01972046.ts"),
+		SampleRate: 0.25,
+	}
+
+	for i := 0; i < 3; i++ {
+		sessions.Track(_identity("muztv", i), segment)
+	}
+	sessions.CloseAll()
+
+	report := sessions.Collect()
+
+	if watchTime := report.WatchTime["muztv"]; watchTime.Sessions != 12 || watchTime.AverageDuration != time.Second*6 {
+		t.Errorf("expected 12 sessions of 6s, got %+v", watchTime)
+	}
+
+	if report.Records[0].SampleRate != 0.25 {
+		t.Errorf("expected session sample rate 0.25, got %v", report.Records[0].SampleRate)
+	}
+}
+
+func TestSessionCollectDoesNotLoseSessions(t *testing.T) {
+	sessions := lib.NewSessionTracker(lib.SessionTrackerConfig{
+		IdleTimeout: time.Minute,
+	})
+	segment := lib.Receiver{Parser: _parseUri(t, "/streaming/muztv/324/vl2w/segment-1597220444-01972046.ts")}
+
+	done := make(chan bool)
+	go func() {
+		// сессии закрываются, пока планировщик забирает пачки
+		for i := 0; i < 1000; i++ {
+			sessions.Track(_identity("muztv", i), segment)
+			sessions.CloseAll()
+		}
+		close(done)
+	}()
+
+	collected := 0
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+
+		collected += len(sessions.Collect().Records)
+	}
+
+	if collected != 1000 {
+		t.Errorf("expected 1000 collected sessions, got %d", collected)
+	}
+}
+
+func TestSessionConcurrentTrack(t *testing.T) {
+	sessions := lib.NewSessionTracker(lib.SessionTrackerConfig{
+		IdleTimeout: time.Minute,
+	})
+	segment := lib.Receiver{Parser: _parseUri(t, "/streaming/muztv/324/vl2w/segment-1597220444-01972046.ts")}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 35; worker++ {
+		wg.Add(1)
+
+		// каждый зритель приходит от нескольких обработчиков
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 1000; i++ {
+				sessions.Track(_identity("muztv", i), segment)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if sessions.Open() != 1000 {
+		t.Errorf("expected 1000 open sessions, got %d", sessions.Open())
+	}
+
+	sessions.CloseAll()
+
+	if records := sessions.Collect().Records; len(records) != 1000 || sessions.Open() != 0 {
+		t.Errorf("expected 1000 closed sessions, got %d", len(records))
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"github.com/LimeHD/limehd-syslog-server/lib"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memorySink struct {
+	mt      sync.Mutex
+	traffic int
+	online  int
+	closed  bool
+	fail    bool
+}
+
+func (m *memorySink) WriteTraffic(params []lib.InfluxRequestParams) error {
+	if m.fail {
+		return errors.New("sink is down")
+	}
+
+	m.mt.Lock()
+	m.traffic += len(params)
+	m.mt.Unlock()
+
+	return nil
+}
+
+func (m *memorySink) WriteOnline(params lib.InfluxOnlineRequestParams) error {
+	if m.fail {
+		return errors.New("sink is down")
+	}
+
+	m.mt.Lock()
+	m.online++
+	m.mt.Unlock()
+
+	return nil
+}
+
+func (m *memorySink) Close() {
+	m.closed = true
+}
+
+// приемник, который не отвечает, пока не закроют release
+type stuckSink struct {
+	memorySink
+	release chan struct{}
+}
+
+func (s *stuckSink) WriteTraffic(params []lib.InfluxRequestParams) error {
+	<-s.release
+	return nil
+}
+
+func TestFanOutSinkDrainTimeout(t *testing.T) {
+	stuck := &stuckSink{release: make(chan struct{})}
+	defer close(stuck.release)
+
+	healthy := &memorySink{}
+	metrics := lib.NewPipelineMetrics()
+	var lost error
+
+	fanOut := lib.NewFanOutSink(lib.FanOutSinkConfig{
+		Sinks:        []lib.Sink{stuck, healthy},
+		BufferSize:   10,
+		Metrics:      metrics,
+		DrainTimeout: time.Millisecond * 100,
+		ErrorHandler: func(err error) {
+			lost = err
+		},
+	})
+
+	for i := 0; i < 5; i++ {
+		_ = fanOut.WriteTraffic(make([]lib.InfluxRequestParams, 1))
+	}
+
+	start := time.Now()
+	fanOut.Close()
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("close waited for the stuck sink: %v", elapsed)
+	}
+
+	// первая пачка зависла в записи, остальные четыре потеряны
+	if dropped := metrics.Counter("sink_dropped_shutdown").Value(); dropped != 4 {
+		t.Errorf("expected 4 dropped batches, got %d", dropped)
+	}
+
+	if lost == nil {
+		t.Error("expected drain timeout error")
+	}
+
+	if healthy.traffic != 5 || !healthy.closed {
+		t.Errorf("healthy sink got traffic=%d closed=%v", healthy.traffic, healthy.closed)
+	}
+
+	if stuck.closed {
+		t.Error("stuck sink must not be closed in the middle of a write")
+	}
+}
+
+func TestFanOutSink(t *testing.T) {
+	healthy := &memorySink{}
+	broken := &memorySink{fail: true}
+	errorsCount := 0
+
+	fanOut := lib.NewFanOutSink(lib.FanOutSinkConfig{
+		Sinks:      []lib.Sink{broken, healthy},
+		BufferSize: 10,
+		ErrorHandler: func(err error) {
+			errorsCount++
+		},
+	})
+
+	for i := 0; i < 5; i++ {
+		if err := fanOut.WriteTraffic(make([]lib.InfluxRequestParams, 2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := fanOut.WriteOnline(lib.InfluxOnlineRequestParams{}); err != nil {
+		t.Fatal(err)
+	}
+
+	fanOut.Close()
+
+	if healthy.traffic != 10 || healthy.online != 1 {
+		t.Errorf("healthy sink got traffic=%d online=%d", healthy.traffic, healthy.online)
+	}
+
+	if errorsCount != 6 {
+		t.Errorf("expected 6 errors from broken sink, got %d", errorsCount)
+	}
+
+	if !healthy.closed || !broken.closed {
+		t.Error("all sinks must be closed")
+	}
+
+	// планировщик, сработавший после остановки, не должен уронить сервис
+	if err := fanOut.WriteTraffic(make([]lib.InfluxRequestParams, 1)); err == nil {
+		t.Error("expected error when writing to closed sinks")
+	}
+}
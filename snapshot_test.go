@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/LimeHD/limehd-syslog-server/constants"
+	"github.com/LimeHD/limehd-syslog-server/lib"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func _snapshotCounters(t *testing.T) map[string]lib.OnlineCounter {
+	hll, err := lib.NewHyperLogLogOnline(12)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]lib.OnlineCounter{
+		"online":            lib.NewOnlineExact(),
+		"dimension:country": hll,
+		"dimension:quality": lib.NewSlidingOnline(60),
+	}
+}
+
+func TestOnlineSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "online.snapshot")
+	logger := lib.NewFileLogger(lib.LoggerConfig{})
+
+	before := _snapshotCounters(t)
+	for _, counter := range before {
+		for i := 0; i < 500; i++ {
+			counter.Peek(_identity("domashniy", i))
+		}
+		counter.Peek(_identity("karusel", 0))
+	}
+
+	snapshot := lib.NewOnlineSnapshot(lib.OnlineSnapshotConfig{
+		Path:     path,
+		MaxAge:   time.Minute,
+		Counters: before,
+		Logger:   logger,
+	})
+
+	if err := snapshot.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	after := _snapshotCounters(t)
+	restored, err := lib.NewOnlineSnapshot(lib.OnlineSnapshotConfig{
+		Path:     path,
+		MaxAge:   time.Minute,
+		Counters: after,
+		Logger:   logger,
+	}).Restore()
+
+	if err != nil || !restored {
+		t.Fatalf("snapshot is not restored: %v", err)
+	}
+
+	for name, counter := range before {
+		expected := counter.Connections()
+		actual := after[name].Connections()
+
+		for channel, c := range expected {
+			if actual[channel] == nil || actual[channel].Count() != c.Count() {
+				t.Errorf("%s: channel %s is not restored", name, channel)
+			}
+		}
+	}
+
+	// снимок другого режима не подходит
+	mismatched := _snapshotCounters(t)
+	mismatched["online"] = lib.NewSlidingOnline(60)
+
+	if _, err := lib.NewOnlineSnapshot(lib.OnlineSnapshotConfig{
+		Path:     path,
+		MaxAge:   time.Minute,
+		Counters: mismatched,
+		Logger:   logger,
+	}).Restore(); err == nil {
+		t.Error("expected mismatch error")
+	}
+
+	// отсутствующий снимок - не ошибка
+	if restored, err := lib.NewOnlineSnapshot(lib.OnlineSnapshotConfig{
+		Path:     filepath.Join(dir, "missing"),
+		MaxAge:   time.Minute,
+		Counters: _snapshotCounters(t),
+		Logger:   logger,
+	}).Restore(); err != nil || restored {
+		t.Errorf("missing snapshot: restored=%v, err=%v", restored, err)
+	}
+}
+
+func TestOnlineSnapshotPartialRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "online.snapshot")
+	logger := lib.NewFileLogger(lib.LoggerConfig{})
+
+	before := _snapshotCounters(t)
+	for _, counter := range before {
+		for i := 0; i < 500; i++ {
+			counter.Peek(_identity("domashniy", i))
+		}
+	}
+
+	if err := lib.NewOnlineSnapshot(lib.OnlineSnapshotConfig{
+		Path:     path,
+		MaxAge:   time.Minute,
+		Counters: before,
+		Logger:   logger,
+	}).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// обрезаем последний счетчик в потоке, первые читаются без ошибок
+	info, err := os.Stat(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Truncate(path, info.Size()-16); err != nil {
+		t.Fatal(err)
+	}
+
+	after := _snapshotCounters(t)
+	for _, counter := range after {
+		counter.Peek(_identity("karusel", 0))
+	}
+
+	if restored, err := lib.NewOnlineSnapshot(lib.OnlineSnapshotConfig{
+		Path:     path,
+		MaxAge:   time.Minute,
+		Counters: after,
+		Logger:   logger,
+	}).Restore(); err == nil || restored {
+		t.Fatalf("truncated snapshot: restored=%v, err=%v", restored, err)
+	}
+
+	// ни один счетчик не получил часть снимка
+	for name, counter := range after {
+		connections := counter.Connections()
+
+		if connections["domashniy"] != nil || connections["karusel"] == nil {
+			t.Errorf("%s: state is changed by failed restore", name)
+		}
+	}
+}
+
+// поля совпадают со снимками скетчей, gob сопоставляет их по именам
+type _sketchSnapshot struct {
+	LastFlushedAt int64
+	Precision     uint8
+	Sketches      map[string][]uint8
+}
+
+type _audienceSnapshot struct {
+	Precision uint8
+	Hash      string
+	Periods   []_audiencePeriodSnapshot
+}
+
+type _audiencePeriodSnapshot struct {
+	Kind     string
+	Start    int64
+	Channels map[string][]uint8
+	Total    []uint8
+}
+
+func TestRestoreTruncatedSketches(t *testing.T) {
+	hll, err := lib.NewHyperLogLogOnline(12)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buffer bytes.Buffer
+	_ = gob.NewEncoder(&buffer).Encode(_sketchSnapshot{
+		LastFlushedAt: time.Now().Unix(),
+		Precision:     12,
+		Sketches:      map[string][]uint8{"karusel": make([]uint8, 100)},
+	})
+
+	if _, err := hll.Restore(&buffer); err == nil {
+		t.Error("Truncated online sketch is restored")
+	}
+
+	// после неудачного восстановления счетчик продолжает работать
+	hll.Peek(_identity("karusel", 1))
+
+	dir, err := ioutil.TempDir("", "audience")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audience.snapshot")
+	file, err := os.Create(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = gob.NewEncoder(file).Encode(_audienceSnapshot{
+		Precision: 14,
+		Hash:      constants.IDENTITY_HASH,
+		Periods: []_audiencePeriodSnapshot{
+			{Kind: "day", Start: time.Now().Unix(), Channels: map[string][]uint8{}, Total: make([]uint8, 1<<14-1)},
+		},
+	})
+	_ = file.Close()
+
+	audience, err := lib.NewAudienceCounter(lib.AudienceCounterConfig{
+		Path:      path,
+		Precision: 14,
+		Logger:    lib.NewFileLogger(lib.LoggerConfig{}),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := audience.Restore(); err == nil || ok {
+		t.Error("Truncated audience sketch is restored")
+	}
+
+	audience.Peek(_identity("karusel", 1))
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"github.com/LimeHD/limehd-syslog-server/lib"
+	"gopkg.in/mcuadros/go-syslog.v2"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+const procNetUdp = `   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  120: 00000000:0202 00000000:0000 07 00000000:00000400 00:00000000 00000000     0        0 31337 2 0000000000000000 17
+  121: 00000000:0202 00000000:0000 07 00000000:00000100 00:00000000 00000000     0        0 31338 2 0000000000000000 3
+  300: 0100007F:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000   101        0 12345 2 0000000000000000 99
+`
+
+func TestParseProcNetUdp(t *testing.T) {
+	stats, err := lib.ParseProcNetUdp(strings.NewReader(procNetUdp), 514)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Sockets != 2 || stats.RxQueue != 0x500 || stats.Drops != 20 {
+		t.Errorf("expected 2 sockets with 1280 queued bytes and 20 drops, got %+v", stats)
+	}
+}
+
+func TestUdpIngest(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT ingestion is linux only")
+	}
+
+	metrics := lib.NewPipelineMetrics()
+	ingest := lib.NewUdpIngest(lib.UdpIngestConfig{
+		Address:   "127.0.0.1:0",
+		Sockets:   4,
+		BatchSize: 8,
+		Metrics:   metrics,
+		Logger:    lib.NewFileLogger(lib.LoggerConfig{}),
+	})
+
+	if err := ingest.Listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	channel := make(syslog.LogPartsChannel, 1000)
+	ingest.Run(channel)
+
+	conn, err := net.Dial("udp", ingest.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		_, _ = fmt.Fprintf(conn, "<190>Aug 11 14:01:32 syslog-server nginx: %s\n", _getNginxFormatString())
+	}
+	_ = conn.Close()
+
+	received := 0
+	timeout := time.After(time.Second * 5)
+
+	for received < 100 {
+		select {
+		case parts := <-channel:
+			received++
+
+			if parts["content"] != _getNginxFormatString() || !strings.HasPrefix(parts["client"].(string), "127.0.0.1:") {
+				t.Fatalf("unexpected log parts %v", parts)
+			}
+		case <-timeout:
+			t.Fatalf("expected 100 datagrams, got %d", received)
+		}
+	}
+
+	ingest.Close()
+	ingest.Wait()
+
+	if stats, err := lib.ReadUdpStats(lib.UdpPort(ingest.Addr().String())); err == nil && stats.Sockets != 0 {
+		t.Errorf("expected sockets closed, got %+v", stats)
+	}
+
+	if metrics.Snapshot().Counters["udp_datagrams"] != 100 {
+		t.Errorf("expected 100 datagrams counted, got %v", metrics.Snapshot().Counters)
+	}
+}
+
+func TestUdpIngestIpv6Hostname(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT ingestion is linux only")
+	}
+
+	ingest := lib.NewUdpIngest(lib.UdpIngestConfig{
+		Address: "[::1]:0",
+		Sockets: 1,
+		Logger:  lib.NewFileLogger(lib.LoggerConfig{}),
+	})
+
+	if err := ingest.Listen(); err != nil {
+		t.Skipf("IPv6 loopback is not available: %v", err)
+	}
+
+	channel := make(syslog.LogPartsChannel, 1)
+	ingest.Run(channel)
+
+	defer func() {
+		ingest.Close()
+		ingest.Wait()
+	}()
+
+	conn, err := net.Dial("udp", ingest.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// без заголовка syslog имя хоста берется из адреса отправителя
+	_, _ = fmt.Fprint(conn, "<190>nginx: hello")
+	_ = conn.Close()
+
+	select {
+	case parts := <-channel:
+		if parts["hostname"] != "::1" {
+			t.Errorf("expected hostname ::1, got %q from %v", parts["hostname"], parts["client"])
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected datagram over IPv6")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/LimeHD/limehd-syslog-server/lib"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func _device(deviceType, os, app string) lib.DeviceInfo {
+	return lib.DeviceInfo{DeviceType: deviceType, Os: os, App: app}
+}
+
+func TestUserAgentClassifier(t *testing.T) {
+	classifier, err := lib.NewUserAgentClassifier(lib.UserAgentClassifierConfig{CacheSize: 2})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]lib.DeviceInfo{
+		"Mozilla/5.0 (Web0S; Linux/SmartTV) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/53.0.2785.34 Safari/537.36 WebAppManager":               _device("smarttv", "webos", "browser"),
+		"Mozilla/5.0 (SMART-TV; Linux; Tizen 5.0) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/2.2 Chrome/63.0.3239.84 TV Safari/537.36": _device("smarttv", "tizen", "browser"),
+		"LimeHD/2.3.1 ExoPlayerLib/2.11.4 (Linux;Android 9) ExoPlayerLib/2.11.4":                                                                  _device("mobile", "android", "limehd"),
+		"AppleCoreMedia/1.0.0.17E262 (iPhone; U; CPU OS 13_4_1 like Mac OS X; ru_ru)":                                                             _device("mobile", "ios", "avplayer"),
+		"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/69.0.3497.100 Safari/537.36":                               _device("desktop", "linux", "browser"),
+		"Mozilla/5.0 (compatible; YandexBot/3.0; +http://yandex.com/bots)":                                                                        _device("bot", "unknown", "browser"),
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)":                                                                _device("bot", "unknown", "browser"),
+		"Mozilla/5.0 (Linux; Android 10; CUBOT X30) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/86.0.4240.185 Mobile Safari/537.36":             _device("mobile", "android", "browser"),
+		"Lavf/58.29.100": _device("unknown", "unknown", "ffmpeg"),
+		"-":              _device("unknown", "unknown", "unknown"),
+	}
+
+	// второй проход идет через кэш
+	for pass := 0; pass < 2; pass++ {
+		for userAgent, expected := range cases {
+			if actual := classifier.Classify(userAgent); actual != expected {
+				t.Errorf("%s: expected %+v, got %+v", userAgent, expected, actual)
+			}
+		}
+	}
+}
+
+func TestUserAgentClassifierRulesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ua")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "ua.rules")
+	rules := "# своя приставка\nstb|android_tv|-|(?i)limehd-box\n"
+
+	if err := ioutil.WriteFile(path, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	classifier, err := lib.NewUserAgentClassifier(lib.UserAgentClassifierConfig{RulesFile: path})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := lib.DeviceInfo{DeviceType: "stb", Os: "android_tv", App: "limehd"}
+
+	if actual := classifier.Classify("LimeHD/2.3.1 (LimeHD-Box; Linux;Android 9)"); actual != expected {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("stb|(?i)box\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := lib.NewUserAgentClassifier(lib.UserAgentClassifierConfig{RulesFile: path}); err == nil {
+		t.Error("expected invalid rule error")
+	}
+}